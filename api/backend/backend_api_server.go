@@ -1,20 +1,27 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 
 	"go.uber.org/zap"
 
-	"github.com/adjust/rmq"
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
 	"github.com/n1207n/video-transcode-queue/api/common/database"
 	"github.com/n1207n/video-transcode-queue/api/common/entity"
+	"github.com/n1207n/video-transcode-queue/api/common/probe"
+	"github.com/n1207n/video-transcode-queue/api/common/profile"
+	"github.com/n1207n/video-transcode-queue/api/common/queue"
+	"github.com/n1207n/video-transcode-queue/api/common/schema"
+	"github.com/n1207n/video-transcode-queue/api/common/server"
+	"github.com/n1207n/video-transcode-queue/api/common/storage"
+	"github.com/n1207n/video-transcode-queue/api/common/webhook"
 
 	redis "gopkg.in/redis.v3"
 )
@@ -22,18 +29,41 @@ import (
 var (
 	pgDb, pgUser, pgPassword, pgHost               string
 	uploadFolderPath                               string
+	uploadRules                                    = probe.Rules{RequireVideo: true}
+	videoStorage                                   storage.Storage
+	encodingProfilesPath                           string
+	encodingProfiles                               profile.Config
 	redisURL, redisPort, redisPassword, redisTopic string
 	redisProtocol                                  = "tcp"
 	redisNetworkTag                                = "transcode_task_consume"
+	redisClient                                    *redis.Client
+	taskQueueBackend                               string
+	taskQueues                                     map[queue.Priority]queue.TaskQueue
+	taskSchemaVersion                              = schema.Version
+	webhooks                                       *webhook.Dispatcher
+	shutdownTimeout                                = server.DefaultShutdownTimeout
+	serverStopping                                 = make(chan struct{})
 	logger                                         *zap.SugaredLogger
 )
 
 func main() {
 	loadEnvironmentVariables()
+	loadEncodingProfiles()
 	database.CreateSchemas(pgUser, pgPassword, pgHost, pgDb)
 	startBackendAPIServer()
 }
 
+// loadEncodingProfiles reads the encoding ladders
+// videos can pick from at creation time
+func loadEncodingProfiles() {
+	config, err := profile.Load(encodingProfilesPath)
+	if err != nil {
+		panic(err)
+	}
+
+	encodingProfiles = config
+}
+
 // loadEnvironmentVariables loads PostgreSQL
 // information from dotenv
 func loadEnvironmentVariables() {
@@ -62,41 +92,140 @@ func loadEnvironmentVariables() {
 		panic("No UPLOAD_FOLDER_PATH environment variable")
 	}
 
+	encodingProfilesPath = os.Getenv("ENCODING_PROFILES_PATH")
+	if len(encodingProfilesPath) == 0 {
+		panic("No ENCODING_PROFILES_PATH environment variable")
+	}
+
+	taskQueueBackend = os.Getenv("TASK_QUEUE_BACKEND")
+	if len(taskQueueBackend) == 0 {
+		taskQueueBackend = queue.BackendRedis
+	}
+
+	// Redis is optional with other queue backends,
+	// video events are disabled without it
 	redisURL = os.Getenv("REDIS_URL")
-	if len(redisURL) == 0 {
+	if len(redisURL) == 0 && (taskQueueBackend == queue.BackendRedis || taskQueueBackend == queue.BackendStream) {
 		panic("No REDIS_URL environment variable")
 	}
 
-	redisPort = os.Getenv("REDIS_PORT")
-	if len(redisPort) == 0 {
-		panic("No REDIS_PORT environment variable")
-	}
+	if len(redisURL) != 0 {
+		redisPort = os.Getenv("REDIS_PORT")
+		if len(redisPort) == 0 {
+			panic("No REDIS_PORT environment variable")
+		}
 
-	redisPassword = os.Getenv("REDIS_PASSWORD")
-	if len(redisPassword) == 0 {
-		panic("No REDIS_PASSWORD environment variable")
+		redisPassword = os.Getenv("REDIS_PASSWORD")
+		if len(redisPassword) == 0 {
+			panic("No REDIS_PASSWORD environment variable")
+		}
 	}
 
+	// REDIS_TOPIC names the task queue with every backend
 	redisTopic = os.Getenv("REDIS_TOPIC")
 	if len(redisTopic) == 0 {
 		panic("No REDIS_TOPIC environment variable")
 	}
+
+	if timeout := os.Getenv("SHUTDOWN_TIMEOUT"); len(timeout) != 0 {
+		duration, err := time.ParseDuration(timeout)
+		if err != nil || duration <= 0 {
+			panic("Invalid SHUTDOWN_TIMEOUT environment variable")
+		}
+
+		shutdownTimeout = duration
+	}
+
+	if interval := os.Getenv("OUTBOX_RELAY_INTERVAL"); len(interval) != 0 {
+		duration, err := time.ParseDuration(interval)
+		if err != nil || duration <= 0 {
+			panic("Invalid OUTBOX_RELAY_INTERVAL environment variable")
+		}
+
+		outboxRelayInterval = duration
+	}
+
+	if maxSize := os.Getenv("UPLOAD_MAX_SIZE"); len(maxSize) != 0 {
+		size, err := strconv.ParseInt(maxSize, 10, 64)
+		if err != nil || size <= 0 {
+			panic("Invalid UPLOAD_MAX_SIZE environment variable")
+		}
+
+		uploadMaxSize = size
+	}
+
+	loadUploadRules()
+
+	// Set to 1 while consumers which only read legacy tasks are still running
+	if version := os.Getenv("TASK_SCHEMA_VERSION"); len(version) != 0 {
+		schemaVersion, err := strconv.Atoi(version)
+		if err != nil || (schemaVersion != schema.VersionLegacy && schemaVersion != schema.Version) {
+			panic("Invalid TASK_SCHEMA_VERSION environment variable")
+		}
+
+		taskSchemaVersion = schemaVersion
+	}
 }
 
-// openTaskQueue connects to redis and return a Queue interface
-func openTaskQueue() rmq.Queue {
-	redisClient := redis.NewClient(&redis.Options{
-		Network:  redisProtocol,
-		Addr:     fmt.Sprintf("%s:%s", redisURL, redisPort),
-		DB:       int64(1),
-		Password: redisPassword,
-	})
+// openTaskQueues connects to the configured queue backend and returns
+// the TaskQueue of every priority lane,
+// the redis client is kept for publishing and subscribing video events
+func openTaskQueues() map[queue.Priority]queue.TaskQueue {
+	config := queue.Config{
+		Backend:  taskQueueBackend,
+		RedisTag: redisNetworkTag,
+		ErrorLog: logger.Errorf,
+	}
+
+	if len(redisURL) != 0 {
+		redisClient = redis.NewClient(&redis.Options{
+			Network:  redisProtocol,
+			Addr:     fmt.Sprintf("%s:%s", redisURL, redisPort),
+			DB:       int64(1),
+			Password: redisPassword,
+		})
+
+		config.RedisClient = redisClient
+	}
+
+	if taskQueueBackend == queue.BackendPostgres {
+		config.PostgresConnection = database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	}
+
+	broker, err := queue.NewBroker(config)
+	if err != nil {
+		panic(err)
+	}
 
-	connection := rmq.OpenConnectionWithRedisClient(redisNetworkTag, redisClient)
+	lanes := map[queue.Priority]queue.TaskQueue{}
 
-	logger.Infof("Connected to Redis task queue: %s\n", connection.Name)
+	for _, priority := range queue.Priorities {
+		taskQueue, err := broker.OpenQueue(queue.LaneName(redisTopic, priority))
+		if err != nil {
+			panic(err)
+		}
 
-	return connection.OpenQueue(redisTopic)
+		logger.Infof("Connected to %s task queue: %s\n", taskQueueBackend, taskQueue.Name())
+		lanes[priority] = taskQueue
+	}
+
+	return lanes
+}
+
+// openStorage connects to the configured storage of video files,
+// the local one is the upload folder itself
+func openStorage() storage.Storage {
+	config, err := storage.ConfigFromEnvironment(uploadFolderPath, "")
+	if err != nil {
+		panic(err)
+	}
+
+	videoStorage, err := storage.New(config)
+	if err != nil {
+		panic(err)
+	}
+
+	return videoStorage
 }
 
 func startBackendAPIServer() {
@@ -106,6 +235,17 @@ func startBackendAPIServer() {
 	logger = log.Sugar()
 	logger.Info("Starting video backend API server")
 
+	taskQueues = openTaskQueues()
+	videoStorage = openStorage()
+	go runOutboxRelay()
+
+	webhooks = webhook.NewDispatcher(func() *gorm.DB {
+		return database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	}, logger)
+	webhooks.Start()
+
+	go completeReceivedUploads()
+
 	// Creates a gin router with default middleware:
 	// logger and recovery (crash-free) middleware
 	router := gin.Default()
@@ -114,13 +254,47 @@ func startBackendAPIServer() {
 	{
 		v1.GET("/videos", getVideoList)
 		v1.GET("/videos/:id", getVideoDetail)
+		v1.GET("/videos/:id/events", streamVideoEvents)
 		v1.DELETE("/videos/:id", deleteVideo)
 		v1.POST("/videos", createVideo)
+		v1.POST("/videos/:id/transcode", retranscodeVideo)
 		v1.POST("/video-upload", uploadVideoFile)
+
+		registerUploadRoutes(v1)
+
+		v1.GET("/webhooks", getWebhookList)
+		v1.POST("/webhooks", createWebhook)
+		v1.DELETE("/webhooks/:id", deleteWebhook)
+		v1.GET("/webhooks/:id/deliveries", getWebhookDeliveries)
 	}
 
 	// By default it serves on :8080
-	router.Run()
+	address := ":8080"
+	if port := os.Getenv("PORT"); len(port) != 0 {
+		address = ":" + port
+	}
+
+	httpServer := &http.Server{
+		Addr:    address,
+		Handler: router,
+	}
+
+	// Event streams never end by themselves, so they are closed first
+	if err := server.RunGracefully(httpServer, shutdownTimeout, func() { close(serverStopping) }, logger); err != nil && err != http.ErrServerClosed {
+		logger.Errorf("Backend API server stopped: %s", err.Error())
+	}
+
+	close(outboxRelayStopping)
+
+	select {
+	case <-outboxRelayDone:
+	case <-time.After(shutdownTimeout):
+		logger.Warnf("Outbox relay still running after %s, unpublished messages are relayed on restart", shutdownTimeout)
+	}
+
+	if !webhooks.Stop(shutdownTimeout) {
+		logger.Warnf("Webhook deliveries still running after %s, unfinished attempts are made on restart", shutdownTimeout)
+	}
 }
 
 func getVideoList(c *gin.Context) {
@@ -144,6 +318,16 @@ func getVideoDetail(c *gin.Context) {
 
 	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
 	video, err := database.GetVideoObject(videoID, connection)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	connection = database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	video.Progress, err = database.GetLatestRenderingProgressObjects(videoID, connection)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
@@ -192,6 +376,30 @@ func createVideo(c *gin.Context) {
 		return
 	}
 
+	if len(videoSerializer.Renditions) != 0 {
+		if err := profile.ValidateRenditions(videoSerializer.Renditions); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+
+		videoSerializer.EncodingLadder = ""
+	} else {
+		if videoSerializer.EncodingLadder == "" {
+			videoSerializer.EncodingLadder = encodingProfiles.DefaultLadder
+		}
+
+		if _, err := encodingProfiles.Ladder(videoSerializer.EncodingLadder); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+	}
+
 	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
 	videoSerializer, err := database.CreateVideoObject(videoSerializer, connection)
 	if err != nil {
@@ -203,8 +411,11 @@ func createVideo(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"title":   videoSerializer.Title,
-		"message": "Object created. Please upload the file for this Video.",
+		"id":              videoSerializer.ID,
+		"title":           videoSerializer.Title,
+		"encoding_ladder": videoSerializer.EncodingLadder,
+		"renditions":      videoSerializer.Renditions,
+		"message":         "Object created. Please upload the file for this Video.",
 	})
 }
 
@@ -220,6 +431,44 @@ func uploadVideoFile(c *gin.Context) {
 		return
 	}
 
+	videoObjectID, err := strconv.Atoi(videoID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "video_id must be a number",
+		})
+
+		return
+	}
+
+	priority, err := queue.ParsePriority(c.PostForm("priority"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	scheduledAt, err := parseScheduledAt(c.PostForm("scheduled_at"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	video, err := database.GetVideoObject(videoObjectID, connection)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
 	file, header, err := c.Request.FormFile("upload")
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -230,12 +479,19 @@ func uploadVideoFile(c *gin.Context) {
 		return
 	}
 
-	filename := header.Filename
+	sourceName, err := newSourceName()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
 
-	videoFolderPath := uploadFolderPath + videoID
-	os.MkdirAll(videoFolderPath, os.ModePerm)
+		return
+	}
 
-	videoFullPath := fmt.Sprintf("%s/%s", videoFolderPath, filename)
+	// Files are received and validated in the upload folder before they are stored
+	videoKey := sourceKey(video.ID, sourceName, header.Filename)
+	videoFullPath := uploadFolderPath + videoKey
+	os.MkdirAll(filepath.Dir(videoFullPath), os.ModePerm)
 
 	outFile, err := os.Create(videoFullPath)
 	if err != nil {
@@ -263,14 +519,49 @@ func uploadVideoFile(c *gin.Context) {
 		return
 	}
 
-	taskQueue := openTaskQueue()
-	task := entity.Task{ID: videoID, Timestamp: time.Now(), FilePath: videoFullPath}
+	// The file is complete before it is probed and stored
+	outFile.Close()
+
+	if err = probe.Check(videoFullPath, uploadRules); err != nil {
+		os.Remove(videoFullPath)
+		respondUploadError(c, err)
+		return
+	}
+
+	if err = storage.PutFile(videoStorage, videoKey, videoFullPath); err != nil {
+		os.Remove(videoFullPath)
+		respondUploadError(c, err)
+		return
+	}
+
+	video.SourceFilePath = videoKey
+	video.OriginalFilename = header.Filename
+
+	task, video, err := queueTranscodeTask(video, videoKey, priority, scheduledAt, c.GetHeader("Idempotency-Key"))
+	if err != nil {
+		logger.Errorf("Failed to queue task of video %s: %s", videoID, err.Error())
+
+		// Nothing refers to the file without the saved video
+		videoStorage.Delete(videoKey)
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "File upload is having issues right now. Please try later.",
+		})
+
+		return
+	}
 
-	queueDataBytes, err := json.Marshal(task)
-	taskQueue.PublishBytes(queueDataBytes)
 	logger.Info("Queue task created...:", task)
 
+	webhooks.Notify(entity.WebhookEventVideoUploaded, video.ID, 0, video)
+
+	message := fmt.Sprintf("Video file uploaded. Transcoding now: %s", videoID)
+	if scheduledAt.After(time.Now()) {
+		message = fmt.Sprintf("Video file uploaded. Transcoding at %s: %s", scheduledAt.Format(time.RFC3339), videoID)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"message": fmt.Sprintf("Video file uploaded. Transcoding now: %s", videoID),
+		"message": message,
 	})
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/n1207n/video-transcode-queue/api/common/database"
+	"github.com/n1207n/video-transcode-queue/api/common/event"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// eventKeepAliveInterval keeps idle event streams open through proxies
+const eventKeepAliveInterval = 15 * time.Second
+
+// streamVideoEvents streams job lifecycle and progress events
+// of a video to the client as Server-Sent Events
+func streamVideoEvents(c *gin.Context) {
+	videoID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	if redisClient == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "video events need REDIS_URL to be configured",
+		})
+
+		return
+	}
+
+	// Subscribe before loading the video so no event
+	// between the snapshot and the stream is missed
+	pubSub, err := event.Subscribe(redisClient, uint(videoID))
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	defer pubSub.Close()
+
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	video, err := database.GetVideoObject(videoID, connection)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	events := make(chan event.Event)
+	done := make(chan struct{})
+	defer close(done)
+
+	go receiveVideoEvents(pubSub, events, done)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	c.SSEvent("video", video)
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case videoEvent, ok := <-events:
+			if !ok {
+				return false
+			}
+
+			c.SSEvent(videoEvent.Type, videoEvent)
+		case <-time.After(eventKeepAliveInterval):
+			c.SSEvent("keep-alive", gin.H{"timestamp": time.Now()})
+		case <-serverStopping:
+			return false
+		}
+
+		return true
+	})
+}
+
+// receiveVideoEvents forwards decoded pub/sub messages
+// until the subscription is closed or the client is gone
+func receiveVideoEvents(pubSub *redis.PubSub, events chan<- event.Event, done <-chan struct{}) {
+	defer close(events)
+
+	for {
+		message, err := pubSub.ReceiveMessage()
+		if err != nil {
+			return
+		}
+
+		videoEvent, err := event.Decode(message.Payload)
+		if err != nil {
+			logger.Warnf("Undecodable video event on %s: %s", message.Channel, err.Error())
+			continue
+		}
+
+		select {
+		case events <- videoEvent:
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/n1207n/video-transcode-queue/api/common/database"
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+	"github.com/n1207n/video-transcode-queue/api/common/queue"
+)
+
+const (
+	// outboxRelayBatchSize is how many messages one relay transaction publishes
+	outboxRelayBatchSize = 100
+
+	// outboxRetention is how long published messages are kept for inspection
+	outboxRetention = 7 * 24 * time.Hour
+)
+
+var (
+	outboxRelayInterval = time.Second
+
+	// outboxRelayWakeup lets a new message skip the wait for the next relay tick
+	outboxRelayWakeup = make(chan struct{}, 1)
+
+	// outboxRelayStopping is closed once the HTTP server stopped taking requests
+	outboxRelayStopping = make(chan struct{})
+	outboxRelayDone     = make(chan struct{})
+)
+
+// wakeOutboxRelay tells the relay a message was recorded
+func wakeOutboxRelay() {
+	select {
+	case outboxRelayWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// runOutboxRelay publishes recorded outbox messages to their task queues
+// until the server stops. A message is marked published only after its queue
+// accepted it, so it is delivered at least once; the transcoder drops duplicates
+// by the idempotency key of the task.
+func runOutboxRelay() {
+	defer close(outboxRelayDone)
+
+	ticker := time.NewTicker(outboxRelayInterval)
+	defer ticker.Stop()
+
+	cleanupTicker := time.NewTicker(time.Hour)
+	defer cleanupTicker.Stop()
+
+	logger.Infof("Outbox relay started, polling every %s", outboxRelayInterval)
+
+	for {
+		select {
+		case <-outboxRelayStopping:
+			// Messages recorded by the last requests are published before exiting
+			relayOutboxMessages()
+			return
+		case <-cleanupTicker.C:
+			deletePublishedOutboxMessages()
+			continue
+		case <-ticker.C:
+		case <-outboxRelayWakeup:
+		}
+
+		relayOutboxMessages()
+	}
+}
+
+// relayOutboxMessages publishes batches of due messages until none is left.
+// Failed messages are retried on a later tick once their backoff passed.
+func relayOutboxMessages() {
+	for {
+		connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+		published, failed, err := database.RelayOutboxMessages(outboxRelayBatchSize, publishOutboxMessage, connection)
+		if err != nil {
+			logger.Errorf("Outbox relay failed: %s", err.Error())
+			return
+		}
+
+		if published > 0 {
+			logger.Infof("Outbox relay published %d messages", published)
+		}
+
+		if failed > 0 {
+			logger.Warnf("Outbox relay failed to publish %d messages, see last_error of outbox_messages", failed)
+		}
+
+		if published+failed < outboxRelayBatchSize {
+			return
+		}
+	}
+}
+
+// publishOutboxMessage publishes a message to the task queue it names
+func publishOutboxMessage(message entity.OutboxMessage) error {
+	taskQueue := taskQueueByName(message.Queue)
+	if taskQueue == nil {
+		return fmt.Errorf("%s names an unknown task queue", message)
+	}
+
+	if message.NotBefore != nil && message.NotBefore.After(time.Now()) {
+		return taskQueue.PublishAt([]byte(message.Payload), *message.NotBefore)
+	}
+
+	return taskQueue.Publish([]byte(message.Payload))
+}
+
+// taskQueueByName returns the priority lane queue of given name
+func taskQueueByName(name string) queue.TaskQueue {
+	for _, taskQueue := range taskQueues {
+		if taskQueue.Name() == name {
+			return taskQueue
+		}
+	}
+
+	return nil
+}
+
+func deletePublishedOutboxMessages() {
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	deleted, err := database.DeletePublishedOutboxMessages(time.Now().Add(-outboxRetention), connection)
+	if err != nil {
+		logger.Warnf("Failed to delete published outbox messages: %s", err.Error())
+		return
+	}
+
+	if deleted > 0 {
+		logger.Infof("Deleted %d published outbox messages", deleted)
+	}
+}
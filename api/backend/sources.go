@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// sourceExtensionPattern limits the extensions kept from client filenames
+var sourceExtensionPattern = regexp.MustCompile(`^\.[a-z0-9]{1,10}$`)
+
+// defaultSourceExtension names source files whose client filename
+// has no usable extension, the transcoder derives rendition names from the part before it
+const defaultSourceExtension = ".bin"
+
+// sourceKey returns the storage key a source file of a video is stored under.
+// Files are named by the server, so client filenames never reach
+// the filesystem or an ffmpeg command line; they are kept in Video.OriginalFilename.
+func sourceKey(videoID uint, name string, originalFilename string) string {
+	return fmt.Sprintf("%d/%s%s", videoID, name, sourceExtension(originalFilename))
+}
+
+// sourceExtension returns the lowercased extension of a client filename
+// if it is made of letters and digits only
+func sourceExtension(filename string) string {
+	extension := strings.ToLower(filepath.Ext(filename))
+	if !sourceExtensionPattern.MatchString(extension) {
+		return defaultSourceExtension
+	}
+
+	return extension
+}
+
+// newSourceName returns a random version 4 UUID
+func newSourceName() (string, error) {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return "", err
+	}
+
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var sourceNamePattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestSourceExtension(t *testing.T) {
+	tests := []struct {
+		filename          string
+		expectedExtension string
+	}{
+		{"video.mp4", ".mp4"},
+		{"VIDEO.MOV", ".mov"},
+		{"clip.Mkv", ".mkv"},
+		{"archive.tar.gz", ".gz"},
+		{"../../etc/passwd.mp4", ".mp4"},
+		{`..\..\video.mp4`, ".mp4"},
+		{"noextension", defaultSourceExtension},
+		{"", defaultSourceExtension},
+		{"trailing.", defaultSourceExtension},
+		{".hidden", ".hidden"},
+		{"video.abcdefghijk", defaultSourceExtension},
+		{"video.abcdefghij", ".abcdefghij"},
+		{"video.mp4 ", defaultSourceExtension},
+		{"video.m-p4", defaultSourceExtension},
+		{"video.mp4;rm -rf", defaultSourceExtension},
+		{"video.mр4", defaultSourceExtension},
+		{"video.mp4/", defaultSourceExtension},
+	}
+
+	for _, test := range tests {
+		if extension := sourceExtension(test.filename); extension != test.expectedExtension {
+			t.Errorf("sourceExtension(%q) = %q, want %q", test.filename, extension, test.expectedExtension)
+		}
+	}
+}
+
+func TestSourceKey(t *testing.T) {
+	name, err := newSourceName()
+	if err != nil {
+		t.Fatalf("newSourceName failed: %v", err)
+	}
+
+	if !sourceNamePattern.MatchString(name) {
+		t.Fatalf("newSourceName = %q, want a version 4 UUID", name)
+	}
+
+	tests := []struct {
+		originalFilename string
+		expectedKey      string
+	}{
+		{"video.MP4", "12/" + name + ".mp4"},
+		{"../../etc/passwd.mp4", "12/" + name + ".mp4"},
+		{"../../etc/passwd", "12/" + name + defaultSourceExtension},
+		{"clip.averyveryverylongextension", "12/" + name + defaultSourceExtension},
+	}
+
+	for _, test := range tests {
+		key := sourceKey(12, name, test.originalFilename)
+
+		if key != test.expectedKey {
+			t.Errorf("sourceKey(%q) = %q, want %q", test.originalFilename, key, test.expectedKey)
+		}
+
+		if strings.Contains(key, "..") || strings.Count(key, "/") != 1 {
+			t.Errorf("sourceKey(%q) = %q leaves the video directory", test.originalFilename, key)
+		}
+	}
+}
+
+func TestNewSourceNameUnique(t *testing.T) {
+	names := make(map[string]bool)
+
+	for index := 0; index < 100; index++ {
+		name, err := newSourceName()
+		if err != nil {
+			t.Fatalf("newSourceName failed: %v", err)
+		}
+
+		if names[name] {
+			t.Fatalf("newSourceName returned %q twice", name)
+		}
+
+		names[name] = true
+	}
+}
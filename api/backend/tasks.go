@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/n1207n/video-transcode-queue/api/common/database"
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+	"github.com/n1207n/video-transcode-queue/api/common/queue"
+	"github.com/n1207n/video-transcode-queue/api/common/schema"
+)
+
+// TranscodeTaskRequest represents the optional JSON body of a re-transcode request
+type TranscodeTaskRequest struct {
+	Priority    string `json:"priority"`
+	ScheduledAt string `json:"scheduled_at"`
+}
+
+// parseScheduledAt reads an RFC 3339 time, an empty value means right away
+func parseScheduledAt(value string) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+
+	scheduledAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return scheduledAt, fmt.Errorf("scheduled_at must be an RFC 3339 time: %s", err)
+	}
+
+	return scheduledAt, nil
+}
+
+// newIdempotencyKey returns the idempotency key of a task of given video.
+// A key sent by the client in the Idempotency-Key header makes repeated
+// requests end up in one transcode job, otherwise every request gets a random key.
+func newIdempotencyKey(videoID uint, clientKey string) (string, error) {
+	if len(clientKey) != 0 {
+		return fmt.Sprintf("video-%d-%s", videoID, clientKey), nil
+	}
+
+	keyBytes := make([]byte, 16)
+	if _, err := rand.Read(keyBytes); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(keyBytes), nil
+}
+
+// queueTranscodeTask saves the video and records a transcode task of a video file
+// in the outbox, in one transaction. The outbox relay publishes it into the lane
+// of given priority, held back until scheduledAt if it is in the future.
+func queueTranscodeTask(video entity.Video, filePath string, priority queue.Priority, scheduledAt time.Time, clientKey string) (schema.TranscodeTask, entity.Video, error) {
+	idempotencyKey, err := newIdempotencyKey(video.ID, clientKey)
+	if err != nil {
+		return schema.TranscodeTask{}, video, err
+	}
+
+	task := schema.TranscodeTask{
+		VideoID:        strconv.Itoa(int(video.ID)),
+		Timestamp:      time.Now(),
+		FilePath:       filePath,
+		EncodingLadder: video.EncodingLadder,
+		Renditions:     video.Renditions,
+		Priority:       string(priority),
+		IdempotencyKey: idempotencyKey,
+	}
+
+	queueDataBytes, err := schema.EncodeTranscodeTask(task, taskSchemaVersion)
+	if err != nil {
+		return task, video, err
+	}
+
+	message := entity.OutboxMessage{
+		Queue:   taskQueues[priority].Name(),
+		Payload: string(queueDataBytes),
+	}
+
+	if scheduledAt.After(time.Now()) {
+		message.NotBefore = &scheduledAt
+	}
+
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	video, message, err = database.QueueVideoTranscode(video, message, connection)
+	if err != nil {
+		return task, video, err
+	}
+
+	wakeOutboxRelay()
+
+	return task, video, nil
+}
+
+// retranscodeVideo queues the uploaded source file of a video again
+func retranscodeVideo(c *gin.Context) {
+	var request TranscodeTaskRequest
+
+	videoID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	if c.Request.ContentLength != 0 {
+		if err = c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+	}
+
+	priority, err := queue.ParsePriority(request.Priority)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	scheduledAt, err := parseScheduledAt(request.ScheduledAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	video, err := database.GetVideoObject(videoID, connection)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	if len(video.SourceFilePath) == 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "Video has no uploaded file to transcode.",
+		})
+
+		return
+	}
+
+	task, video, err := queueTranscodeTask(video, video.SourceFilePath, priority, scheduledAt, c.GetHeader("Idempotency-Key"))
+	if err != nil {
+		logger.Errorf("Failed to queue task of video %d: %s", video.ID, err.Error())
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Transcoding could not be queued. Please try later.",
+		})
+
+		return
+	}
+
+	logger.Info("Queue task created...:", task)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":      fmt.Sprintf("Transcoding queued: %d", video.ID),
+		"priority":     priority,
+		"scheduled_at": scheduledAtOrNil(scheduledAt),
+	})
+}
+
+// scheduledAtOrNil returns nil for tasks queued right away
+func scheduledAtOrNil(scheduledAt time.Time) interface{} {
+	if scheduledAt.After(time.Now()) {
+		return scheduledAt
+	}
+
+	return nil
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/n1207n/video-transcode-queue/api/common/database"
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+	"github.com/n1207n/video-transcode-queue/api/common/probe"
+	"github.com/n1207n/video-transcode-queue/api/common/queue"
+	"github.com/n1207n/video-transcode-queue/api/common/storage"
+)
+
+// tus 1.0 protocol constants of the resumable upload API
+const (
+	tusVersion             = "1.0.0"
+	tusExtensions          = "creation,termination,checksum"
+	tusChecksumAlgorithms  = "sha1,sha256,md5"
+	tusOffsetContentType   = "application/offset+octet-stream"
+	statusChecksumMismatch = 460
+)
+
+var (
+	// uploadMaxSize limits Upload-Length, 0 means no limit
+	uploadMaxSize int64
+
+	// uploadLocks keeps two requests of this process from writing to one upload,
+	// the offset check in the database covers other backend replicas
+	uploadLocks      = map[string]bool{}
+	uploadLocksMutex sync.Mutex
+)
+
+// registerUploadRoutes adds the resumable upload API to a router group
+func registerUploadRoutes(group *gin.RouterGroup) {
+	uploads := group.Group("/uploads", requireTusResumable)
+	uploads.OPTIONS("", getUploadOptions)
+	uploads.POST("", createUpload)
+	uploads.HEAD("/:id", getUploadOffset)
+	uploads.PATCH("/:id", patchUpload)
+	uploads.DELETE("/:id", deleteUpload)
+}
+
+// requireTusResumable rejects requests of other tus versions,
+// OPTIONS requests are answered to any client
+func requireTusResumable(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+
+	if c.Request.Method == http.MethodOptions {
+		return
+	}
+
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+	}
+}
+
+func getUploadOptions(c *gin.Context) {
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+
+	if uploadMaxSize > 0 {
+		c.Header("Tus-Max-Size", strconv.FormatInt(uploadMaxSize, 10))
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// createUpload starts an upload session of a video file. Upload-Metadata must hold
+// video_id and filename, and may hold priority and scheduled_at of the transcode task.
+func createUpload(c *gin.Context) {
+	uploadLength, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || uploadLength < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Upload-Length header must be a non-negative number",
+		})
+
+		return
+	}
+
+	if uploadMaxSize > 0 && uploadLength > uploadMaxSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"message": fmt.Sprintf("Upload-Length exceeds %d bytes", uploadMaxSize),
+		})
+
+		return
+	}
+
+	metadata, err := parseUploadMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	videoID, err := strconv.Atoi(metadata["video_id"])
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Upload-Metadata must have a numeric video_id",
+		})
+
+		return
+	}
+
+	// The filename is only kept as metadata of the video
+	filename := metadata["filename"]
+	if len(filename) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Upload-Metadata must have a filename",
+		})
+
+		return
+	}
+
+	priority, err := queue.ParsePriority(metadata["priority"])
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	scheduledAt, err := parseScheduledAt(metadata["scheduled_at"])
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	video, err := database.GetVideoObject(videoID, connection)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	sessionID, err := newUploadSessionID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	partialFolderPath := fmt.Sprintf("%s%d/.uploads", uploadFolderPath, video.ID)
+	os.MkdirAll(partialFolderPath, os.ModePerm)
+
+	session := entity.UploadSession{
+		ID:              sessionID,
+		VideoID:         video.ID,
+		Filename:        filename,
+		Metadata:        c.GetHeader("Upload-Metadata"),
+		UploadLength:    uploadLength,
+		PartialFilePath: fmt.Sprintf("%s/%s", partialFolderPath, sessionID),
+		Priority:        string(priority),
+	}
+
+	if !scheduledAt.IsZero() {
+		session.ScheduledAt = &scheduledAt
+	}
+
+	partialFile, err := os.Create(session.PartialFilePath)
+	if err != nil {
+		logger.Errorf("Failed to create partial upload file: %s", err.Error())
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "File upload is having issues right now. Please try later.",
+		})
+
+		return
+	}
+
+	partialFile.Close()
+
+	connection = database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	session, err = database.CreateUploadSessionObject(session, connection)
+	if err != nil {
+		os.Remove(session.PartialFilePath)
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	logger.Infof("Upload created: %s", session)
+
+	if session.IsComplete() {
+		if err = completeUpload(session); err != nil {
+			respondUploadError(c, err)
+			return
+		}
+	}
+
+	c.Header("Location", "/api/v1/uploads/"+session.ID)
+	c.Header("Upload-Offset", "0")
+	c.Status(http.StatusCreated)
+}
+
+// getUploadOffset answers HEAD requests with the offset to resume the upload from
+func getUploadOffset(c *gin.Context) {
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	session, err := database.GetUploadSessionObject(c.Param("id"), connection)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(session.UploadOffset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(session.UploadLength, 10))
+
+	if len(session.Metadata) != 0 {
+		c.Header("Upload-Metadata", session.Metadata)
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// patchUpload appends a chunk at the current offset of the upload.
+// A chunk cut short by a dropped connection is kept unless it has a checksum,
+// and the last chunk queues the transcode task of the video.
+func patchUpload(c *gin.Context) {
+	if c.ContentType() != tusOffsetContentType {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"message": "Content-Type must be " + tusOffsetContentType,
+		})
+
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Upload-Offset header must be a non-negative number",
+		})
+
+		return
+	}
+
+	checksum, expectedSum, err := parseUploadChecksum(c.GetHeader("Upload-Checksum"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	sessionID := c.Param("id")
+	if !lockUpload(sessionID) {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "Another request is writing to this upload",
+		})
+
+		return
+	}
+
+	defer unlockUpload(sessionID)
+
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	session, err := database.GetUploadSessionObject(sessionID, connection)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if offset != session.UploadOffset {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": fmt.Sprintf("Upload-Offset %d does not match the upload offset %d", offset, session.UploadOffset),
+		})
+
+		return
+	}
+
+	// Repeating the last chunk completes an upload interrupted while completing
+	if session.IsComplete() {
+		if session.CompletedAt == nil {
+			if err = completeUpload(session); err != nil {
+				respondUploadError(c, err)
+				return
+			}
+		}
+
+		c.Header("Upload-Offset", strconv.FormatInt(session.UploadOffset, 10))
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	written, copyErr := writeUploadChunk(session, c.Request.Body, checksum)
+
+	if written > session.UploadLength-offset {
+		truncateUpload(session, offset)
+
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"message": "Chunk exceeds Upload-Length",
+		})
+
+		return
+	}
+
+	if checksum != nil {
+		// A checksum covers the whole chunk, so an incomplete one is dropped
+		if copyErr != nil {
+			truncateUpload(session, offset)
+			logger.Warnf("Dropped incomplete chunk of %s: %s", session, copyErr.Error())
+			return
+		}
+
+		if !bytes.Equal(checksum.Sum(nil), expectedSum) {
+			truncateUpload(session, offset)
+			c.AbortWithStatus(statusChecksumMismatch)
+			return
+		}
+	}
+
+	connection = database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	isAdvanced, err := database.AdvanceUploadSessionOffset(session.ID, offset, offset+written, connection)
+	if err != nil || !isAdvanced {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "Upload offset changed while writing the chunk",
+		})
+
+		return
+	}
+
+	session.UploadOffset = offset + written
+
+	if copyErr != nil {
+		logger.Warnf("Upload %s interrupted at offset %d: %s", session.ID, session.UploadOffset, copyErr.Error())
+		return
+	}
+
+	if session.IsComplete() {
+		if err = completeUpload(session); err != nil {
+			respondUploadError(c, err)
+			return
+		}
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(session.UploadOffset, 10))
+	c.Status(http.StatusNoContent)
+}
+
+// deleteUpload terminates an upload and removes its received bytes
+func deleteUpload(c *gin.Context) {
+	sessionID := c.Param("id")
+	if !lockUpload(sessionID) {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "Another request is writing to this upload",
+		})
+
+		return
+	}
+
+	defer unlockUpload(sessionID)
+
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	session, err := database.GetUploadSessionObject(sessionID, connection)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	connection = database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	if err = database.DeleteUploadSessionObject(session, connection); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	os.Remove(session.PartialFilePath)
+
+	logger.Infof("Upload terminated: %s", session)
+
+	c.Status(http.StatusNoContent)
+}
+
+// writeUploadChunk appends a request body to the partial file of an upload,
+// feeding it to checksum as well if one was sent.
+// One byte more than the upload misses is read, to tell if the chunk is too long.
+func writeUploadChunk(session entity.UploadSession, body io.Reader, checksum hash.Hash) (int64, error) {
+	partialFile, err := os.OpenFile(session.PartialFilePath, os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	defer partialFile.Close()
+
+	if _, err = partialFile.Seek(session.UploadOffset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	var writer io.Writer = partialFile
+	if checksum != nil {
+		writer = io.MultiWriter(partialFile, checksum)
+	}
+
+	written, err := io.Copy(writer, io.LimitReader(body, session.UploadLength-session.UploadOffset+1))
+
+	// Received bytes must be on disk before the offset says so
+	if syncErr := partialFile.Sync(); err == nil {
+		err = syncErr
+	}
+
+	return written, err
+}
+
+// truncateUpload drops bytes of the partial file written past given offset
+func truncateUpload(session entity.UploadSession, offset int64) {
+	if err := os.Truncate(session.PartialFilePath, offset); err != nil {
+		logger.Errorf("Failed to truncate %s to %d: %s", session, offset, err.Error())
+	}
+}
+
+// completeUpload validates the received file, moves it to the video storage
+// and queues its transcode task
+func completeUpload(session entity.UploadSession) error {
+	// Named by the upload ID, so completing again finds the stored file
+	videoKey := sourceKey(session.VideoID, session.ID, session.Filename)
+
+	if _, err := os.Stat(session.PartialFilePath); err == nil {
+		// A rejected file ends the upload, the client has to start over with another file
+		if err = probe.Check(session.PartialFilePath, uploadRules); err != nil {
+			if _, ok := err.(*probe.ValidationError); ok {
+				os.Remove(session.PartialFilePath)
+
+				connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+				database.DeleteUploadSessionObject(session, connection)
+
+				logger.Infof("Upload rejected: %s: %s", session, err.Error())
+			}
+
+			return err
+		}
+
+		if err = storage.PutFile(videoStorage, videoKey, session.PartialFilePath); err != nil {
+			return err
+		}
+	} else if _, err = videoStorage.Stat(videoKey); err != nil {
+		// Without the partial file completing must have failed after storing it
+		return err
+	}
+
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	video, err := database.GetVideoObject(int(session.VideoID), connection)
+	if err != nil {
+		return err
+	}
+
+	var scheduledAt time.Time
+	if session.ScheduledAt != nil {
+		scheduledAt = *session.ScheduledAt
+	}
+
+	video.SourceFilePath = videoKey
+	video.OriginalFilename = session.Filename
+
+	// Completing again after a crash results in the same transcode job
+	task, video, err := queueTranscodeTask(video, videoKey, queue.Priority(session.Priority), scheduledAt, "upload-"+session.ID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	session.CompletedAt = &now
+
+	connection = database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	if _, err = database.UpdateUploadSessionObject(session, connection); err != nil {
+		return err
+	}
+
+	logger.Info("Upload completed, queue task created...:", task)
+
+	webhooks.Notify(entity.WebhookEventVideoUploaded, video.ID, 0, video)
+
+	return nil
+}
+
+// completeReceivedUploads completes uploads whose last chunk arrived
+// but which weren't completed before the previous backend process stopped
+func completeReceivedUploads() {
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	sessions, err := database.GetReceivedUploadSessionObjects(connection)
+	if err != nil {
+		logger.Errorf("Failed to load received uploads: %s", err.Error())
+		return
+	}
+
+	for _, session := range sessions {
+		if err = completeUpload(session); err != nil {
+			logger.Errorf("Failed to complete %s: %s", session, err.Error())
+		}
+	}
+}
+
+// parseUploadMetadata reads the comma separated key and base64 value pairs of Upload-Metadata
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("invalid Upload-Metadata pair %q", pair)
+		}
+
+		value := ""
+		if len(fields) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid Upload-Metadata value of %s: %s", fields[0], err)
+			}
+
+			value = string(decoded)
+		}
+
+		metadata[fields[0]] = value
+	}
+
+	return metadata, nil
+}
+
+// parseUploadChecksum reads an Upload-Checksum header like "sha1 <base64 digest>",
+// returning a nil hash without the header
+func parseUploadChecksum(header string) (hash.Hash, []byte, error) {
+	if len(header) == 0 {
+		return nil, nil, nil
+	}
+
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return nil, nil, errors.New("Upload-Checksum must be an algorithm and a base64 digest")
+	}
+
+	expectedSum, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid Upload-Checksum digest: %s", err)
+	}
+
+	switch fields[0] {
+	case "sha1":
+		return sha1.New(), expectedSum, nil
+	case "sha256":
+		return sha256.New(), expectedSum, nil
+	case "md5":
+		return md5.New(), expectedSum, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported checksum algorithm %s, expected one of %s", fields[0], tusChecksumAlgorithms)
+	}
+}
+
+// newUploadSessionID returns a random upload ID, which is the only secret of an upload URL
+func newUploadSessionID() (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(idBytes), nil
+}
+
+func lockUpload(sessionID string) bool {
+	uploadLocksMutex.Lock()
+	defer uploadLocksMutex.Unlock()
+
+	if uploadLocks[sessionID] {
+		return false
+	}
+
+	uploadLocks[sessionID] = true
+
+	return true
+}
+
+func unlockUpload(sessionID string) {
+	uploadLocksMutex.Lock()
+	delete(uploadLocks, sessionID)
+	uploadLocksMutex.Unlock()
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/n1207n/video-transcode-queue/api/common/database"
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	logger = zap.NewNop().Sugar()
+
+	os.Exit(m.Run())
+}
+
+func newUploadTestRouter() *gin.Engine {
+	router := gin.New()
+	registerUploadRoutes(router.Group("/api/v1"))
+
+	return router
+}
+
+// tusRequest serves a tus request, headers hold pairs of names and values
+func tusRequest(router *gin.Engine, method string, path string, body string, headers ...string) *httptest.ResponseRecorder {
+	var bodyReader io.Reader
+	if len(body) != 0 {
+		bodyReader = strings.NewReader(body)
+	}
+
+	request := httptest.NewRequest(method, path, bodyReader)
+	request.Header.Set("Tus-Resumable", tusVersion)
+
+	for index := 0; index+1 < len(headers); index += 2 {
+		if len(headers[index+1]) == 0 {
+			request.Header.Del(headers[index])
+		} else {
+			request.Header.Set(headers[index], headers[index+1])
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+func encodeMetadata(pairs ...string) string {
+	var encodedPairs []string
+
+	for index := 0; index+1 < len(pairs); index += 2 {
+		encodedPairs = append(encodedPairs, pairs[index]+" "+base64.StdEncoding.EncodeToString([]byte(pairs[index+1])))
+	}
+
+	return strings.Join(encodedPairs, ",")
+}
+
+func sha1Checksum(content string) string {
+	sum := sha1.Sum([]byte(content))
+	return "sha1 " + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestParseUploadMetadata(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected map[string]string
+		isValid  bool
+	}{
+		{"", map[string]string{}, true},
+		{"video_id MTI=,filename c291cmNlLm1wNA==", map[string]string{"video_id": "12", "filename": "source.mp4"}, true},
+		{" video_id MTI= , filename c291cmNlLm1wNA== ", map[string]string{"video_id": "12", "filename": "source.mp4"}, true},
+		{"video_id MTI=,is_private", map[string]string{"video_id": "12", "is_private": ""}, true},
+		{"filename " + base64.StdEncoding.EncodeToString([]byte("my video, final.mp4")), map[string]string{"filename": "my video, final.mp4"}, true},
+		{"video_id not-base64!", nil, false},
+		{"video_id MTI= extra", nil, false},
+	}
+
+	for _, test := range tests {
+		metadata, err := parseUploadMetadata(test.header)
+
+		if test.isValid != (err == nil) {
+			t.Errorf("parseUploadMetadata(%q) returned error %v", test.header, err)
+			continue
+		}
+
+		if !test.isValid {
+			continue
+		}
+
+		if len(metadata) != len(test.expected) {
+			t.Errorf("parseUploadMetadata(%q) = %v, want %v", test.header, metadata, test.expected)
+			continue
+		}
+
+		for key, value := range test.expected {
+			if metadata[key] != value {
+				t.Errorf("parseUploadMetadata(%q) = %v, want %v", test.header, metadata, test.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestParseUploadChecksum(t *testing.T) {
+	tests := []struct {
+		header   string
+		hashSize int
+		isValid  bool
+	}{
+		{"", 0, true},
+		{sha1Checksum("chunk"), sha1.Size, true},
+		{"sha256 " + base64.StdEncoding.EncodeToString(make([]byte, 32)), 32, true},
+		{"md5 " + base64.StdEncoding.EncodeToString(make([]byte, 16)), 16, true},
+		{"crc32 AAAAAA==", 0, false},
+		{"sha1", 0, false},
+		{"sha1 not-base64!", 0, false},
+	}
+
+	for _, test := range tests {
+		checksum, expectedSum, err := parseUploadChecksum(test.header)
+
+		if test.isValid != (err == nil) {
+			t.Errorf("parseUploadChecksum(%q) returned error %v", test.header, err)
+			continue
+		}
+
+		if test.hashSize == 0 {
+			if checksum != nil {
+				t.Errorf("parseUploadChecksum(%q) returned a hash", test.header)
+			}
+
+			continue
+		}
+
+		if checksum == nil || checksum.Size() != test.hashSize || len(expectedSum) != test.hashSize {
+			t.Errorf("parseUploadChecksum(%q) returned a hash of the wrong algorithm", test.header)
+		}
+	}
+}
+
+func TestUploadRequiresTusResumable(t *testing.T) {
+	router := newUploadTestRouter()
+
+	recorder := tusRequest(router, http.MethodPost, "/api/v1/uploads", "", "Tus-Resumable", "", "Upload-Length", "10")
+	if recorder.Code != http.StatusPreconditionFailed || recorder.Header().Get("Tus-Version") != tusVersion {
+		t.Errorf("request without Tus-Resumable got %d, Tus-Version %q", recorder.Code, recorder.Header().Get("Tus-Version"))
+	}
+
+	recorder = tusRequest(router, http.MethodOptions, "/api/v1/uploads", "", "Tus-Resumable", "")
+	if recorder.Code != http.StatusNoContent || recorder.Header().Get("Tus-Extension") != tusExtensions {
+		t.Errorf("OPTIONS got %d, Tus-Extension %q", recorder.Code, recorder.Header().Get("Tus-Extension"))
+	}
+}
+
+// TestCreateUploadRejects covers requests rejected before an upload is looked up
+func TestCreateUploadRejects(t *testing.T) {
+	router := newUploadTestRouter()
+	metadata := encodeMetadata("video_id", "12", "filename", "source.mp4")
+
+	uploadMaxSize = 1000
+	defer func() {
+		uploadMaxSize = 0
+	}()
+
+	tests := []struct {
+		name           string
+		uploadLength   string
+		metadata       string
+		expectedStatus int
+	}{
+		{"no Upload-Length", "", metadata, http.StatusBadRequest},
+		{"negative Upload-Length", "-1", metadata, http.StatusBadRequest},
+		{"overflowing Upload-Length", "99999999999999999999", metadata, http.StatusBadRequest},
+		{"Upload-Length over the max size", "1001", metadata, http.StatusRequestEntityTooLarge},
+		{"invalid metadata", "10", "video_id MTI=!", http.StatusBadRequest},
+		{"non-numeric video_id", "10", encodeMetadata("video_id", "twelve", "filename", "source.mp4"), http.StatusBadRequest},
+		{"no filename", "10", encodeMetadata("video_id", "12"), http.StatusBadRequest},
+		{"unknown priority", "10", encodeMetadata("video_id", "12", "filename", "source.mp4", "priority", "urgent"), http.StatusBadRequest},
+		{"invalid scheduled_at", "10", encodeMetadata("video_id", "12", "filename", "source.mp4", "scheduled_at", "tomorrow"), http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		recorder := tusRequest(router, http.MethodPost, "/api/v1/uploads", "", "Upload-Length", test.uploadLength, "Upload-Metadata", test.metadata)
+		if recorder.Code != test.expectedStatus {
+			t.Errorf("%s: got %d, want %d", test.name, recorder.Code, test.expectedStatus)
+		}
+	}
+}
+
+// TestPatchUploadRejects covers requests rejected before an upload is looked up
+func TestPatchUploadRejects(t *testing.T) {
+	router := newUploadTestRouter()
+
+	tests := []struct {
+		name           string
+		contentType    string
+		uploadOffset   string
+		checksum       string
+		expectedStatus int
+	}{
+		{"wrong Content-Type", "application/json", "0", "", http.StatusUnsupportedMediaType},
+		{"no Upload-Offset", tusOffsetContentType, "", "", http.StatusBadRequest},
+		{"negative Upload-Offset", tusOffsetContentType, "-5", "", http.StatusBadRequest},
+		{"unsupported checksum", tusOffsetContentType, "0", "crc32 AAAAAA==", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		recorder := tusRequest(router, http.MethodPatch, "/api/v1/uploads/abc", "chunk",
+			"Content-Type", test.contentType, "Upload-Offset", test.uploadOffset, "Upload-Checksum", test.checksum)
+		if recorder.Code != test.expectedStatus {
+			t.Errorf("%s: got %d, want %d", test.name, recorder.Code, test.expectedStatus)
+		}
+	}
+
+	// Another request of this process writing to the upload
+	lockUpload("busy")
+	defer unlockUpload("busy")
+
+	recorder := tusRequest(router, http.MethodPatch, "/api/v1/uploads/busy", "chunk", "Content-Type", tusOffsetContentType, "Upload-Offset", "0")
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("PATCH of a locked upload got %d, want %d", recorder.Code, http.StatusConflict)
+	}
+
+	recorder = tusRequest(router, http.MethodDelete, "/api/v1/uploads/busy", "")
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("DELETE of a locked upload got %d, want %d", recorder.Code, http.StatusConflict)
+	}
+}
+
+// TestUploadLifecycle runs against the PostgreSQL database of the TEST_PG* environment variables.
+// It stops short of the last chunk, as completing an upload needs ffprobe.
+func TestUploadLifecycle(t *testing.T) {
+	pgHost = os.Getenv("TEST_PGHOST")
+	if len(pgHost) == 0 {
+		t.Skip("No TEST_PGHOST environment variable")
+	}
+
+	pgUser, pgPassword, pgDb = os.Getenv("TEST_PGUSER"), os.Getenv("TEST_PGPASSWORD"), os.Getenv("TEST_PGDB")
+	database.CreateSchemas(pgUser, pgPassword, pgHost, pgDb)
+
+	folderPath, err := ioutil.TempDir("", "tus-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(folderPath)
+	uploadFolderPath = folderPath + "/"
+
+	video, err := database.CreateVideoObject(entity.Video{Title: "tus test"}, database.GetConnection(pgUser, pgPassword, pgHost, pgDb))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := newUploadTestRouter()
+	metadata := encodeMetadata("video_id", strconv.Itoa(int(video.ID)), "filename", "source.mp4")
+
+	recorder := tusRequest(router, http.MethodPost, "/api/v1/uploads", "", "Upload-Length", "10", "Upload-Metadata", metadata)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("creation got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	location := recorder.Header().Get("Location")
+	if !strings.HasPrefix(location, "/api/v1/uploads/") || recorder.Header().Get("Upload-Offset") != "0" {
+		t.Fatalf("creation returned Location %q and Upload-Offset %q", location, recorder.Header().Get("Upload-Offset"))
+	}
+
+	session, err := database.GetUploadSessionObject(strings.TrimPrefix(location, "/api/v1/uploads/"), database.GetConnection(pgUser, pgPassword, pgHost, pgDb))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectOffset := func(expected int64) {
+		recorder := tusRequest(router, http.MethodHead, location, "")
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("HEAD got %d", recorder.Code)
+		}
+
+		if recorder.Header().Get("Upload-Offset") != strconv.FormatInt(expected, 10) || recorder.Header().Get("Upload-Length") != "10" {
+			t.Fatalf("HEAD returned Upload-Offset %q and Upload-Length %q, want %d and 10",
+				recorder.Header().Get("Upload-Offset"), recorder.Header().Get("Upload-Length"), expected)
+		}
+
+		if recorder.Header().Get("Upload-Metadata") != metadata || recorder.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("HEAD returned headers %v", recorder.Header())
+		}
+
+		if info, err := os.Stat(session.PartialFilePath); err != nil || info.Size() != expected {
+			t.Fatalf("partial file doesn't hold %d bytes: %v", expected, err)
+		}
+	}
+
+	expectOffset(0)
+
+	recorder = tusRequest(router, http.MethodPatch, location, "hello", "Content-Type", tusOffsetContentType, "Upload-Offset", "5")
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("PATCH at a wrong offset got %d, want %d", recorder.Code, http.StatusConflict)
+	}
+
+	recorder = tusRequest(router, http.MethodPatch, location, "hello", "Content-Type", tusOffsetContentType, "Upload-Offset", "0", "Upload-Checksum", sha1Checksum("jello"))
+	if recorder.Code != statusChecksumMismatch {
+		t.Errorf("PATCH with a wrong checksum got %d, want %d", recorder.Code, statusChecksumMismatch)
+	}
+
+	expectOffset(0)
+
+	recorder = tusRequest(router, http.MethodPatch, location, "hello", "Content-Type", tusOffsetContentType, "Upload-Offset", "0", "Upload-Checksum", sha1Checksum("hello"))
+	if recorder.Code != http.StatusNoContent || recorder.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("PATCH got %d and Upload-Offset %q", recorder.Code, recorder.Header().Get("Upload-Offset"))
+	}
+
+	expectOffset(5)
+
+	recorder = tusRequest(router, http.MethodPatch, location, "world!", "Content-Type", tusOffsetContentType, "Upload-Offset", "5")
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PATCH past Upload-Length got %d, want %d", recorder.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	expectOffset(5)
+
+	// The offset only moves from the one a writer started at
+	isAdvanced, err := database.AdvanceUploadSessionOffset(session.ID, 0, 3, database.GetConnection(pgUser, pgPassword, pgHost, pgDb))
+	if err != nil || isAdvanced {
+		t.Errorf("advancing from a stale offset returned %t, %v", isAdvanced, err)
+	}
+
+	expectOffset(5)
+
+	recorder = tusRequest(router, http.MethodDelete, location, "")
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("DELETE got %d", recorder.Code)
+	}
+
+	if recorder = tusRequest(router, http.MethodHead, location, ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("HEAD of a terminated upload got %d, want %d", recorder.Code, http.StatusNotFound)
+	}
+
+	if _, err = os.Stat(session.PartialFilePath); !os.IsNotExist(err) {
+		t.Errorf("partial file of a terminated upload is left: %v", err)
+	}
+}
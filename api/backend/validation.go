@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/n1207n/video-transcode-queue/api/common/probe"
+)
+
+// loadUploadRules loads the rules uploaded video files
+// are checked against before their transcode task is queued
+func loadUploadRules() {
+	containers, ok := os.LookupEnv("UPLOAD_ALLOWED_CONTAINERS")
+	if !ok {
+		containers = probe.DefaultContainers
+	}
+
+	uploadRules.Containers = probe.ParseList(containers)
+	uploadRules.VideoCodecs = probe.ParseList(os.Getenv("UPLOAD_ALLOWED_VIDEO_CODECS"))
+	uploadRules.AudioCodecs = probe.ParseList(os.Getenv("UPLOAD_ALLOWED_AUDIO_CODECS"))
+
+	if maxDuration := os.Getenv("UPLOAD_MAX_DURATION"); len(maxDuration) != 0 {
+		duration, err := time.ParseDuration(maxDuration)
+		if err != nil || duration <= 0 {
+			panic("Invalid UPLOAD_MAX_DURATION environment variable")
+		}
+
+		uploadRules.MaxDuration = duration
+	}
+
+	if maxResolution := os.Getenv("UPLOAD_MAX_RESOLUTION"); len(maxResolution) != 0 {
+		width, height, err := probe.ParseResolution(maxResolution)
+		if err != nil {
+			panic("Invalid UPLOAD_MAX_RESOLUTION environment variable")
+		}
+
+		uploadRules.MaxWidth, uploadRules.MaxHeight = width, height
+	}
+
+	if requireVideo := os.Getenv("UPLOAD_REQUIRE_VIDEO"); len(requireVideo) != 0 {
+		isRequired, err := strconv.ParseBool(requireVideo)
+		if err != nil {
+			panic("Invalid UPLOAD_REQUIRE_VIDEO environment variable")
+		}
+
+		uploadRules.RequireVideo = isRequired
+	}
+
+	if timeout := os.Getenv("UPLOAD_PROBE_TIMEOUT"); len(timeout) != 0 {
+		duration, err := time.ParseDuration(timeout)
+		if err != nil || duration <= 0 {
+			panic("Invalid UPLOAD_PROBE_TIMEOUT environment variable")
+		}
+
+		uploadRules.Timeout = duration
+	}
+}
+
+// respondUploadError answers a rejected video file with 422 and the rules it broke,
+// other errors of handling an upload with 500
+func respondUploadError(c *gin.Context, err error) {
+	if validationError, ok := err.(*probe.ValidationError); ok {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":        validationError.Error(),
+			"content_type": validationError.ContentType,
+			"violations":   validationError.Violations,
+		})
+
+		return
+	}
+
+	logger.Errorf("Failed to handle uploaded file: %s", err.Error())
+
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error":   err.Error(),
+		"message": "File upload is having issues right now. Please try later.",
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/n1207n/video-transcode-queue/api/common/probe"
+)
+
+func TestRespondUploadError(t *testing.T) {
+	validationError := &probe.ValidationError{
+		ContentType: "text/plain; charset=utf-8",
+		Violations: []probe.Violation{
+			{Code: probe.CodeContentType, Message: "content type text/plain; charset=utf-8 is not a video"},
+		},
+	}
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+
+	respondUploadError(c, validationError)
+
+	if recorder.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusUnprocessableEntity)
+	}
+
+	var body struct {
+		Error       string            `json:"error"`
+		ContentType string            `json:"content_type"`
+		Violations  []probe.Violation `json:"violations"`
+	}
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON response %s: %v", recorder.Body.String(), err)
+	}
+
+	if body.Error != validationError.Error() {
+		t.Errorf("error = %q, want %q", body.Error, validationError.Error())
+	}
+
+	if body.ContentType != validationError.ContentType {
+		t.Errorf("content_type = %q, want %q", body.ContentType, validationError.ContentType)
+	}
+
+	if !reflect.DeepEqual(body.Violations, validationError.Violations) {
+		t.Errorf("violations = %+v, want %+v", body.Violations, validationError.Violations)
+	}
+
+	recorder = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(recorder)
+
+	respondUploadError(c, errors.New("disk full"))
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("status of other errors = %d, want %d", recorder.Code, http.StatusInternalServerError)
+	}
+}
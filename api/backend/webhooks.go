@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/n1207n/video-transcode-queue/api/common/database"
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+	"github.com/n1207n/video-transcode-queue/api/common/webhook"
+)
+
+// webhookDeliveryLogLimit caps deliveries listed per subscription
+const webhookDeliveryLogLimit = 100
+
+// WebhookSubscriptionRequest represents a JSON POST data for webhooks API
+type WebhookSubscriptionRequest struct {
+	URL    string   `json:"url" binding:"required"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+func getWebhookList(c *gin.Context) {
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	subscriptions, err := database.GetWebhookSubscriptionObjects(connection)
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+	} else {
+		c.JSON(http.StatusOK, gin.H{
+			"count":   len(subscriptions),
+			"results": subscriptions,
+		})
+	}
+}
+
+func createWebhook(c *gin.Context) {
+	var request WebhookSubscriptionRequest
+
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+
+	parsedURL, err := url.Parse(request.URL)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || len(parsedURL.Host) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "url must be an absolute http(s) URL",
+		})
+
+		return
+	}
+
+	if err = entity.ValidateWebhookEvents(request.Events); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	secret := request.Secret
+	if len(secret) == 0 {
+		if secret, err = webhook.NewSecret(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+	}
+
+	subscription := entity.WebhookSubscription{
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		URL:       request.URL,
+		Secret:    secret,
+		Events:    strings.Join(request.Events, ","),
+		IsActive:  true,
+	}
+
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	subscription, err = database.CreateWebhookSubscriptionObject(subscription, connection)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":    subscription,
+		"secret":  subscription.Secret,
+		"message": "Webhook registered. Verify payloads with the secret, it is not shown again.",
+	})
+}
+
+func deleteWebhook(c *gin.Context) {
+	subscriptionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	if err = database.DeleteWebhookSubscriptionObject(subscriptionID, connection); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+	} else {
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Webhook deleted.",
+		})
+	}
+}
+
+func getWebhookDeliveries(c *gin.Context) {
+	subscriptionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	deliveries, err := database.GetWebhookDeliveryObjects(subscriptionID, webhookDeliveryLogLimit, connection)
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+	} else {
+		c.JSON(http.StatusOK, gin.H{
+			"count":   len(deliveries),
+			"results": deliveries,
+		})
+	}
+}
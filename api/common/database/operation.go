@@ -2,6 +2,7 @@ package database
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
@@ -27,10 +28,328 @@ func CreateSchemas(user string, password string, host string, db string) {
 
 	defer connection.Close()
 
-	connection.AutoMigrate(&entity.Video{}, &entity.VideoRendering{})
+	connection.AutoMigrate(&entity.Video{}, &entity.VideoRendering{}, &entity.TranscodeJob{}, &entity.TranscodeJobTransition{}, &entity.RenderingProgress{}, &entity.WebhookSubscription{}, &entity.WebhookDelivery{}, &entity.OutboxMessage{}, &entity.UploadSession{})
 
 	connection.Model(&entity.VideoRendering{}).AddForeignKey("video_id", "videos(id)", "CASCADE", "CASCADE")
+	connection.Model(&entity.TranscodeJob{}).AddForeignKey("video_id", "videos(id)", "CASCADE", "CASCADE")
+	connection.Model(&entity.TranscodeJobTransition{}).AddForeignKey("job_id", "transcode_jobs(id)", "CASCADE", "CASCADE")
+	connection.Model(&entity.RenderingProgress{}).AddForeignKey("job_id", "transcode_jobs(id)", "CASCADE", "CASCADE")
+	connection.Model(&entity.WebhookDelivery{}).AddForeignKey("subscription_id", "webhook_subscriptions(id)", "CASCADE", "CASCADE")
+	connection.Model(&entity.UploadSession{}).AddForeignKey("video_id", "videos(id)", "CASCADE", "CASCADE")
 
 	connection.Model(&entity.VideoRendering{}).AddIndex("idx_video_id", "video_id")
+	connection.Model(&entity.TranscodeJob{}).AddIndex("idx_transcode_job_video_id", "video_id")
+	connection.Model(&entity.TranscodeJob{}).AddIndex("idx_transcode_job_state", "state")
+	connection.Model(&entity.TranscodeJobTransition{}).AddIndex("idx_transcode_job_transition_job_id", "job_id")
+	connection.Model(&entity.RenderingProgress{}).AddUniqueIndex("idx_rendering_progress_job_profile", "job_id", "profile_name")
+	connection.Model(&entity.WebhookDelivery{}).AddIndex("idx_webhook_delivery_subscription_id", "subscription_id")
 
+	connection.Exec("CREATE INDEX IF NOT EXISTS idx_outbox_message_unpublished ON outbox_messages (id) WHERE published_at IS NULL")
+	connection.Exec("CREATE INDEX IF NOT EXISTS idx_outbox_message_failed ON outbox_messages (id) WHERE failed_at IS NOT NULL")
+	connection.Exec("CREATE INDEX IF NOT EXISTS idx_webhook_delivery_pending ON webhook_deliveries (next_attempt_at) WHERE next_attempt_at IS NOT NULL")
+
+	// Jobs created without a key share the empty one, so only keys set are unique
+	connection.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_transcode_job_idempotency_key ON transcode_jobs (idempotency_key) WHERE idempotency_key <> ''")
+
+}
+
+// TransitionTranscodeJob moves a TranscodeJob to given state
+// and records the transition with an optional error message
+func TransitionTranscodeJob(jobID uint, state string, message string, connection *gorm.DB) (entity.TranscodeJob, error) {
+	var job entity.TranscodeJob
+
+	defer connection.Close()
+
+	transaction := connection.Begin()
+
+	if err := transaction.Set("gorm:query_option", "FOR UPDATE").Where(map[string]interface{}{"id": jobID}).First(&job).Error; err != nil {
+		transaction.Rollback()
+		return job, err
+	}
+
+	if err := entity.ValidateJobStateTransition(job.State, state); err != nil {
+		transaction.Rollback()
+		return job, err
+	}
+
+	now := time.Now()
+	transition := entity.TranscodeJobTransition{
+		JobID:     job.ID,
+		FromState: job.State,
+		ToState:   state,
+		Error:     message,
+	}
+
+	job.State = state
+
+	if state == entity.JobStateProbing && job.StartedAt == nil {
+		job.StartedAt = &now
+	}
+
+	if state == entity.JobStateFailed || state == entity.JobStateCancelled {
+		job.Error = message
+	}
+
+	if entity.IsFinalJobState(state) {
+		job.FinishedAt = &now
+	}
+
+	if err := transaction.Save(&job).Error; err != nil {
+		transaction.Rollback()
+		return job, err
+	}
+
+	if err := transaction.Create(&transition).Error; err != nil {
+		transaction.Rollback()
+		return job, err
+	}
+
+	return job, transaction.Commit().Error
+}
+
+// GetTranscodeJobObjectsByState returns a list of TranscodeJob objects in given states from database
+func GetTranscodeJobObjectsByState(states []string, connection *gorm.DB) ([]entity.TranscodeJob, error) {
+	var jobs []entity.TranscodeJob
+	var dbError error
+
+	defer connection.Close()
+
+	connection = connection.Where("state IN (?)", states).Order("id").Find(&jobs)
+	if connection.Error != nil {
+		dbError = connection.Error
+	}
+
+	return jobs, dbError
+}
+
+// GetVideoTranscodeJobObjectsByState returns a list of TranscodeJob objects
+// of given video in given states from database
+func GetVideoTranscodeJobObjectsByState(videoID uint, states []string, connection *gorm.DB) ([]entity.TranscodeJob, error) {
+	var jobs []entity.TranscodeJob
+	var dbError error
+
+	defer connection.Close()
+
+	connection = connection.Where("video_id = ? AND state IN (?)", videoID, states).Order("id").Find(&jobs)
+	if connection.Error != nil {
+		dbError = connection.Error
+	}
+
+	return jobs, dbError
+}
+
+// GetLatestRenderingProgressObjects returns RenderingProgress objects
+// of the most recent TranscodeJob of given video from database
+func GetLatestRenderingProgressObjects(videoID int, connection *gorm.DB) ([]entity.RenderingProgress, error) {
+	var job entity.TranscodeJob
+	var progress []entity.RenderingProgress
+	var dbError error
+
+	defer connection.Close()
+
+	query := connection.Where(map[string]interface{}{"video_id": videoID}).Order("id desc").First(&job)
+	if query.RecordNotFound() {
+		return progress, nil
+	} else if query.Error != nil {
+		return progress, query.Error
+	}
+
+	query = connection.Where(map[string]interface{}{"job_id": job.ID}).Order("id").Find(&progress)
+	if query.Error != nil {
+		dbError = query.Error
+	}
+
+	return progress, dbError
+}
+
+// GetActiveWebhookSubscriptionObjects returns WebhookSubscription objects
+// registered for given event from database
+func GetActiveWebhookSubscriptionObjects(eventName string, connection *gorm.DB) ([]entity.WebhookSubscription, error) {
+	var subscriptions []entity.WebhookSubscription
+	var acceptingSubscriptions []entity.WebhookSubscription
+
+	defer connection.Close()
+
+	connection = connection.Where(map[string]interface{}{"is_active": true}).Order("id").Find(&subscriptions)
+	if connection.Error != nil {
+		return acceptingSubscriptions, connection.Error
+	}
+
+	for _, subscription := range subscriptions {
+		if subscription.Accepts(eventName) {
+			acceptingSubscriptions = append(acceptingSubscriptions, subscription)
+		}
+	}
+
+	return acceptingSubscriptions, nil
+}
+
+// ClaimDueWebhookDeliveries returns up to limit WebhookDelivery attempts due to be made
+// and moves their NextAttemptAt claimFor ahead, so other dispatchers skip them meanwhile.
+// An attempt not completed by then, e.g. of a stopped process, is claimed again.
+func ClaimDueWebhookDeliveries(limit int, claimFor time.Duration, connection *gorm.DB) ([]entity.WebhookDelivery, error) {
+	var deliveries []entity.WebhookDelivery
+
+	defer connection.Close()
+
+	now := time.Now()
+
+	err := connection.Raw(
+		"UPDATE webhook_deliveries SET next_attempt_at = ?, updated_at = ? WHERE id IN (SELECT id FROM webhook_deliveries WHERE next_attempt_at <= ? ORDER BY next_attempt_at LIMIT ? FOR UPDATE SKIP LOCKED) RETURNING *",
+		now.Add(claimFor), now, now, limit,
+	).Scan(&deliveries).Error
+
+	return deliveries, err
+}
+
+// CompleteWebhookDeliveryAttempt records the outcome of a claimed attempt
+// and creates the next attempt, if any, in one transaction.
+// It tells if it did; the claim having expired and gone to another dispatcher makes it fail.
+func CompleteWebhookDeliveryAttempt(delivery entity.WebhookDelivery, nextDelivery *entity.WebhookDelivery, connection *gorm.DB) (bool, error) {
+	defer connection.Close()
+
+	transaction := connection.Begin()
+
+	result := transaction.Model(&entity.WebhookDelivery{}).
+		Where("id = ? AND next_attempt_at = ?", delivery.ID, delivery.NextAttemptAt).
+		Updates(map[string]interface{}{
+			"status_code":     delivery.StatusCode,
+			"error":           delivery.Error,
+			"is_delivered":    delivery.IsDelivered,
+			"next_attempt_at": nil,
+			"updated_at":      time.Now(),
+		})
+	if result.Error != nil {
+		transaction.Rollback()
+		return false, result.Error
+	}
+
+	if result.RowsAffected != 1 {
+		transaction.Rollback()
+		return false, nil
+	}
+
+	if nextDelivery != nil {
+		if err := transaction.Create(nextDelivery).Error; err != nil {
+			transaction.Rollback()
+			return false, err
+		}
+	}
+
+	if err := transaction.Commit().Error; err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// QueueVideoTranscode saves a video together with the outbox message
+// of its transcode task in one transaction, so neither exists without the other
+func QueueVideoTranscode(video entity.Video, message entity.OutboxMessage, connection *gorm.DB) (entity.Video, entity.OutboxMessage, error) {
+	defer connection.Close()
+
+	now := time.Now()
+	video.TranscodeQueuedAt = &now
+
+	transaction := connection.Begin()
+
+	if err := transaction.Save(&video).Error; err != nil {
+		transaction.Rollback()
+		return video, message, err
+	}
+
+	if err := transaction.Create(&message).Error; err != nil {
+		transaction.Rollback()
+		return video, message, err
+	}
+
+	return video, message, transaction.Commit().Error
+}
+
+// RelayOutboxMessages locks up to limit OutboxMessage objects due for publishing in order,
+// hands them to publish and marks them published in one transaction.
+// A failed publish is recorded on its message, which is retried later or parked,
+// so it doesn't hold back the messages after it.
+// It returns how many messages were published and how many failed.
+func RelayOutboxMessages(limit int, publish func(entity.OutboxMessage) error, connection *gorm.DB) (int, int, error) {
+	var messages []entity.OutboxMessage
+
+	defer connection.Close()
+
+	transaction := connection.Begin()
+
+	// Locked rows are skipped, so several relays share the outbox
+	err := transaction.Raw(
+		"SELECT * FROM outbox_messages WHERE published_at IS NULL AND failed_at IS NULL AND (next_attempt_at IS NULL OR next_attempt_at <= ?) ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED",
+		time.Now(), limit,
+	).Scan(&messages).Error
+	if err != nil {
+		transaction.Rollback()
+		return 0, 0, err
+	}
+
+	published := 0
+	failed := 0
+
+	for index := range messages {
+		message := &messages[index]
+		now := time.Now()
+
+		if publishError := publish(*message); publishError != nil {
+			message.RecordFailure(publishError, now)
+			failed++
+		} else {
+			message.PublishedAt = &now
+			published++
+		}
+
+		if err = transaction.Save(message).Error; err != nil {
+			transaction.Rollback()
+			return 0, 0, err
+		}
+	}
+
+	if err = transaction.Commit().Error; err != nil {
+		return 0, 0, err
+	}
+
+	return published, failed, nil
+}
+
+// DeletePublishedOutboxMessages deletes OutboxMessage objects published before given time
+func DeletePublishedOutboxMessages(before time.Time, connection *gorm.DB) (int64, error) {
+	defer connection.Close()
+
+	connection = connection.Where("published_at < ?", before).Delete(entity.OutboxMessage{})
+
+	return connection.RowsAffected, connection.Error
+}
+
+// AdvanceUploadSessionOffset moves the offset of an UploadSession
+// only if it is still at given offset, and tells if it did.
+// Another request having written to the upload meanwhile makes it fail.
+func AdvanceUploadSessionOffset(sessionID string, fromOffset int64, toOffset int64, connection *gorm.DB) (bool, error) {
+	defer connection.Close()
+
+	connection = connection.Model(&entity.UploadSession{}).
+		Where("id = ? AND upload_offset = ?", sessionID, fromOffset).
+		Updates(map[string]interface{}{"upload_offset": toOffset, "updated_at": time.Now()})
+
+	return connection.RowsAffected == 1, connection.Error
+}
+
+// GetReceivedUploadSessionObjects returns UploadSession objects
+// which received every byte but were not completed
+func GetReceivedUploadSessionObjects(connection *gorm.DB) ([]entity.UploadSession, error) {
+	var sessions []entity.UploadSession
+	var dbError error
+
+	defer connection.Close()
+
+	connection = connection.Where("upload_offset = upload_length AND completed_at IS NULL").Find(&sessions)
+	if connection.Error != nil {
+		dbError = connection.Error
+	}
+
+	return sessions, dbError
 }
@@ -0,0 +1,198 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+)
+
+// testConnection opens the PostgreSQL database of the TEST_PG* environment variables
+// with the schemas created, and skips the test without TEST_PGHOST.
+// Tests delete the rows they work on, so never point it at a database in use.
+func testConnection(t *testing.T) func() *gorm.DB {
+	host := os.Getenv("TEST_PGHOST")
+	if len(host) == 0 {
+		t.Skip("No TEST_PGHOST environment variable")
+	}
+
+	user, password, db := os.Getenv("TEST_PGUSER"), os.Getenv("TEST_PGPASSWORD"), os.Getenv("TEST_PGDB")
+
+	CreateSchemas(user, password, host, db)
+
+	return func() *gorm.DB {
+		return GetConnection(user, password, host, db)
+	}
+}
+
+func TestRelayOutboxMessages(t *testing.T) {
+	connect := testConnection(t)
+
+	connection := connect()
+	connection.Exec("DELETE FROM outbox_messages")
+
+	for _, queueName := range []string{"first", "unknown", "second"} {
+		if err := connection.Create(&entity.OutboxMessage{Queue: queueName, Payload: "{}"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	connection.Close()
+
+	var publishedQueues []string
+
+	publish := func(message entity.OutboxMessage) error {
+		publishedQueues = append(publishedQueues, message.Queue)
+
+		if message.Queue == "unknown" {
+			return errors.New("unknown task queue")
+		}
+
+		return nil
+	}
+
+	published, failed, err := RelayOutboxMessages(10, publish, connect())
+	if err != nil {
+		t.Fatalf("RelayOutboxMessages failed: %v", err)
+	}
+
+	if published != 2 || failed != 1 {
+		t.Errorf("published %d and failed %d messages, want 2 and 1", published, failed)
+	}
+
+	// A failed message doesn't hold back the ones after it
+	expectedQueues := []string{"first", "unknown", "second"}
+	if len(publishedQueues) != len(expectedQueues) {
+		t.Fatalf("publish got %v, want %v", publishedQueues, expectedQueues)
+	}
+
+	for index := range expectedQueues {
+		if publishedQueues[index] != expectedQueues[index] {
+			t.Fatalf("publish got %v, want %v", publishedQueues, expectedQueues)
+		}
+	}
+
+	var message entity.OutboxMessage
+
+	connection = connect()
+	err = connection.Where("queue = ?", "unknown").First(&message).Error
+	connection.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if message.Attempts != 1 || message.LastError != "unknown task queue" || message.NextAttemptAt == nil || message.PublishedAt != nil {
+		t.Fatalf("unexpected failed message: %+v", message)
+	}
+
+	// The failed message waits for its backoff
+	publishedQueues = nil
+
+	if published, failed, err = RelayOutboxMessages(10, publish, connect()); err != nil || published+failed != 0 {
+		t.Fatalf("relay before backoff published %d and failed %d messages: %v", published, failed, err)
+	}
+
+	// The last attempt parks the message
+	connection = connect()
+	connection.Model(&message).Updates(map[string]interface{}{
+		"attempts":        entity.MaxOutboxAttempts - 1,
+		"next_attempt_at": time.Now().Add(-time.Second),
+	})
+	connection.Close()
+
+	if published, failed, err = RelayOutboxMessages(10, publish, connect()); err != nil || published != 0 || failed != 1 {
+		t.Fatalf("relay after backoff published %d and failed %d messages: %v", published, failed, err)
+	}
+
+	connection = connect()
+	err = connection.Where("queue = ?", "unknown").First(&message).Error
+	connection.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if message.FailedAt == nil || message.Attempts != entity.MaxOutboxAttempts {
+		t.Fatalf("message not parked: %+v", message)
+	}
+
+	if published, failed, err = RelayOutboxMessages(10, publish, connect()); err != nil || published+failed != 0 {
+		t.Fatalf("relay of parked message published %d and failed %d messages: %v", published, failed, err)
+	}
+}
+
+func TestClaimWebhookDeliveries(t *testing.T) {
+	connect := testConnection(t)
+
+	connection := connect()
+	connection.Exec("DELETE FROM webhook_subscriptions")
+	connection.Close()
+
+	subscription, err := CreateWebhookSubscriptionObject(entity.WebhookSubscription{URL: "http://localhost", Secret: "secret", IsActive: true}, connect())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	later := now.Add(time.Hour)
+
+	for _, nextAttemptAt := range []*time.Time{&now, &later, nil} {
+		delivery := entity.WebhookDelivery{SubscriptionID: subscription.ID, DeliveryID: "test", Event: "video.ready", Attempt: 1, NextAttemptAt: nextAttemptAt}
+
+		if _, err = CreateWebhookDeliveryObject(delivery, connect()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the due attempt is claimed, and only once
+	deliveries, err := ClaimDueWebhookDeliveries(10, time.Minute, connect())
+	if err != nil {
+		t.Fatalf("ClaimDueWebhookDeliveries failed: %v", err)
+	}
+
+	if len(deliveries) != 1 || deliveries[0].NextAttemptAt == nil || deliveries[0].NextAttemptAt.Before(now.Add(time.Minute-time.Second)) {
+		t.Fatalf("claimed %+v, want the due attempt pushed a minute ahead", deliveries)
+	}
+
+	if claimed, err := ClaimDueWebhookDeliveries(10, time.Minute, connect()); err != nil || len(claimed) != 0 {
+		t.Fatalf("second claim returned %+v: %v", claimed, err)
+	}
+
+	delivery := deliveries[0]
+	delivery.Error = "unexpected response status: 500"
+	delivery.StatusCode = 500
+
+	// The claim expired and another dispatcher claimed the attempt again
+	expiredClaim := delivery
+	staleTime := now.Add(-time.Second)
+	expiredClaim.NextAttemptAt = &staleTime
+
+	if isCompleted, err := CompleteWebhookDeliveryAttempt(expiredClaim, nil, connect()); err != nil || isCompleted {
+		t.Fatalf("completing an expired claim returned %t: %v", isCompleted, err)
+	}
+
+	nextDelivery := &entity.WebhookDelivery{SubscriptionID: subscription.ID, DeliveryID: "test", Event: "video.ready", Attempt: 2, NextAttemptAt: &later}
+
+	if isCompleted, err := CompleteWebhookDeliveryAttempt(delivery, nextDelivery, connect()); err != nil || !isCompleted {
+		t.Fatalf("CompleteWebhookDeliveryAttempt returned %t: %v", isCompleted, err)
+	}
+
+	log, err := GetWebhookDeliveryObjects(int(subscription.ID), 10, connect())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(log) != 4 || log[0].Attempt != 2 || log[0].NextAttemptAt == nil {
+		t.Fatalf("next attempt not recorded: %+v", log)
+	}
+
+	for _, entry := range log {
+		if entry.ID == delivery.ID && (entry.NextAttemptAt != nil || entry.StatusCode != 500) {
+			t.Errorf("attempt not completed: %+v", entry)
+		}
+	}
+}
@@ -115,3 +115,232 @@ func CreateVideoRenderingObject(videoRendering entity.VideoRendering, connection
 
 	return videoRendering, dbError
 }
+
+// CreateTranscodeJobObject pushes TranscodeJob object to database
+func CreateTranscodeJobObject(job entity.TranscodeJob, connection *gorm.DB) (entity.TranscodeJob, error) {
+	var dbError error
+
+	defer connection.Close()
+
+	connection = connection.Create(&job)
+	if connection.Error != nil {
+		dbError = connection.Error
+	}
+
+	return job, dbError
+}
+
+// GetTranscodeJobObject returns a TranscodeJob object from given id from database
+func GetTranscodeJobObject(jobID int, connection *gorm.DB) (entity.TranscodeJob, error) {
+	var job entity.TranscodeJob
+	var dbError error
+
+	defer connection.Close()
+
+	connection = connection.Where(map[string]interface{}{"id": jobID}).Preload("Transitions").Preload("Progress").First(&job)
+	if connection.Error != nil {
+		dbError = connection.Error
+	}
+
+	if job.ID == 0 {
+		dbError = errors.New("no transcode job found")
+	}
+
+	return job, dbError
+}
+
+// GetTranscodeJobObjectByIdempotencyKey returns a TranscodeJob object created for given idempotency key from database
+func GetTranscodeJobObjectByIdempotencyKey(idempotencyKey string, connection *gorm.DB) (entity.TranscodeJob, error) {
+	var job entity.TranscodeJob
+	var dbError error
+
+	defer connection.Close()
+
+	connection = connection.Where(map[string]interface{}{"idempotency_key": idempotencyKey}).First(&job)
+	if connection.Error != nil {
+		dbError = connection.Error
+	}
+
+	if job.ID == 0 {
+		dbError = errors.New("no transcode job found")
+	}
+
+	return job, dbError
+}
+
+// UpdateTranscodeJobObject updates TranscodeJob object to database
+func UpdateTranscodeJobObject(updatedJob entity.TranscodeJob, connection *gorm.DB) (entity.TranscodeJob, error) {
+	var dbError error
+
+	defer connection.Close()
+
+	connection = connection.Save(&updatedJob)
+	if connection.Error != nil {
+		dbError = connection.Error
+	}
+
+	return updatedJob, dbError
+}
+
+// UpdateVideoRenderingObject updates VideoRendering object to database
+func UpdateVideoRenderingObject(updatedRendering entity.VideoRendering, connection *gorm.DB) (entity.VideoRendering, error) {
+	var dbError error
+
+	defer connection.Close()
+
+	connection = connection.Save(&updatedRendering)
+	if connection.Error != nil {
+		dbError = connection.Error
+	}
+
+	return updatedRendering, dbError
+}
+
+// SaveRenderingProgressObject creates or updates RenderingProgress object to database
+func SaveRenderingProgressObject(progress entity.RenderingProgress, connection *gorm.DB) (entity.RenderingProgress, error) {
+	var dbError error
+
+	defer connection.Close()
+
+	connection = connection.Save(&progress)
+	if connection.Error != nil {
+		dbError = connection.Error
+	}
+
+	return progress, dbError
+}
+
+// GetWebhookSubscriptionObjects returns a list of WebhookSubscription objects from database
+func GetWebhookSubscriptionObjects(connection *gorm.DB) ([]entity.WebhookSubscription, error) {
+	var subscriptions []entity.WebhookSubscription
+	var dbError error
+
+	defer connection.Close()
+
+	connection = connection.Order("id").Find(&subscriptions)
+	if connection.Error != nil {
+		dbError = connection.Error
+	}
+
+	return subscriptions, dbError
+}
+
+// GetWebhookSubscriptionObject returns a WebhookSubscription object from given id from database
+func GetWebhookSubscriptionObject(subscriptionID int, connection *gorm.DB) (entity.WebhookSubscription, error) {
+	var subscription entity.WebhookSubscription
+
+	defer connection.Close()
+
+	err := connection.Where(map[string]interface{}{"id": subscriptionID}).First(&subscription).Error
+
+	return subscription, err
+}
+
+// CreateWebhookSubscriptionObject creates WebhookSubscription object to database
+func CreateWebhookSubscriptionObject(subscription entity.WebhookSubscription, connection *gorm.DB) (entity.WebhookSubscription, error) {
+	var dbError error
+
+	defer connection.Close()
+
+	connection = connection.Create(&subscription)
+	if connection.Error != nil {
+		dbError = connection.Error
+	}
+
+	return subscription, dbError
+}
+
+// DeleteWebhookSubscriptionObject deletes WebhookSubscription object from given id from database
+func DeleteWebhookSubscriptionObject(subscriptionID int, connection *gorm.DB) error {
+	defer connection.Close()
+
+	connection = connection.Where(map[string]interface{}{"id": subscriptionID}).Delete(entity.WebhookSubscription{})
+	if connection.Error != nil {
+		return connection.Error
+	}
+
+	if connection.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// CreateWebhookDeliveryObject creates WebhookDelivery object to database
+func CreateWebhookDeliveryObject(delivery entity.WebhookDelivery, connection *gorm.DB) (entity.WebhookDelivery, error) {
+	var dbError error
+
+	defer connection.Close()
+
+	connection = connection.Create(&delivery)
+	if connection.Error != nil {
+		dbError = connection.Error
+	}
+
+	return delivery, dbError
+}
+
+// GetWebhookDeliveryObjects returns the latest WebhookDelivery objects of given subscription from database
+func GetWebhookDeliveryObjects(subscriptionID int, limit int, connection *gorm.DB) ([]entity.WebhookDelivery, error) {
+	var deliveries []entity.WebhookDelivery
+	var dbError error
+
+	defer connection.Close()
+
+	connection = connection.Where(map[string]interface{}{"subscription_id": subscriptionID}).Order("id desc").Limit(limit).Find(&deliveries)
+	if connection.Error != nil {
+		dbError = connection.Error
+	}
+
+	return deliveries, dbError
+}
+
+// CreateUploadSessionObject creates UploadSession object to database
+func CreateUploadSessionObject(session entity.UploadSession, connection *gorm.DB) (entity.UploadSession, error) {
+	var dbError error
+
+	defer connection.Close()
+
+	connection = connection.Create(&session)
+	if connection.Error != nil {
+		dbError = connection.Error
+	}
+
+	return session, dbError
+}
+
+// GetUploadSessionObject returns an UploadSession object from given id from database
+func GetUploadSessionObject(sessionID string, connection *gorm.DB) (entity.UploadSession, error) {
+	var session entity.UploadSession
+	var dbError error
+
+	defer connection.Close()
+
+	connection = connection.Where(map[string]interface{}{"id": sessionID}).First(&session)
+	if connection.Error != nil {
+		dbError = connection.Error
+	}
+
+	return session, dbError
+}
+
+// UpdateUploadSessionObject updates UploadSession object to database
+func UpdateUploadSessionObject(updatedSession entity.UploadSession, connection *gorm.DB) (entity.UploadSession, error) {
+	var dbError error
+
+	defer connection.Close()
+
+	connection = connection.Save(&updatedSession)
+	if connection.Error != nil {
+		dbError = connection.Error
+	}
+
+	return updatedSession, dbError
+}
+
+// DeleteUploadSessionObject deletes UploadSession object in database
+func DeleteUploadSessionObject(session entity.UploadSession, connection *gorm.DB) error {
+	defer connection.Close()
+
+	return connection.Delete(&session).Error
+}
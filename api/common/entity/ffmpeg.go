@@ -1,13 +1,16 @@
 package entity
 
-import "time"
+import (
+	"strconv"
+	"time"
+)
 
 // FFProbeStreamData represents JSON format for each stream
 type FFProbeStreamData struct {
 	Index              int               `json:"index"`
 	CodecName          string            `json:"codec_name"`
 	CodecLongName      string            `json:"codec_long_name"`
-	Profile            int               `json:"profile,string"`
+	Profile            string            `json:"profile"`
 	CodecType          string            `json:"codec_type"`
 	CodecTimeBase      string            `json:"codec_time_base"`
 	CodecTagString     string            `json:"codec_tag_string"`
@@ -60,7 +63,32 @@ func (f FFProbeStreamData) DurationAsObject() time.Duration {
 	return time.Duration(f.Duration * float64(time.Second))
 }
 
+// FFProbeFormatData represents JSON format of the container
+type FFProbeFormatData struct {
+	Filename       string            `json:"filename"`
+	NBStreams      int               `json:"nb_streams"`
+	FormatName     string            `json:"format_name"`
+	FormatLongName string            `json:"format_long_name"`
+	Duration       string            `json:"duration"`
+	Size           string            `json:"size"`
+	BitRate        string            `json:"bit_rate"`
+	Tags           map[string]string `json:"tags"`
+}
+
+// DurationAsObject represents
+// FFProbeFormatData's Duration field as Duration object,
+// zero if ffprobe couldn't tell the duration
+func (f FFProbeFormatData) DurationAsObject() time.Duration {
+	seconds, err := strconv.ParseFloat(f.Duration, 64)
+	if err != nil {
+		return 0
+	}
+
+	return time.Duration(seconds * float64(time.Second))
+}
+
 // ProbeData represents ffprobe info as JSON struct
 type ProbeData struct {
 	Stream []FFProbeStreamData `json:"streams,omitempty"`
+	Format *FFProbeFormatData  `json:"format,omitempty"`
 }
@@ -0,0 +1,104 @@
+package entity
+
+import (
+	"fmt"
+	"time"
+)
+
+// Transcode job states
+const (
+	JobStateQueued    = "queued"
+	JobStateProbing   = "probing"
+	JobStateEncoding  = "encoding"
+	JobStatePackaging = "packaging"
+	JobStateReady     = "ready"
+	JobStateFailed    = "failed"
+	JobStateCancelled = "cancelled"
+)
+
+// jobStateTransitions lists the states each job state can move to.
+// In-progress states can go back to queued when a transcoder restarts.
+var jobStateTransitions = map[string][]string{
+	JobStateQueued:    {JobStateProbing, JobStateFailed, JobStateCancelled},
+	JobStateProbing:   {JobStateEncoding, JobStateFailed, JobStateCancelled, JobStateQueued},
+	JobStateEncoding:  {JobStatePackaging, JobStateFailed, JobStateCancelled, JobStateQueued},
+	JobStatePackaging: {JobStateReady, JobStateFailed, JobStateCancelled, JobStateQueued},
+	JobStateReady:     {},
+	JobStateFailed:    {},
+	JobStateCancelled: {},
+}
+
+// InProgressJobStates lists the states of a job a worker is busy with
+var InProgressJobStates = []string{JobStateProbing, JobStateEncoding, JobStatePackaging}
+
+// ValidateJobStateTransition returns an error
+// if a job is not allowed to move between given states
+func ValidateJobStateTransition(from string, to string) error {
+	nextStates, ok := jobStateTransitions[from]
+	if !ok {
+		return fmt.Errorf("unknown transcode job state: %s", from)
+	}
+
+	for _, state := range nextStates {
+		if state == to {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid transcode job state transition: %s -> %s", from, to)
+}
+
+// IsFinalJobState tells if a job in given state will not change anymore
+func IsFinalJobState(state string) bool {
+	nextStates, ok := jobStateTransitions[state]
+
+	return ok && len(nextStates) == 0
+}
+
+// TranscodeJob represents a background transcoding job of a Video file
+// Relation:
+// - belongs to Video
+// - has many TranscodeJobTransition
+// - has many RenderingProgress
+type TranscodeJob struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `gorm:"not null" json:"created_at"`
+	UpdatedAt time.Time `gorm:"not null" json:"updated_at"`
+
+	VideoID  uint   `gorm:"not null" json:"video_id"`
+	FilePath string `gorm:"not null" json:"file_path"`
+	State    string `gorm:"not null" json:"state"`
+	Error    string `json:"error"`
+
+	EncodingLadder string           `json:"encoding_ladder"`
+	Renditions     EncodingProfiles `gorm:"type:text" json:"renditions"`
+
+	// IdempotencyKey of the task the job was created for,
+	// a request with a known key gets the existing job back
+	IdempotencyKey string `json:"idempotency_key"`
+
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+
+	Transitions []TranscodeJobTransition `gorm:"ForeignKey:JobID" json:"transitions"`
+	Progress    []RenderingProgress      `gorm:"ForeignKey:JobID" json:"progress"`
+}
+
+func (j TranscodeJob) String() string {
+	return fmt.Sprintf("TranscodeJob: %d - Video %d (%s)", j.ID, j.VideoID, j.State)
+}
+
+// TranscodeJobTransition represents a state change of a TranscodeJob
+type TranscodeJobTransition struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `gorm:"not null" json:"created_at"`
+
+	JobID     uint   `gorm:"not null" json:"job_id"`
+	FromState string `json:"from_state"`
+	ToState   string `gorm:"not null" json:"to_state"`
+	Error     string `json:"error"`
+}
+
+func (t TranscodeJobTransition) String() string {
+	return fmt.Sprintf("TranscodeJobTransition: job %d %s -> %s", t.JobID, t.FromState, t.ToState)
+}
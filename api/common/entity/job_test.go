@@ -0,0 +1,84 @@
+package entity
+
+import "testing"
+
+var jobStates = []string{JobStateQueued, JobStateProbing, JobStateEncoding, JobStatePackaging, JobStateReady, JobStateFailed, JobStateCancelled}
+
+// allowedJobStateTransitions is the state machine spelled out edge by edge
+var allowedJobStateTransitions = map[[2]string]bool{
+	{JobStateQueued, JobStateProbing}:   true,
+	{JobStateQueued, JobStateFailed}:    true,
+	{JobStateQueued, JobStateCancelled}: true,
+
+	{JobStateProbing, JobStateEncoding}:  true,
+	{JobStateProbing, JobStateFailed}:    true,
+	{JobStateProbing, JobStateCancelled}: true,
+	{JobStateProbing, JobStateQueued}:    true,
+
+	{JobStateEncoding, JobStatePackaging}: true,
+	{JobStateEncoding, JobStateFailed}:    true,
+	{JobStateEncoding, JobStateCancelled}: true,
+	{JobStateEncoding, JobStateQueued}:    true,
+
+	{JobStatePackaging, JobStateReady}:     true,
+	{JobStatePackaging, JobStateFailed}:    true,
+	{JobStatePackaging, JobStateCancelled}: true,
+	{JobStatePackaging, JobStateQueued}:    true,
+}
+
+// TestValidateJobStateTransition checks every pair of states against the spelled out edges
+func TestValidateJobStateTransition(t *testing.T) {
+	for _, from := range jobStates {
+		for _, to := range jobStates {
+			err := ValidateJobStateTransition(from, to)
+
+			if isAllowed := allowedJobStateTransitions[[2]string{from, to}]; isAllowed != (err == nil) {
+				t.Errorf("ValidateJobStateTransition(%s, %s) returned %v, want allowed %t", from, to, err, isAllowed)
+			}
+		}
+	}
+}
+
+func TestValidateJobStateTransitionRejects(t *testing.T) {
+	tests := []struct {
+		from string
+		to   string
+	}{
+		{JobStateReady, JobStateEncoding},
+		{JobStateFailed, JobStatePackaging},
+		{JobStateCancelled, JobStateQueued},
+		{JobStateReady, JobStateQueued},
+		{JobStateQueued, JobStateEncoding},
+		{JobStateProbing, JobStateReady},
+		{JobStateEncoding, JobStateEncoding},
+		{"unknown", JobStateQueued},
+		{JobStateQueued, "unknown"},
+	}
+
+	for _, test := range tests {
+		if err := ValidateJobStateTransition(test.from, test.to); err == nil {
+			t.Errorf("ValidateJobStateTransition(%s, %s) succeeded", test.from, test.to)
+		}
+	}
+}
+
+func TestIsFinalJobState(t *testing.T) {
+	finalStates := map[string]bool{JobStateReady: true, JobStateFailed: true, JobStateCancelled: true}
+
+	for _, state := range jobStates {
+		if isFinal := IsFinalJobState(state); isFinal != finalStates[state] {
+			t.Errorf("IsFinalJobState(%s) = %t, want %t", state, isFinal, finalStates[state])
+		}
+	}
+
+	if IsFinalJobState("unknown") {
+		t.Error("unknown state is final")
+	}
+
+	// Every in-progress state can be resumed from the queue
+	for _, state := range InProgressJobStates {
+		if err := ValidateJobStateTransition(state, JobStateQueued); err != nil {
+			t.Errorf("in-progress state %s can't be queued again: %v", state, err)
+		}
+	}
+}
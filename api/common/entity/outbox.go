@@ -0,0 +1,72 @@
+package entity
+
+import (
+	"fmt"
+	"time"
+)
+
+// OutboxMessage represents a task payload waiting to be published to a task queue.
+// It is written in the same transaction as the change it announces,
+// and the outbox relay publishes it at least once afterwards.
+type OutboxMessage struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `gorm:"not null" json:"created_at"`
+	UpdatedAt time.Time `gorm:"not null" json:"updated_at"`
+
+	// Queue names the task queue to publish to,
+	// NotBefore schedules the task instead of publishing it right away
+	Queue     string     `gorm:"not null" json:"queue"`
+	Payload   string     `gorm:"type:text;not null" json:"payload"`
+	NotBefore *time.Time `json:"not_before"`
+
+	// Attempts and LastError record failed publishes. A failed message is retried
+	// from NextAttemptAt on, and parked at FailedAt after MaxOutboxAttempts.
+	Attempts      int        `gorm:"not null" json:"attempts"`
+	LastError     string     `json:"last_error"`
+	NextAttemptAt *time.Time `json:"next_attempt_at"`
+	FailedAt      *time.Time `json:"failed_at"`
+	PublishedAt   *time.Time `json:"published_at"`
+}
+
+const (
+	// MaxOutboxAttempts is how many failed publishes park an OutboxMessage
+	MaxOutboxAttempts = 10
+
+	outboxRetryMinDelay = time.Second
+	outboxRetryMaxDelay = time.Hour
+)
+
+// RecordFailure counts a failed publish and schedules the next attempt
+// with a delay doubling per attempt, or parks the message after too many
+func (om *OutboxMessage) RecordFailure(err error, now time.Time) {
+	om.Attempts++
+	om.LastError = err.Error()
+
+	if om.Attempts >= MaxOutboxAttempts {
+		om.FailedAt = &now
+		om.NextAttemptAt = nil
+		return
+	}
+
+	nextAttemptAt := now.Add(OutboxRetryDelay(om.Attempts))
+	om.NextAttemptAt = &nextAttemptAt
+}
+
+// OutboxRetryDelay returns how long a message waits after given number of failed publishes
+func OutboxRetryDelay(attempts int) time.Duration {
+	delay := outboxRetryMinDelay
+
+	for attempt := 1; attempt < attempts && delay < outboxRetryMaxDelay; attempt++ {
+		delay *= 2
+	}
+
+	if delay > outboxRetryMaxDelay {
+		delay = outboxRetryMaxDelay
+	}
+
+	return delay
+}
+
+func (om OutboxMessage) String() string {
+	return fmt.Sprintf("OutboxMessage: %d - %s", om.ID, om.Queue)
+}
@@ -0,0 +1,69 @@
+package entity
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOutboxRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{9, 256 * time.Second},
+		{13, time.Hour},
+		{100, time.Hour},
+	}
+
+	for _, test := range tests {
+		if delay := OutboxRetryDelay(test.attempts); delay != test.expected {
+			t.Errorf("OutboxRetryDelay(%d) = %s, want %s", test.attempts, delay, test.expected)
+		}
+	}
+}
+
+func TestOutboxMessageRecordFailure(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	message := OutboxMessage{Queue: "unknown"}
+
+	message.RecordFailure(errors.New("unknown task queue"), now)
+
+	if message.Attempts != 1 || message.LastError != "unknown task queue" {
+		t.Fatalf("unexpected failure record: %+v", message)
+	}
+
+	if message.NextAttemptAt == nil || !message.NextAttemptAt.Equal(now.Add(time.Second)) {
+		t.Errorf("NextAttemptAt = %v, want %v", message.NextAttemptAt, now.Add(time.Second))
+	}
+
+	if message.FailedAt != nil {
+		t.Errorf("message parked after one attempt")
+	}
+
+	for message.Attempts < MaxOutboxAttempts-1 {
+		message.RecordFailure(errors.New("unknown task queue"), now)
+	}
+
+	if message.FailedAt != nil {
+		t.Fatalf("message parked after %d attempts", message.Attempts)
+	}
+
+	message.RecordFailure(errors.New("still unknown"), now)
+
+	if message.FailedAt == nil || !message.FailedAt.Equal(now) {
+		t.Errorf("FailedAt = %v, want %v", message.FailedAt, now)
+	}
+
+	if message.NextAttemptAt != nil {
+		t.Errorf("parked message still has NextAttemptAt %v", message.NextAttemptAt)
+	}
+
+	if message.LastError != "still unknown" {
+		t.Errorf("LastError = %q, want the last error", message.LastError)
+	}
+}
@@ -0,0 +1,59 @@
+package entity
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// EncodingProfile represents ffmpeg settings of a single rendition
+// in an encoding ladder
+type EncodingProfile struct {
+	Name   string `json:"name"`
+	Height int    `json:"height"`
+
+	VideoCodec       string `json:"video_codec"`
+	VideoBitrateKbps int    `json:"video_bitrate_kbps"`
+	MaxRateKbps      int    `json:"maxrate_kbps"`
+	BufSizeKbps      int    `json:"bufsize_kbps"`
+	Preset           string `json:"preset"`
+	KeyframeInterval int    `json:"keyframe_interval"`
+
+	AudioCodec       string `json:"audio_codec"`
+	AudioBitrateKbps int    `json:"audio_bitrate_kbps"`
+	AudioChannels    int    `json:"audio_channels"`
+}
+
+func (p EncodingProfile) String() string {
+	return fmt.Sprintf("EncodingProfile: %s - %dp %dk", p.Name, p.Height, p.VideoBitrateKbps)
+}
+
+// EncodingProfiles represents a list of EncodingProfile
+// stored as a JSON text column
+type EncodingProfiles []EncodingProfile
+
+// Value implements driver.Valuer interface
+func (p EncodingProfiles) Value() (driver.Value, error) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+
+	encoded, err := json.Marshal(p)
+
+	return string(encoded), err
+}
+
+// Scan implements sql.Scanner interface
+func (p *EncodingProfiles) Scan(value interface{}) error {
+	switch encoded := value.(type) {
+	case nil:
+		*p = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(encoded, p)
+	case string:
+		return json.Unmarshal([]byte(encoded), p)
+	default:
+		return fmt.Errorf("cannot scan %T into EncodingProfiles", value)
+	}
+}
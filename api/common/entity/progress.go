@@ -0,0 +1,34 @@
+package entity
+
+import (
+	"fmt"
+	"time"
+)
+
+// RenderingProgress represents how far a rendition of a TranscodeJob is encoded
+// Relation:
+// - belongs to TranscodeJob
+type RenderingProgress struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `gorm:"not null" json:"created_at"`
+	UpdatedAt time.Time `gorm:"not null" json:"updated_at"`
+
+	JobID       uint   `gorm:"not null" json:"job_id"`
+	VideoID     uint   `gorm:"not null" json:"video_id"`
+	ProfileName string `gorm:"not null" json:"profile_name"`
+
+	// Frame, OutTime and Speed are the last values reported by ffmpeg,
+	// Duration is the source duration from ffprobe
+	Frame    uint    `json:"frame"`
+	OutTime  float64 `json:"out_time"`
+	Duration float64 `json:"duration"`
+	Speed    float64 `json:"speed"`
+
+	Percent    float64 `json:"percent"`
+	ETASeconds float64 `json:"eta_seconds"`
+	IsDone     bool    `sql:"DEFAULT:false" json:"is_done"`
+}
+
+func (rp RenderingProgress) String() string {
+	return fmt.Sprintf("RenderingProgress: %d - %s %.1f%%", rp.JobID, rp.ProfileName, rp.Percent)
+}
@@ -0,0 +1,42 @@
+package entity
+
+import (
+	"fmt"
+	"time"
+)
+
+// UploadSession represents a resumable tus upload of a Video file.
+// Received bytes are appended to PartialFilePath until UploadOffset
+// reaches UploadLength, then the file is moved next to the video files.
+// Relation:
+// - belongs to Video
+type UploadSession struct {
+	ID        string    `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `gorm:"not null" json:"created_at"`
+	UpdatedAt time.Time `gorm:"not null" json:"updated_at"`
+
+	VideoID  uint   `gorm:"not null" json:"video_id"`
+	Filename string `gorm:"not null" json:"filename"`
+
+	// Metadata is the Upload-Metadata header the upload was created with
+	Metadata string `gorm:"type:text" json:"metadata"`
+
+	UploadLength    int64  `gorm:"not null" json:"upload_length"`
+	UploadOffset    int64  `gorm:"not null" json:"upload_offset"`
+	PartialFilePath string `gorm:"not null" json:"-"`
+
+	// Priority and ScheduledAt of the transcode task queued on completion
+	Priority    string     `json:"priority"`
+	ScheduledAt *time.Time `json:"scheduled_at"`
+
+	CompletedAt *time.Time `json:"completed_at"`
+}
+
+func (us UploadSession) String() string {
+	return fmt.Sprintf("UploadSession: %s - video %d", us.ID, us.VideoID)
+}
+
+// IsComplete tells if every byte of the upload was received
+func (us UploadSession) IsComplete() bool {
+	return us.UploadOffset == us.UploadLength
+}
@@ -17,13 +17,39 @@ type Video struct {
 	IsReadyToServe bool   `sql:"DEFAULT:false" json:"is_ready_to_serve"`
 	StreamFilePath string `json:"stream_file_path"`
 
+	// SourceFilePath is the uploaded file, kept for re-transcoding.
+	// It is named by the server, OriginalFilename is the name the client sent.
+	SourceFilePath   string `json:"source_file_path"`
+	OriginalFilename string `json:"original_filename"`
+
+	// TranscodeQueuedAt is when a transcode task of the video was last recorded
+	TranscodeQueuedAt *time.Time `json:"transcode_queued_at"`
+
+	// HLSManifestPath points to the HLS master playlist
+	// built from the same renditions as the DASH MPD
+	HLSManifestPath string `json:"hls_manifest_path"`
+
+	// EncodingLadder names a ladder from the encoding profile file,
+	// Renditions overrides it with an explicit list of profiles
+	EncodingLadder string           `json:"encoding_ladder"`
+	Renditions     EncodingProfiles `gorm:"type:text" json:"renditions"`
+
 	Renderings []VideoRendering `gorm:"ForeignKey:VideoID"`
+
+	// Progress of the latest TranscodeJob, filled in by the detail API
+	Progress []RenderingProgress `gorm:"-" json:"progress,omitempty"`
 }
 
 func (v Video) String() string {
 	return fmt.Sprintf("Video: %d - %s", v.ID, v.Title)
 }
 
+// Media types of a VideoRendering
+const (
+	MediaTypeVideo = "video"
+	MediaTypeAudio = "audio"
+)
+
 // VideoRendering represents each rendering variant from original
 type VideoRendering struct {
 	ID             uint      `gorm:"primary_key" json:"id"`
@@ -31,10 +57,21 @@ type VideoRendering struct {
 	UpdatedAt      time.Time `gorm:"not null" json:"updated_at"`
 	RenderingTitle string    `gorm:"not null" json:"rendering_title" binding:"required"`
 
-	FilePath string `gorm:"not null" json:"file_path"`
-	URL      string `gorm:"not null" json:"url"`
-	Width    uint   `gorm:"not null" json:"width"`
-	Height   uint   `gorm:"not null" json:"height"`
+	FilePath  string `gorm:"not null" json:"file_path"`
+	URL       string `gorm:"not null" json:"url"`
+	Width     uint   `gorm:"not null" json:"width"`
+	Height    uint   `gorm:"not null" json:"height"`
+	MediaType string `json:"media_type"`
+
+	// DASH on-demand packaging metadata of the rendering
+	DashFilePath    string  `json:"dash_file_path"`
+	Codecs          string  `json:"codecs"`
+	Bandwidth       uint    `json:"bandwidth"`
+	Duration        float64 `json:"duration"`
+	InitRange       string  `json:"init_range"`
+	IndexRange      string  `json:"index_range"`
+	AudioSampleRate uint    `json:"audio_sample_rate"`
+	AudioChannels   uint    `json:"audio_channels"`
 
 	VideoID uint `json:"video_id"`
 }
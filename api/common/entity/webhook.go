@@ -0,0 +1,111 @@
+package entity
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Webhook event names sent to subscriptions
+const (
+	WebhookEventVideoUploaded     = "video.uploaded"
+	WebhookEventTranscodeStarted  = "transcode.started"
+	WebhookEventRenderingFinished = "rendering.finished"
+	WebhookEventVideoReady        = "video.ready"
+	WebhookEventVideoFailed       = "video.failed"
+)
+
+// WebhookEvents lists every event a subscription can register for
+var WebhookEvents = []string{
+	WebhookEventVideoUploaded,
+	WebhookEventTranscodeStarted,
+	WebhookEventRenderingFinished,
+	WebhookEventVideoReady,
+	WebhookEventVideoFailed,
+}
+
+// WebhookSubscription represents a URL notified of video lifecycle events
+// Relation:
+// - has many WebhookDelivery
+type WebhookSubscription struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `gorm:"not null" json:"created_at"`
+	UpdatedAt time.Time `gorm:"not null" json:"updated_at"`
+
+	URL string `gorm:"not null" json:"url"`
+
+	// Secret signs every payload with HMAC-SHA256,
+	// it is only shown once when the subscription is created
+	Secret string `gorm:"not null" json:"-"`
+
+	// Events is a comma separated list of event names, empty means all
+	Events string `json:"events"`
+
+	IsActive bool `sql:"DEFAULT:true" json:"is_active"`
+}
+
+func (ws WebhookSubscription) String() string {
+	return fmt.Sprintf("WebhookSubscription: %d - %s", ws.ID, ws.URL)
+}
+
+// Accepts tells if the subscription registered for given event
+func (ws WebhookSubscription) Accepts(eventName string) bool {
+	if len(ws.Events) == 0 {
+		return true
+	}
+
+	for _, name := range strings.Split(ws.Events, ",") {
+		if strings.TrimSpace(name) == eventName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateWebhookEvents returns an error for any unknown event name
+func ValidateWebhookEvents(eventNames []string) error {
+	for _, name := range eventNames {
+		isKnown := false
+
+		for _, knownName := range WebhookEvents {
+			if name == knownName {
+				isKnown = true
+				break
+			}
+		}
+
+		if !isKnown {
+			return fmt.Errorf("unknown webhook event: %s", name)
+		}
+	}
+
+	return nil
+}
+
+// WebhookDelivery represents one attempt to POST an event to a subscription.
+// An attempt still to be made has NextAttemptAt set, so pending deliveries
+// outlive the process that queued them.
+// Relation:
+// - belongs to WebhookSubscription
+type WebhookDelivery struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `gorm:"not null" json:"created_at"`
+	UpdatedAt time.Time `gorm:"not null" json:"updated_at"`
+
+	SubscriptionID uint   `gorm:"not null" json:"subscription_id"`
+	DeliveryID     string `gorm:"not null" json:"delivery_id"`
+	Event          string `gorm:"not null" json:"event"`
+	Payload        string `gorm:"type:text" json:"payload"`
+
+	Attempt     int    `gorm:"not null" json:"attempt"`
+	StatusCode  int    `json:"status_code"`
+	Error       string `json:"error"`
+	IsDelivered bool   `sql:"DEFAULT:false" json:"is_delivered"`
+
+	NextAttemptAt *time.Time `json:"next_attempt_at"`
+}
+
+func (wd WebhookDelivery) String() string {
+	return fmt.Sprintf("WebhookDelivery: %s #%d - %s", wd.DeliveryID, wd.Attempt, wd.Event)
+}
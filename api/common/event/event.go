@@ -0,0 +1,84 @@
+package event
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// Types of Event published for a video
+const (
+	TypeJobState = "job_state"
+	TypeProgress = "progress"
+)
+
+// Event represents a transcode job lifecycle or progress change of a video
+type Event struct {
+	Type      string    `json:"type"`
+	VideoID   uint      `json:"video_id"`
+	JobID     uint      `json:"job_id"`
+	Timestamp time.Time `json:"timestamp"`
+
+	// State and Error are set for job_state events
+	State string `json:"state,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	// Progress is set for progress events
+	Progress *entity.RenderingProgress `json:"progress,omitempty"`
+}
+
+// NewJobStateEvent returns an Event for a TranscodeJob that changed state
+func NewJobStateEvent(job entity.TranscodeJob) Event {
+	return Event{
+		Type:      TypeJobState,
+		VideoID:   job.VideoID,
+		JobID:     job.ID,
+		Timestamp: time.Now(),
+		State:     job.State,
+		Error:     job.Error,
+	}
+}
+
+// NewProgressEvent returns an Event for an updated RenderingProgress
+func NewProgressEvent(progress entity.RenderingProgress) Event {
+	return Event{
+		Type:      TypeProgress,
+		VideoID:   progress.VideoID,
+		JobID:     progress.JobID,
+		Timestamp: time.Now(),
+		Progress:  &progress,
+	}
+}
+
+// Channel returns Redis pub/sub channel name carrying events of given video
+func Channel(videoID uint) string {
+	return fmt.Sprintf("video_events::%d", videoID)
+}
+
+// Publish sends an Event to subscribers of its video
+func Publish(client *redis.Client, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return client.Publish(Channel(event.VideoID), string(payload)).Err()
+}
+
+// Subscribe listens to events of given video,
+// the returned PubSub must be closed by the caller
+func Subscribe(client *redis.Client, videoID uint) (*redis.PubSub, error) {
+	return client.Subscribe(Channel(videoID))
+}
+
+// Decode parses an Event from a pub/sub message payload
+func Decode(payload string) (Event, error) {
+	var event Event
+	err := json.Unmarshal([]byte(payload), &event)
+
+	return event, err
+}
@@ -0,0 +1,133 @@
+package lock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// ErrLocked is returned when another holder owns the lock
+var ErrLocked = errors.New("lock is held by another holder")
+
+// ErrLeaseLost is returned when a lease expired before it was renewed
+var ErrLeaseLost = errors.New("lock lease is lost")
+
+// Scripts touching the lock only while it still holds the token of the lease
+const (
+	renewScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+
+	releaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+)
+
+// VideoKey returns the lock key of given video
+func VideoKey(videoID uint) string {
+	return fmt.Sprintf("lock::video::%d", videoID)
+}
+
+// Lease represents a held Redis lock, which expires after its TTL
+// unless it is renewed. Keep it alive with KeepAlive, and Release it when done.
+type Lease struct {
+	client *redis.Client
+	key    string
+	token  string
+	ttl    time.Duration
+
+	releaseOnce sync.Once
+	released    chan struct{}
+}
+
+// Acquire takes the lock of given key with SET NX,
+// returning ErrLocked if another lease holds it
+func Acquire(client *redis.Client, key string, ttl time.Duration) (*Lease, error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, err
+	}
+
+	lease := &Lease{
+		client:   client,
+		key:      key,
+		token:    hex.EncodeToString(tokenBytes),
+		ttl:      ttl,
+		released: make(chan struct{}),
+	}
+
+	isAcquired, err := client.SetNX(key, lease.token, ttl).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if !isAcquired {
+		return nil, ErrLocked
+	}
+
+	return lease, nil
+}
+
+// Renew extends the lease by its TTL, or returns ErrLeaseLost
+// if the lock expired and maybe went to another holder meanwhile
+func (l *Lease) Renew() error {
+	renewed, err := l.client.Eval(renewScript, []string{l.key}, []string{l.token, strconv.FormatInt(int64(l.ttl/time.Millisecond), 10)}).Result()
+	if err != nil {
+		return err
+	}
+
+	if count, ok := renewed.(int64); !ok || count == 0 {
+		return ErrLeaseLost
+	}
+
+	return nil
+}
+
+// KeepAlive renews the lease every third of its TTL until it is released.
+// onLost is called once if the lease is lost, the holder should stop then.
+func (l *Lease) KeepAlive(onLost func(err error)) {
+	go func() {
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+
+		renewedAt := time.Now()
+
+		for {
+			select {
+			case <-l.released:
+				return
+			case <-ticker.C:
+				err := l.Renew()
+				if err == nil {
+					renewedAt = time.Now()
+					continue
+				}
+
+				// A failed call may still be followed by a successful one before the TTL ends
+				if err != ErrLeaseLost && time.Since(renewedAt) < l.ttl {
+					continue
+				}
+
+				if onLost != nil {
+					onLost(err)
+				}
+
+				return
+			}
+		}
+	}()
+}
+
+// Release stops renewing and deletes the lock if the lease still holds it
+func (l *Lease) Release() error {
+	var err error
+
+	l.releaseOnce.Do(func() {
+		close(l.released)
+		err = l.client.Eval(releaseScript, []string{l.key}, []string{l.token}).Err()
+	})
+
+	return err
+}
@@ -0,0 +1,221 @@
+package lock
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// testClient connects to the Redis server of TEST_REDIS_ADDR, e.g. "localhost:6379",
+// and skips the test without it
+func testClient(t *testing.T) *redis.Client {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if len(addr) == 0 {
+		t.Skip("No TEST_REDIS_ADDR environment variable")
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Network:  "tcp",
+		Addr:     addr,
+		Password: os.Getenv("TEST_REDIS_PASSWORD"),
+	})
+
+	if err := client.Ping().Err(); err != nil {
+		t.Fatalf("Redis is unreachable: %v", err)
+	}
+
+	return client
+}
+
+func testKey(t *testing.T) string {
+	return fmt.Sprintf("lock::test::%s::%d", t.Name(), time.Now().UnixNano())
+}
+
+func TestAcquireLocked(t *testing.T) {
+	client := testClient(t)
+	defer client.Close()
+
+	key := testKey(t)
+	defer client.Del(key)
+
+	lease, err := Acquire(client, key, time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	if _, err = Acquire(client, key, time.Minute); err != ErrLocked {
+		t.Fatalf("second Acquire returned %v, want ErrLocked", err)
+	}
+
+	if err = lease.Release(); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+
+	other, err := Acquire(client, key, time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire after Release failed: %v", err)
+	}
+
+	other.Release()
+}
+
+func TestRenew(t *testing.T) {
+	client := testClient(t)
+	defer client.Close()
+
+	key := testKey(t)
+	defer client.Del(key)
+
+	lease, err := Acquire(client, key, time.Second)
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	defer lease.Release()
+
+	client.PExpire(key, 100*time.Millisecond)
+
+	if err = lease.Renew(); err != nil {
+		t.Fatalf("Renew failed: %v", err)
+	}
+
+	ttl, err := client.PTTL(key).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl <= 100*time.Millisecond {
+		t.Errorf("Renew left a TTL of %s, want about %s", ttl, time.Second)
+	}
+}
+
+func TestRenewLost(t *testing.T) {
+	client := testClient(t)
+	defer client.Close()
+
+	key := testKey(t)
+	defer client.Del(key)
+
+	lease, err := Acquire(client, key, time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	// The lock expired and went to another holder
+	client.Del(key)
+
+	other, err := Acquire(client, key, time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire of expired lock failed: %v", err)
+	}
+
+	defer other.Release()
+
+	if err = lease.Renew(); err != ErrLeaseLost {
+		t.Fatalf("Renew of stale lease returned %v, want ErrLeaseLost", err)
+	}
+
+	if token, _ := client.Get(key).Result(); token != other.token {
+		t.Errorf("Renew of stale lease touched the lock of another holder")
+	}
+}
+
+func TestReleaseStaleToken(t *testing.T) {
+	client := testClient(t)
+	defer client.Close()
+
+	key := testKey(t)
+	defer client.Del(key)
+
+	lease, err := Acquire(client, key, time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	client.Del(key)
+
+	other, err := Acquire(client, key, time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire of expired lock failed: %v", err)
+	}
+
+	defer other.Release()
+
+	if err = lease.Release(); err != nil {
+		t.Fatalf("Release of stale lease failed: %v", err)
+	}
+
+	token, err := client.Get(key).Result()
+	if err != nil {
+		t.Fatalf("Release of stale lease deleted the lock of another holder: %v", err)
+	}
+
+	if token != other.token {
+		t.Errorf("lock holds token %q, want %q", token, other.token)
+	}
+}
+
+func TestKeepAliveLost(t *testing.T) {
+	client := testClient(t)
+	defer client.Close()
+
+	key := testKey(t)
+	defer client.Del(key)
+
+	lease, err := Acquire(client, key, 300*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	defer lease.Release()
+
+	lost := make(chan error, 1)
+	lease.KeepAlive(func(err error) {
+		lost <- err
+	})
+
+	client.Del(key)
+
+	select {
+	case err = <-lost:
+		if err != ErrLeaseLost {
+			t.Errorf("onLost got %v, want ErrLeaseLost", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("onLost was not called")
+	}
+}
+
+func TestKeepAliveRenews(t *testing.T) {
+	client := testClient(t)
+	defer client.Close()
+
+	key := testKey(t)
+	defer client.Del(key)
+
+	lease, err := Acquire(client, key, 300*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	lease.KeepAlive(func(err error) {
+		t.Errorf("onLost called: %v", err)
+	})
+
+	time.Sleep(time.Second)
+
+	if token, _ := client.Get(key).Result(); token != lease.token {
+		t.Errorf("lock expired while kept alive")
+	}
+
+	if err = lease.Release(); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+
+	if exists, _ := client.Exists(key).Result(); exists {
+		t.Errorf("lock still exists after Release")
+	}
+}
@@ -0,0 +1,140 @@
+package mpd
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+)
+
+// DefaultMinBufferTime is the buffer a client should fill before playback
+const DefaultMinBufferTime = 1500 * time.Millisecond
+
+// BuildOnDemand creates a static on-demand MPD from DASH packaged renderings.
+// Each rendering is a single file indexed by a sidx box,
+// addressed relative to the MPD file location.
+func BuildOnDemand(renderings []entity.VideoRendering, minBufferTime time.Duration) (*MPD, error) {
+	return build(renderings, minBufferTime, ProfileOnDemand, func(rendering entity.VideoRendering, representation *Representation) error {
+		if rendering.DashFilePath == "" || rendering.IndexRange == "" || rendering.InitRange == "" {
+			return fmt.Errorf("rendering %s is not DASH packaged", rendering.RenderingTitle)
+		}
+
+		representation.BaseURL = filepath.Base(rendering.DashFilePath)
+		representation.SegmentBase = &SegmentBase{
+			IndexRange:      rendering.IndexRange,
+			IndexRangeExact: true,
+			Initialization:  &URL{Range: rendering.InitRange},
+		}
+
+		return nil
+	})
+}
+
+// BuildSegmentTemplate creates a static MPD whose renderings are split into
+// numbered segments of a fixed duration, named after the given templates.
+// $RepresentationID$ in the templates resolves to each rendering title.
+func BuildSegmentTemplate(renderings []entity.VideoRendering, minBufferTime time.Duration, segmentDuration time.Duration, initialization string, media string) (*MPD, error) {
+	if segmentDuration <= 0 {
+		return nil, errors.New("segment duration must be positive")
+	}
+
+	template := SegmentTemplate{
+		Timescale:      1000,
+		Duration:       uint(segmentDuration / time.Millisecond),
+		StartNumber:    1,
+		Initialization: initialization,
+		Media:          media,
+	}
+
+	return build(renderings, minBufferTime, ProfileLive, func(rendering entity.VideoRendering, representation *Representation) error {
+		representationTemplate := template
+		representation.SegmentTemplate = &representationTemplate
+
+		return nil
+	})
+}
+
+// build groups renderings into video and audio adaptation sets of a single period
+func build(renderings []entity.VideoRendering, minBufferTime time.Duration, profile string, addSegments func(entity.VideoRendering, *Representation) error) (*MPD, error) {
+	if len(renderings) == 0 {
+		return nil, errors.New("no rendering to build MPD from")
+	}
+
+	sorted := make([]entity.VideoRendering, len(renderings))
+	copy(sorted, renderings)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Bandwidth < sorted[j].Bandwidth
+	})
+
+	videoSet := AdaptationSet{ID: "0", ContentType: "video", MimeType: "video/mp4"}
+	audioSet := AdaptationSet{ID: "1", ContentType: "audio", MimeType: "audio/mp4"}
+
+	var duration float64
+
+	for _, rendering := range sorted {
+		if rendering.Bandwidth == 0 {
+			return nil, fmt.Errorf("rendering %s has no bandwidth", rendering.RenderingTitle)
+		}
+
+		representation := Representation{
+			ID:        rendering.RenderingTitle,
+			Bandwidth: rendering.Bandwidth,
+			Codecs:    rendering.Codecs,
+		}
+
+		if err := addSegments(rendering, &representation); err != nil {
+			return nil, err
+		}
+
+		if rendering.Duration > duration {
+			duration = rendering.Duration
+		}
+
+		if rendering.MediaType == entity.MediaTypeAudio {
+			representation.AudioSamplingRate = rendering.AudioSampleRate
+
+			if rendering.AudioChannels > 0 {
+				representation.AudioChannelConfiguration = NewAudioChannelConfiguration(rendering.AudioChannels)
+			}
+
+			audioSet.Representations = append(audioSet.Representations, representation)
+		} else {
+			representation.Width = rendering.Width
+			representation.Height = rendering.Height
+
+			videoSet.Representations = append(videoSet.Representations, representation)
+		}
+	}
+
+	period := Period{ID: "0"}
+
+	for _, adaptationSet := range []AdaptationSet{videoSet, audioSet} {
+		if len(adaptationSet.Representations) == 0 {
+			continue
+		}
+
+		if profile == ProfileOnDemand {
+			adaptationSet.SubsegmentAlignment = true
+			adaptationSet.SubsegmentStartsWithSAP = 1
+		} else {
+			adaptationSet.SegmentAlignment = true
+			adaptationSet.StartWithSAP = 1
+		}
+
+		period.AdaptationSets = append(period.AdaptationSets, adaptationSet)
+	}
+
+	presentationDuration := time.Duration(duration * float64(time.Second))
+
+	return &MPD{
+		Profiles:                  profile,
+		Type:                      "static",
+		MediaPresentationDuration: FormatDuration(presentationDuration),
+		MinBufferTime:             FormatDuration(minBufferTime),
+		Periods:                   []Period{period},
+	}, nil
+}
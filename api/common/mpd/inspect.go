@@ -0,0 +1,336 @@
+package mpd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// FileInfo represents DASH packaging metadata of a fragmented MP4 file
+type FileInfo struct {
+	InitRange  string
+	IndexRange string
+	Codecs     string
+	Duration   float64
+
+	AudioSampleRate uint
+	AudioChannels   uint
+}
+
+// boxHeader represents the size and type of an ISO BMFF box
+type boxHeader struct {
+	size       int64
+	boxType    string
+	headerSize int64
+}
+
+// InspectFile reads DASH packaging metadata of a fragmented MP4 file
+func InspectFile(path string) (FileInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	defer file.Close()
+
+	return Inspect(file)
+}
+
+// Inspect reads the byte ranges of the initialization segment (ftyp + moov)
+// and of the sidx index from the top level boxes of a fragmented MP4 stream.
+// Codec and duration are taken from the moov and sidx boxes.
+func Inspect(reader io.ReadSeeker) (FileInfo, error) {
+	var info FileInfo
+	var offset int64
+
+	for info.InitRange == "" || info.IndexRange == "" {
+		if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+			return info, err
+		}
+
+		header, err := readBoxHeader(reader)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return info, err
+		}
+
+		switch header.boxType {
+		case "moov":
+			body, err := readBoxBody(reader, header)
+			if err != nil {
+				return info, err
+			}
+
+			info.InitRange = fmt.Sprintf("0-%d", offset+header.size-1)
+			inspectMovie(body, &info)
+		case "sidx":
+			body, err := readBoxBody(reader, header)
+			if err != nil {
+				return info, err
+			}
+
+			info.IndexRange = fmt.Sprintf("%d-%d", offset, offset+header.size-1)
+			info.Duration = segmentIndexDuration(body)
+		case "moof", "mdat":
+			if info.InitRange == "" {
+				return info, errors.New("no moov box before media data")
+			}
+		}
+
+		if header.size == 0 {
+			break
+		}
+
+		offset += header.size
+	}
+
+	if info.InitRange == "" {
+		return info, errors.New("no moov box found")
+	}
+
+	if info.IndexRange == "" {
+		return info, errors.New("no sidx box found, file is not packaged for DASH on-demand")
+	}
+
+	return info, nil
+}
+
+func readBoxHeader(reader io.Reader) (boxHeader, error) {
+	var header boxHeader
+	buffer := make([]byte, 8)
+
+	if _, err := io.ReadFull(reader, buffer); err != nil {
+		return header, err
+	}
+
+	header.size = int64(binary.BigEndian.Uint32(buffer[0:4]))
+	header.boxType = string(buffer[4:8])
+	header.headerSize = 8
+
+	if header.size == 1 {
+		if _, err := io.ReadFull(reader, buffer); err != nil {
+			return header, err
+		}
+
+		header.size = int64(binary.BigEndian.Uint64(buffer))
+		header.headerSize = 16
+	}
+
+	if header.size != 0 && header.size < header.headerSize {
+		return header, fmt.Errorf("invalid %s box size: %d", header.boxType, header.size)
+	}
+
+	return header, nil
+}
+
+func readBoxBody(reader io.Reader, header boxHeader) ([]byte, error) {
+	if header.size == 0 {
+		return nil, fmt.Errorf("unbounded %s box", header.boxType)
+	}
+
+	body := make([]byte, header.size-header.headerSize)
+	_, err := io.ReadFull(reader, body)
+
+	return body, err
+}
+
+// childBoxes splits a box payload into its child boxes keyed by type.
+// Only the first child of each type is kept.
+func childBoxes(payload []byte) map[string][]byte {
+	children := map[string][]byte{}
+
+	for len(payload) >= 8 {
+		size := int(binary.BigEndian.Uint32(payload[0:4]))
+		boxType := string(payload[4:8])
+
+		if size < 8 || size > len(payload) {
+			break
+		}
+
+		if _, ok := children[boxType]; !ok {
+			children[boxType] = payload[8:size]
+		}
+
+		payload = payload[size:]
+	}
+
+	return children
+}
+
+// findBox walks nested boxes down the given path of box types
+func findBox(payload []byte, path ...string) []byte {
+	for _, boxType := range path {
+		child, ok := childBoxes(payload)[boxType]
+		if !ok {
+			return nil
+		}
+
+		payload = child
+	}
+
+	return payload
+}
+
+// inspectMovie reads the codec of the first track in a moov box payload
+func inspectMovie(moov []byte, info *FileInfo) {
+	stsd := findBox(moov, "trak", "mdia", "minf", "stbl", "stsd")
+
+	// Skip version, flags and entry count of the sample description box
+	if len(stsd) < 16 {
+		return
+	}
+
+	entries := stsd[8:]
+	entrySize := int(binary.BigEndian.Uint32(entries[0:4]))
+	format := string(entries[4:8])
+
+	if entrySize < 8 || entrySize > len(entries) {
+		return
+	}
+
+	entry := entries[8:entrySize]
+	info.Codecs = format
+
+	switch format {
+	case "avc1", "avc3":
+		// Visual sample entry fields take 78 bytes before child boxes
+		if len(entry) < 78 {
+			return
+		}
+
+		avcC := childBoxes(entry[78:])["avcC"]
+		if len(avcC) >= 4 {
+			info.Codecs = fmt.Sprintf("%s.%02x%02x%02x", format, avcC[1], avcC[2], avcC[3])
+		}
+	case "mp4a":
+		// Audio sample entry fields take 28 bytes before child boxes
+		if len(entry) < 28 {
+			return
+		}
+
+		info.AudioChannels = uint(binary.BigEndian.Uint16(entry[16:18]))
+		info.AudioSampleRate = uint(binary.BigEndian.Uint32(entry[24:28]) >> 16)
+
+		if objectType, audioObjectType, ok := parseESDS(childBoxes(entry[28:])["esds"]); ok {
+			info.Codecs = fmt.Sprintf("mp4a.%x.%d", objectType, audioObjectType)
+		}
+	}
+}
+
+// parseESDS reads the object type indication and the audio object type
+// from an elementary stream descriptor box payload
+func parseESDS(esds []byte) (byte, byte, bool) {
+	// Skip version and flags
+	if len(esds) < 4 {
+		return 0, 0, false
+	}
+
+	payload := esds[4:]
+
+	tag, body, _ := readDescriptor(payload)
+	if tag != 0x03 || len(body) < 3 {
+		return 0, 0, false
+	}
+
+	flags := body[2]
+	body = body[3:]
+
+	if flags&0x80 != 0 && len(body) >= 2 {
+		body = body[2:]
+	}
+
+	if flags&0x40 != 0 && len(body) >= 1 {
+		urlLength := int(body[0])
+		if len(body) < 1+urlLength {
+			return 0, 0, false
+		}
+
+		body = body[1+urlLength:]
+	}
+
+	if flags&0x20 != 0 && len(body) >= 2 {
+		body = body[2:]
+	}
+
+	tag, decoderConfig, _ := readDescriptor(body)
+	if tag != 0x04 || len(decoderConfig) < 13 {
+		return 0, 0, false
+	}
+
+	objectType := decoderConfig[0]
+
+	tag, decoderSpecificInfo, _ := readDescriptor(decoderConfig[13:])
+	if tag != 0x05 || len(decoderSpecificInfo) < 1 {
+		return objectType, 0, false
+	}
+
+	audioObjectType := decoderSpecificInfo[0] >> 3
+	if audioObjectType == 31 && len(decoderSpecificInfo) >= 2 {
+		audioObjectType = 32 + (decoderSpecificInfo[0]&0x07)<<3 + decoderSpecificInfo[1]>>5
+	}
+
+	return objectType, audioObjectType, true
+}
+
+// readDescriptor reads an MPEG-4 descriptor with its variable length size
+func readDescriptor(payload []byte) (byte, []byte, []byte) {
+	if len(payload) < 2 {
+		return 0, nil, nil
+	}
+
+	tag := payload[0]
+	length := 0
+	index := 1
+
+	for ; index < len(payload) && index < 5; index++ {
+		length = length<<7 | int(payload[index]&0x7f)
+
+		if payload[index]&0x80 == 0 {
+			index++
+			break
+		}
+	}
+
+	if index+length > len(payload) {
+		return 0, nil, nil
+	}
+
+	return tag, payload[index : index+length], payload[index+length:]
+}
+
+// segmentIndexDuration sums up subsegment durations of a sidx box payload in seconds
+func segmentIndexDuration(sidx []byte) float64 {
+	if len(sidx) < 12 {
+		return 0
+	}
+
+	version := sidx[0]
+	timescale := binary.BigEndian.Uint32(sidx[8:12])
+
+	// Skip earliest presentation time and first offset
+	referencesOffset := 12 + 8
+	if version != 0 {
+		referencesOffset = 12 + 16
+	}
+
+	if timescale == 0 || len(sidx) < referencesOffset+4 {
+		return 0
+	}
+
+	referenceCount := int(binary.BigEndian.Uint16(sidx[referencesOffset+2 : referencesOffset+4]))
+	references := sidx[referencesOffset+4:]
+
+	var total uint64
+
+	for index := 0; index < referenceCount && len(references) >= 12; index++ {
+		total += uint64(binary.BigEndian.Uint32(references[4:8]))
+		references = references[12:]
+	}
+
+	return float64(total) / float64(timescale)
+}
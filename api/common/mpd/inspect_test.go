@@ -0,0 +1,73 @@
+package mpd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"testing"
+)
+
+func box(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	header := make([]byte, 8)
+
+	binary.BigEndian.PutUint32(header, uint32(8+len(body)))
+	copy(header[4:], boxType)
+
+	return append(header, body...)
+}
+
+func TestInspect(t *testing.T) {
+	avcC := box("avcC", []byte{0x01, 0x64, 0x00, 0x1f, 0xff})
+	avc1 := box("avc1", make([]byte, 78), avcC)
+	stsd := box("stsd", make([]byte, 8), avc1)
+	moov := box("moov", box("trak", box("mdia", box("minf", box("stbl", stsd)))))
+
+	sidxBody := make([]byte, 24+12*2)
+	binary.BigEndian.PutUint32(sidxBody[8:12], 1000)
+	binary.BigEndian.PutUint16(sidxBody[22:24], 2)
+	binary.BigEndian.PutUint32(sidxBody[28:32], 4000)
+	binary.BigEndian.PutUint32(sidxBody[40:44], 2500)
+	sidx := box("sidx", sidxBody)
+
+	ftyp := box("ftyp", []byte("isom\x00\x00\x02\x00"))
+	file := bytes.Join([][]byte{ftyp, moov, sidx, box("moof"), box("mdat", make([]byte, 32))}, nil)
+
+	info, err := Inspect(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initEnd := len(ftyp) + len(moov) - 1
+	expected := FileInfo{
+		InitRange:  "0-" + strconv.Itoa(initEnd),
+		IndexRange: strconv.Itoa(initEnd+1) + "-" + strconv.Itoa(initEnd+len(sidx)),
+		Codecs:     "avc1.64001f",
+		Duration:   6.5,
+	}
+
+	if info != expected {
+		t.Errorf("Inspect() = %+v, expected %+v", info, expected)
+	}
+}
+
+func TestInspectWithoutIndex(t *testing.T) {
+	file := bytes.Join([][]byte{box("ftyp", []byte("isom")), box("moov"), box("mdat")}, nil)
+
+	if _, err := Inspect(bytes.NewReader(file)); err == nil {
+		t.Error("expected an error for a file without sidx box")
+	}
+}
+
+func TestParseESDS(t *testing.T) {
+	decoderSpecificInfo := []byte{0x05, 0x02, 0x11, 0x90}
+	decoderConfig := append([]byte{0x04, byte(13 + len(decoderSpecificInfo)), 0x40, 0x15}, make([]byte, 11)...)
+	decoderConfig = append(decoderConfig, decoderSpecificInfo...)
+	esDescriptor := append([]byte{0x03, byte(3 + len(decoderConfig)), 0x00, 0x01, 0x00}, decoderConfig...)
+	esds := append([]byte{0, 0, 0, 0}, esDescriptor...)
+
+	objectType, audioObjectType, ok := parseESDS(esds)
+	if !ok || objectType != 0x40 || audioObjectType != 2 {
+		t.Errorf("parseESDS() = %x, %d, %t, expected 40, 2, true", objectType, audioObjectType, ok)
+	}
+}
@@ -0,0 +1,157 @@
+// Package mpd builds and serializes MPEG-DASH media presentation descriptions
+// (ISO/IEC 23009-1) for transcoded video renderings.
+package mpd
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DASH profiles an MPD can conform to
+const (
+	ProfileOnDemand = "urn:mpeg:dash:profile:isoff-on-demand:2011"
+	ProfileLive     = "urn:mpeg:dash:profile:isoff-live:2011"
+)
+
+// audioChannelConfigurationScheme identifies channel counts in AudioChannelConfiguration
+const audioChannelConfigurationScheme = "urn:mpeg:dash:23003:3:audio_channel_configuration:2011"
+
+// MPD represents the root element of a media presentation description
+type MPD struct {
+	XMLName                   xml.Name `xml:"urn:mpeg:dash:schema:mpd:2011 MPD"`
+	Profiles                  string   `xml:"profiles,attr"`
+	Type                      string   `xml:"type,attr"`
+	MediaPresentationDuration string   `xml:"mediaPresentationDuration,attr,omitempty"`
+	MinBufferTime             string   `xml:"minBufferTime,attr"`
+
+	Periods []Period `xml:"Period"`
+}
+
+// Period represents a time interval of the presentation
+type Period struct {
+	ID       string `xml:"id,attr,omitempty"`
+	Start    string `xml:"start,attr,omitempty"`
+	Duration string `xml:"duration,attr,omitempty"`
+
+	AdaptationSets []AdaptationSet `xml:"AdaptationSet"`
+}
+
+// AdaptationSet represents a set of interchangeable encoded versions of a media component
+type AdaptationSet struct {
+	ID                      string `xml:"id,attr,omitempty"`
+	ContentType             string `xml:"contentType,attr,omitempty"`
+	MimeType                string `xml:"mimeType,attr"`
+	Lang                    string `xml:"lang,attr,omitempty"`
+	SegmentAlignment        bool   `xml:"segmentAlignment,attr,omitempty"`
+	SubsegmentAlignment     bool   `xml:"subsegmentAlignment,attr,omitempty"`
+	SubsegmentStartsWithSAP int    `xml:"subsegmentStartsWithSAP,attr,omitempty"`
+	StartWithSAP            int    `xml:"startWithSAP,attr,omitempty"`
+
+	SegmentTemplate *SegmentTemplate `xml:"SegmentTemplate,omitempty"`
+	Representations []Representation `xml:"Representation"`
+}
+
+// Representation represents one encoded version of a media component
+type Representation struct {
+	ID                string `xml:"id,attr"`
+	Bandwidth         uint   `xml:"bandwidth,attr"`
+	Codecs            string `xml:"codecs,attr,omitempty"`
+	Width             uint   `xml:"width,attr,omitempty"`
+	Height            uint   `xml:"height,attr,omitempty"`
+	FrameRate         string `xml:"frameRate,attr,omitempty"`
+	AudioSamplingRate uint   `xml:"audioSamplingRate,attr,omitempty"`
+
+	AudioChannelConfiguration *Descriptor      `xml:"AudioChannelConfiguration,omitempty"`
+	BaseURL                   string           `xml:"BaseURL,omitempty"`
+	SegmentBase               *SegmentBase     `xml:"SegmentBase,omitempty"`
+	SegmentTemplate           *SegmentTemplate `xml:"SegmentTemplate,omitempty"`
+}
+
+// Descriptor represents a generic scheme/value DASH descriptor
+type Descriptor struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+// SegmentBase describes a single segment file indexed by a sidx box
+type SegmentBase struct {
+	IndexRange      string `xml:"indexRange,attr"`
+	IndexRangeExact bool   `xml:"indexRangeExact,attr,omitempty"`
+
+	Initialization *URL `xml:"Initialization,omitempty"`
+}
+
+// SegmentTemplate describes segment URLs built from a template
+type SegmentTemplate struct {
+	Timescale      uint   `xml:"timescale,attr,omitempty"`
+	Duration       uint   `xml:"duration,attr,omitempty"`
+	StartNumber    uint   `xml:"startNumber,attr,omitempty"`
+	Initialization string `xml:"initialization,attr,omitempty"`
+	Media          string `xml:"media,attr"`
+}
+
+// URL represents a URL or a byte range of a segment
+type URL struct {
+	SourceURL string `xml:"sourceURL,attr,omitempty"`
+	Range     string `xml:"range,attr,omitempty"`
+}
+
+// NewAudioChannelConfiguration returns the descriptor of an audio channel count
+func NewAudioChannelConfiguration(channels uint) *Descriptor {
+	return &Descriptor{
+		SchemeIDURI: audioChannelConfigurationScheme,
+		Value:       strconv.FormatUint(uint64(channels), 10),
+	}
+}
+
+// Marshal serializes MPD as an indented XML document
+func (m *MPD) Marshal() ([]byte, error) {
+	buffer := bytes.NewBufferString(xml.Header)
+
+	encoder := xml.NewEncoder(buffer)
+	encoder.Indent("", "  ")
+
+	if err := encoder.Encode(m); err != nil {
+		return nil, err
+	}
+
+	buffer.WriteString("\n")
+
+	return buffer.Bytes(), nil
+}
+
+// FormatDuration formats a duration as xs:duration, e.g. PT1H2M3.5S
+func FormatDuration(duration time.Duration) string {
+	if duration <= 0 {
+		return "PT0S"
+	}
+
+	hours := duration / time.Hour
+	duration -= hours * time.Hour
+
+	minutes := duration / time.Minute
+	duration -= minutes * time.Minute
+
+	seconds := strconv.FormatFloat(duration.Seconds(), 'f', 3, 64)
+	seconds = strings.TrimRight(strings.TrimRight(seconds, "0"), ".")
+
+	formatted := "PT"
+
+	if hours > 0 {
+		formatted += fmt.Sprintf("%dH", hours)
+	}
+
+	if minutes > 0 {
+		formatted += fmt.Sprintf("%dM", minutes)
+	}
+
+	if seconds != "0" || formatted == "PT" {
+		formatted += seconds + "S"
+	}
+
+	return formatted
+}
@@ -0,0 +1,124 @@
+package mpd
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+var testRenderings = []entity.VideoRendering{
+	{
+		RenderingTitle: "sample_720p",
+		MediaType:      entity.MediaTypeVideo,
+		Width:          1280,
+		Height:         720,
+		DashFilePath:   "/data/video_uploads/1/sample_720p_dash.mp4",
+		Codecs:         "avc1.64001f",
+		Bandwidth:      1500000,
+		Duration:       62.5,
+		InitRange:      "0-861",
+		IndexRange:     "862-1033",
+	},
+	{
+		RenderingTitle: "sample_360p",
+		MediaType:      entity.MediaTypeVideo,
+		Width:          640,
+		Height:         360,
+		DashFilePath:   "/data/video_uploads/1/sample_360p_dash.mp4",
+		Codecs:         "avc1.64001e",
+		Bandwidth:      400000,
+		Duration:       62.5,
+		InitRange:      "0-859",
+		IndexRange:     "860-1031",
+	},
+	{
+		RenderingTitle:  "sample_audio",
+		MediaType:       entity.MediaTypeAudio,
+		DashFilePath:    "/data/video_uploads/1/sample_audio_dash.mp4",
+		Codecs:          "mp4a.40.2",
+		Bandwidth:       128000,
+		Duration:        62.54,
+		InitRange:       "0-743",
+		IndexRange:      "744-915",
+		AudioSampleRate: 48000,
+		AudioChannels:   2,
+	},
+}
+
+func assertGolden(t *testing.T, name string, actual []byte) {
+	goldenPath := filepath.Join("testdata", name)
+
+	if *update {
+		if err := ioutil.WriteFile(goldenPath, actual, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := ioutil.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("%s mismatch\n--- expected\n%s\n--- actual\n%s", name, expected, actual)
+	}
+}
+
+func TestBuildOnDemand(t *testing.T) {
+	manifest, err := BuildOnDemand(testRenderings, DefaultMinBufferTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := manifest.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertGolden(t, "on_demand.mpd", output)
+}
+
+func TestBuildOnDemandRequiresPackagedRenderings(t *testing.T) {
+	renderings := []entity.VideoRendering{{RenderingTitle: "sample_360p", Bandwidth: 400000}}
+
+	if _, err := BuildOnDemand(renderings, DefaultMinBufferTime); err == nil {
+		t.Error("expected an error for a rendering without DASH metadata")
+	}
+}
+
+func TestBuildSegmentTemplate(t *testing.T) {
+	manifest, err := BuildSegmentTemplate(testRenderings, 2*time.Second, 4*time.Second, "$RepresentationID$_init.mp4", "$RepresentationID$_$Number$.m4s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := manifest.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertGolden(t, "segment_template.mpd", output)
+}
+
+func TestFormatDuration(t *testing.T) {
+	cases := map[time.Duration]string{
+		0:                        "PT0S",
+		1500 * time.Millisecond:  "PT1.5S",
+		62540 * time.Millisecond: "PT1M2.54S",
+		2 * time.Hour:            "PT2H",
+		time.Hour + time.Second:  "PT1H1S",
+	}
+
+	for duration, expected := range cases {
+		if actual := FormatDuration(duration); actual != expected {
+			t.Errorf("FormatDuration(%s) = %s, expected %s", duration, actual, expected)
+		}
+	}
+}
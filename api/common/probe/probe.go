@@ -0,0 +1,294 @@
+package probe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+)
+
+// Violation codes of a rejected upload
+const (
+	CodeContentType   = "unsupported_content_type"
+	CodeUnreadable    = "unreadable_file"
+	CodeContainer     = "container_not_allowed"
+	CodeNoVideoStream = "no_video_stream"
+	CodeVideoCodec    = "video_codec_not_allowed"
+	CodeAudioCodec    = "audio_codec_not_allowed"
+	CodeDuration      = "duration_exceeded"
+	CodeResolution    = "resolution_exceeded"
+)
+
+const (
+	// DefaultContainers are the containers allowed unless configured otherwise
+	DefaultContainers = "mov,mp4,matroska,webm,avi,mpegts,flv"
+
+	// DefaultTimeout is how long ffprobe may take unless configured otherwise
+	DefaultTimeout = 30 * time.Second
+
+	// sniffLength is how many leading bytes http.DetectContentType looks at
+	sniffLength = 512
+)
+
+// Rules represents what an uploaded video file must look like.
+// Empty lists allow anything and zero limits are unlimited.
+type Rules struct {
+	// Containers are ffprobe format names, e.g. mp4 or matroska
+	Containers  []string
+	VideoCodecs []string
+	AudioCodecs []string
+
+	MaxDuration time.Duration
+	MaxWidth    int
+	MaxHeight   int
+
+	RequireVideo bool
+
+	// Timeout stops ffprobe on files it can't get through
+	Timeout time.Duration
+}
+
+// Violation represents one rule an uploaded file breaks
+type Violation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError represents an uploaded file rejected by Rules
+type ValidationError struct {
+	ContentType string      `json:"content_type"`
+	Violations  []Violation `json:"violations"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for index, violation := range e.Violations {
+		messages[index] = violation.Message
+	}
+
+	return "invalid video file: " + strings.Join(messages, ", ")
+}
+
+// Check sniffs and probes a file and returns a *ValidationError
+// if it breaks the rules. Other errors mean the file couldn't be checked.
+func Check(path string, rules Rules) error {
+	contentType, err := SniffContentType(path)
+	if err != nil {
+		return err
+	}
+
+	validationError := &ValidationError{ContentType: contentType}
+
+	// Text, images and archives are rejected without starting ffprobe,
+	// containers Go can't tell apart are left to it
+	if !isMediaContentType(contentType) {
+		validationError.Violations = append(validationError.Violations, Violation{
+			Code:    CodeContentType,
+			Message: fmt.Sprintf("content type %s is not a video", contentType),
+		})
+
+		return validationError
+	}
+
+	probeData, err := Run(path, rules.Timeout)
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return err
+		}
+
+		validationError.Violations = append(validationError.Violations, Violation{
+			Code:    CodeUnreadable,
+			Message: "ffprobe can't read the file",
+		})
+
+		return validationError
+	}
+
+	validationError.Violations = Validate(probeData, rules)
+	if len(validationError.Violations) != 0 {
+		return validationError
+	}
+
+	return nil
+}
+
+// SniffContentType detects the MIME type of a file from its leading bytes
+func SniffContentType(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	leadingBytes := make([]byte, sniffLength)
+
+	read, err := io.ReadFull(file, leadingBytes)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	return http.DetectContentType(leadingBytes[:read]), nil
+}
+
+// Run returns ffprobe data of the container and streams of a file.
+// An *exec.ExitError means ffprobe couldn't read the file.
+func Run(path string, timeout time.Duration) (entity.ProbeData, error) {
+	var probeData entity.ProbeData
+
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", path)
+
+	outputBytes, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return probeData, fmt.Errorf("ffprobe timed out after %s", timeout)
+	}
+
+	if err != nil {
+		return probeData, err
+	}
+
+	if err = json.Unmarshal(outputBytes, &probeData); err != nil {
+		return probeData, fmt.Errorf("ffprobe JSON parse error: %s", err.Error())
+	}
+
+	return probeData, nil
+}
+
+// Validate returns the rules broken by a probed file
+func Validate(probeData entity.ProbeData, rules Rules) []Violation {
+	var violations []Violation
+
+	if probeData.Format == nil {
+		return []Violation{{Code: CodeUnreadable, Message: "ffprobe found no container"}}
+	}
+
+	// ffprobe names demuxers of several formats like "mov,mp4,m4a,3gp,3g2,mj2"
+	if len(rules.Containers) != 0 && !containsAny(rules.Containers, strings.Split(probeData.Format.FormatName, ",")) {
+		violations = append(violations, Violation{
+			Code:    CodeContainer,
+			Message: fmt.Sprintf("container %s is not one of %s", probeData.Format.FormatName, strings.Join(rules.Containers, ", ")),
+		})
+	}
+
+	if duration := probeData.Format.DurationAsObject(); rules.MaxDuration > 0 && duration > rules.MaxDuration {
+		violations = append(violations, Violation{
+			Code:    CodeDuration,
+			Message: fmt.Sprintf("duration %s exceeds %s", duration, rules.MaxDuration),
+		})
+	}
+
+	hasVideo := false
+
+	for _, stream := range probeData.Stream {
+		switch stream.CodecType {
+		case "video":
+			// Cover art is a still image stream, not the video
+			if stream.Disposition["attached_pic"] == 1 {
+				continue
+			}
+
+			hasVideo = true
+
+			if len(rules.VideoCodecs) != 0 && !containsAny(rules.VideoCodecs, []string{stream.CodecName}) {
+				violations = append(violations, Violation{
+					Code:    CodeVideoCodec,
+					Message: fmt.Sprintf("video codec %s is not one of %s", stream.CodecName, strings.Join(rules.VideoCodecs, ", ")),
+				})
+			}
+
+			if stream.Width != nil && stream.Height != nil && exceedsResolution(*stream.Width, *stream.Height, rules) {
+				violations = append(violations, Violation{
+					Code:    CodeResolution,
+					Message: fmt.Sprintf("resolution %dx%d exceeds %dx%d", *stream.Width, *stream.Height, rules.MaxWidth, rules.MaxHeight),
+				})
+			}
+		case "audio":
+			if len(rules.AudioCodecs) != 0 && !containsAny(rules.AudioCodecs, []string{stream.CodecName}) {
+				violations = append(violations, Violation{
+					Code:    CodeAudioCodec,
+					Message: fmt.Sprintf("audio codec %s is not one of %s", stream.CodecName, strings.Join(rules.AudioCodecs, ", ")),
+				})
+			}
+		}
+	}
+
+	if rules.RequireVideo && !hasVideo {
+		violations = append(violations, Violation{
+			Code:    CodeNoVideoStream,
+			Message: "file has no video stream",
+		})
+	}
+
+	return violations
+}
+
+// ParseList splits a comma separated rule value, dropping empty items
+func ParseList(value string) []string {
+	var items []string
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); len(item) != 0 {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// ParseResolution reads a maximum resolution like 1920x1080
+func ParseResolution(value string) (int, int, error) {
+	var width, height int
+
+	if _, err := fmt.Sscanf(value, "%dx%d", &width, &height); err != nil || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid resolution %q, expected WIDTHxHEIGHT", value)
+	}
+
+	return width, height, nil
+}
+
+// isMediaContentType tells if a sniffed type may be a video container.
+// Go only recognizes a few, e.g. QuickTime and MPEG-TS are octet streams.
+func isMediaContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "video/") ||
+		strings.HasPrefix(contentType, "audio/") ||
+		strings.HasPrefix(contentType, "application/ogg") ||
+		contentType == "application/octet-stream"
+}
+
+// exceedsResolution compares portrait videos against the rotated limit as well
+func exceedsResolution(width int, height int, rules Rules) bool {
+	if rules.MaxWidth <= 0 || rules.MaxHeight <= 0 {
+		return false
+	}
+
+	fitsLandscape := width <= rules.MaxWidth && height <= rules.MaxHeight
+	fitsPortrait := width <= rules.MaxHeight && height <= rules.MaxWidth
+
+	return !fitsLandscape && !fitsPortrait
+}
+
+func containsAny(allowed []string, values []string) bool {
+	for _, value := range values {
+		for _, item := range allowed {
+			if strings.EqualFold(item, value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
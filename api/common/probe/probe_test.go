@@ -0,0 +1,190 @@
+package probe
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+)
+
+// testRules are the rules every canned probe is validated against
+var testRules = Rules{
+	Containers:   []string{"mp4", "matroska"},
+	VideoCodecs:  []string{"h264", "hevc"},
+	AudioCodecs:  []string{"aac"},
+	MaxDuration:  time.Hour,
+	MaxWidth:     1920,
+	MaxHeight:    1080,
+	RequireVideo: true,
+}
+
+// parseProbeData reads canned ffprobe output the way Run does
+func parseProbeData(t *testing.T, output string) entity.ProbeData {
+	var probeData entity.ProbeData
+
+	if err := json.Unmarshal([]byte(output), &probeData); err != nil {
+		t.Fatalf("invalid canned ffprobe output: %v", err)
+	}
+
+	return probeData
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name          string
+		output        string
+		rules         Rules
+		expectedCodes []string
+	}{
+		{
+			name: "valid file",
+			output: `{"format":{"format_name":"mov,mp4,m4a,3gp,3g2,mj2","duration":"60.5"},"streams":[
+				{"codec_type":"video","codec_name":"h264","width":1920,"height":1080},
+				{"codec_type":"audio","codec_name":"aac"}]}`,
+			rules: testRules,
+		},
+		{
+			name:          "no container",
+			output:        `{"streams":[{"codec_type":"video","codec_name":"h264","width":640,"height":360}]}`,
+			rules:         testRules,
+			expectedCodes: []string{CodeUnreadable},
+		},
+		{
+			name:          "container not allowed",
+			output:        `{"format":{"format_name":"avi","duration":"10"},"streams":[{"codec_type":"video","codec_name":"h264","width":640,"height":360}]}`,
+			rules:         testRules,
+			expectedCodes: []string{CodeContainer},
+		},
+		{
+			name:          "duration exceeded",
+			output:        `{"format":{"format_name":"matroska,webm","duration":"3600.5"},"streams":[{"codec_type":"video","codec_name":"hevc","width":640,"height":360}]}`,
+			rules:         testRules,
+			expectedCodes: []string{CodeDuration},
+		},
+		{
+			name: "codecs not allowed",
+			output: `{"format":{"format_name":"matroska,webm","duration":"10"},"streams":[
+				{"codec_type":"video","codec_name":"vp9","width":640,"height":360},
+				{"codec_type":"audio","codec_name":"opus"}]}`,
+			rules:         testRules,
+			expectedCodes: []string{CodeVideoCodec, CodeAudioCodec},
+		},
+		{
+			name:          "resolution exceeded",
+			output:        `{"format":{"format_name":"mp4","duration":"10"},"streams":[{"codec_type":"video","codec_name":"h264","width":3840,"height":2160}]}`,
+			rules:         testRules,
+			expectedCodes: []string{CodeResolution},
+		},
+		{
+			name:   "portrait within rotated limit",
+			output: `{"format":{"format_name":"mp4","duration":"10"},"streams":[{"codec_type":"video","codec_name":"h264","width":1080,"height":1920}]}`,
+			rules:  testRules,
+		},
+		{
+			name: "audio with cover art only",
+			output: `{"format":{"format_name":"mp4","duration":"10"},"streams":[
+				{"codec_type":"audio","codec_name":"aac"},
+				{"codec_type":"video","codec_name":"mjpeg","width":600,"height":600,"disposition":{"attached_pic":1}}]}`,
+			rules:         testRules,
+			expectedCodes: []string{CodeNoVideoStream},
+		},
+		{
+			name:   "audio only without video requirement",
+			output: `{"format":{"format_name":"mp4","duration":"10"},"streams":[{"codec_type":"audio","codec_name":"mp3"}]}`,
+			rules:  Rules{},
+		},
+		{
+			name: "every rule broken",
+			output: `{"format":{"format_name":"avi","duration":"7200"},"streams":[
+				{"codec_type":"audio","codec_name":"mp3"}]}`,
+			rules:         testRules,
+			expectedCodes: []string{CodeContainer, CodeDuration, CodeAudioCodec, CodeNoVideoStream},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			violations := Validate(parseProbeData(t, test.output), test.rules)
+
+			var codes []string
+			for _, violation := range violations {
+				if len(violation.Message) == 0 {
+					t.Errorf("violation %s has no message", violation.Code)
+				}
+
+				codes = append(codes, violation.Code)
+			}
+
+			if !reflect.DeepEqual(codes, test.expectedCodes) {
+				t.Errorf("violation codes = %v, want %v", codes, test.expectedCodes)
+			}
+		})
+	}
+}
+
+func TestValidationError(t *testing.T) {
+	validationError := &ValidationError{
+		ContentType: "video/mp4",
+		Violations: []Violation{
+			{Code: CodeContainer, Message: "container avi is not one of mp4"},
+			{Code: CodeDuration, Message: "duration 2h0m0s exceeds 1h0m0s"},
+		},
+	}
+
+	expected := "invalid video file: container avi is not one of mp4, duration 2h0m0s exceeds 1h0m0s"
+	if validationError.Error() != expected {
+		t.Errorf("Error() = %q, want %q", validationError.Error(), expected)
+	}
+
+	body, err := json.Marshal(validationError)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedBody := `{"content_type":"video/mp4","violations":[` +
+		`{"code":"container_not_allowed","message":"container avi is not one of mp4"},` +
+		`{"code":"duration_exceeded","message":"duration 2h0m0s exceeds 1h0m0s"}]}`
+	if string(body) != expectedBody {
+		t.Errorf("JSON = %s, want %s", body, expectedBody)
+	}
+}
+
+func TestParseResolution(t *testing.T) {
+	tests := []struct {
+		value          string
+		expectedWidth  int
+		expectedHeight int
+		isValid        bool
+	}{
+		{"1920x1080", 1920, 1080, true},
+		{"1080", 0, 0, false},
+		{"0x1080", 0, 0, false},
+		{"-1920x1080", 0, 0, false},
+		{"widexhigh", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		width, height, err := ParseResolution(test.value)
+
+		if test.isValid != (err == nil) {
+			t.Errorf("ParseResolution(%q) returned error %v", test.value, err)
+		}
+
+		if width != test.expectedWidth || height != test.expectedHeight {
+			t.Errorf("ParseResolution(%q) = %dx%d, want %dx%d", test.value, width, height, test.expectedWidth, test.expectedHeight)
+		}
+	}
+}
+
+func TestParseList(t *testing.T) {
+	list := ParseList(" MP4, ,matroska,")
+	if !reflect.DeepEqual(list, []string{"mp4", "matroska"}) {
+		t.Errorf("ParseList = %v, want [mp4 matroska]", list)
+	}
+
+	if list = ParseList(""); list != nil {
+		t.Errorf("ParseList of empty value = %v, want nil", list)
+	}
+}
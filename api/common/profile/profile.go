@@ -0,0 +1,288 @@
+package profile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+)
+
+// profileNamePattern limits profile names to characters
+// safe to be used as a rendition file name suffix
+var profileNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// maxRenditions limits the number of renditions encoded for one video
+const maxRenditions = 8
+
+// Config represents an encoding profile file.
+// Ladders name subsets of profiles which videos can pick at creation time.
+type Config struct {
+	Profiles      []entity.EncodingProfile `json:"profiles"`
+	Ladders       map[string][]string      `json:"ladders"`
+	DefaultLadder string                   `json:"default_ladder"`
+}
+
+// Load reads and validates an encoding ladder JSON file
+func Load(path string) (Config, error) {
+	var config Config
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	if err = json.Unmarshal(contents, &config); err != nil {
+		return config, fmt.Errorf("invalid encoding profile file %s: %s", path, err.Error())
+	}
+
+	if len(config.Profiles) == 0 {
+		return config, errors.New("no encoding profile defined")
+	}
+
+	names := map[string]bool{}
+
+	for index := range config.Profiles {
+		profile := &config.Profiles[index]
+
+		if err = Validate(profile); err != nil {
+			return config, err
+		}
+
+		if names[profile.Name] {
+			return config, fmt.Errorf("duplicate encoding profile: %s", profile.Name)
+		}
+
+		names[profile.Name] = true
+	}
+
+	sortByHeight(config.Profiles)
+
+	// Without named ladders every profile belongs to the default one
+	if len(config.Ladders) == 0 {
+		config.DefaultLadder = "default"
+		config.Ladders = map[string][]string{config.DefaultLadder: {}}
+
+		for _, profile := range config.Profiles {
+			config.Ladders[config.DefaultLadder] = append(config.Ladders[config.DefaultLadder], profile.Name)
+		}
+	}
+
+	for ladder, profileNames := range config.Ladders {
+		if len(profileNames) == 0 {
+			return config, fmt.Errorf("encoding ladder %s has no profile", ladder)
+		}
+
+		for _, name := range profileNames {
+			if !names[name] {
+				return config, fmt.Errorf("encoding ladder %s refers to unknown profile: %s", ladder, name)
+			}
+		}
+	}
+
+	if _, ok := config.Ladders[config.DefaultLadder]; !ok {
+		return config, fmt.Errorf("unknown default encoding ladder: %q", config.DefaultLadder)
+	}
+
+	return config, nil
+}
+
+// Codecs and presets an EncodingProfile may name, as they end up on the ffmpeg command line
+var (
+	videoCodecs = map[string]bool{"libx264": true, "libx265": true, "libvpx-vp9": true}
+	audioCodecs = map[string]bool{"aac": true, "libfdk_aac": true}
+	presets     = map[string]bool{
+		"ultrafast": true, "superfast": true, "veryfast": true, "faster": true, "fast": true,
+		"medium": true, "slow": true, "slower": true, "veryslow": true, "placebo": true,
+	}
+)
+
+// Ranges of numeric EncodingProfile settings
+const (
+	maxHeight           = 4320
+	maxBitrateKbps      = 100000
+	maxKeyframeInterval = 600
+	minAudioBitrateKbps = 8
+	maxAudioBitrateKbps = 512
+	maxAudioChannels    = 8
+)
+
+// Validate checks required EncodingProfile settings
+// and fills optional ones with defaults
+func Validate(profile *entity.EncodingProfile) error {
+	if !profileNamePattern.MatchString(profile.Name) {
+		return fmt.Errorf("invalid encoding profile name: %q", profile.Name)
+	}
+
+	if profile.Height <= 0 || profile.Height > maxHeight || profile.Height%2 != 0 {
+		return fmt.Errorf("encoding profile %s: height must be a positive even number up to %d", profile.Name, maxHeight)
+	}
+
+	if profile.VideoBitrateKbps <= 0 || profile.VideoBitrateKbps > maxBitrateKbps {
+		return fmt.Errorf("encoding profile %s: video_bitrate_kbps must be between 1 and %d", profile.Name, maxBitrateKbps)
+	}
+
+	if profile.MaxRateKbps == 0 {
+		profile.MaxRateKbps = profile.VideoBitrateKbps
+	}
+
+	if profile.BufSizeKbps == 0 {
+		profile.BufSizeKbps = profile.MaxRateKbps
+	}
+
+	if profile.VideoCodec == "" {
+		profile.VideoCodec = "libx264"
+	}
+
+	if profile.Preset == "" {
+		profile.Preset = "slow"
+	}
+
+	if profile.KeyframeInterval == 0 {
+		profile.KeyframeInterval = 24
+	}
+
+	if profile.AudioCodec == "" {
+		profile.AudioCodec = "libfdk_aac"
+	}
+
+	if profile.AudioBitrateKbps == 0 {
+		profile.AudioBitrateKbps = 128
+	}
+
+	if profile.AudioChannels == 0 {
+		profile.AudioChannels = 2
+	}
+
+	if profile.MaxRateKbps < 0 || profile.MaxRateKbps > maxBitrateKbps {
+		return fmt.Errorf("encoding profile %s: maxrate_kbps must be between 1 and %d", profile.Name, maxBitrateKbps)
+	}
+
+	if profile.BufSizeKbps < 0 || profile.BufSizeKbps > maxBitrateKbps {
+		return fmt.Errorf("encoding profile %s: bufsize_kbps must be between 1 and %d", profile.Name, maxBitrateKbps)
+	}
+
+	if !videoCodecs[profile.VideoCodec] {
+		return fmt.Errorf("encoding profile %s: unsupported video_codec %q", profile.Name, profile.VideoCodec)
+	}
+
+	if !presets[profile.Preset] {
+		return fmt.Errorf("encoding profile %s: unsupported preset %q", profile.Name, profile.Preset)
+	}
+
+	if profile.KeyframeInterval < 0 || profile.KeyframeInterval > maxKeyframeInterval {
+		return fmt.Errorf("encoding profile %s: keyframe_interval must be between 1 and %d", profile.Name, maxKeyframeInterval)
+	}
+
+	if !audioCodecs[profile.AudioCodec] {
+		return fmt.Errorf("encoding profile %s: unsupported audio_codec %q", profile.Name, profile.AudioCodec)
+	}
+
+	if profile.AudioBitrateKbps < minAudioBitrateKbps || profile.AudioBitrateKbps > maxAudioBitrateKbps {
+		return fmt.Errorf("encoding profile %s: audio_bitrate_kbps must be between %d and %d", profile.Name, minAudioBitrateKbps, maxAudioBitrateKbps)
+	}
+
+	if profile.AudioChannels < 0 || profile.AudioChannels > maxAudioChannels {
+		return fmt.Errorf("encoding profile %s: audio_channels must be between 1 and %d", profile.Name, maxAudioChannels)
+	}
+
+	return nil
+}
+
+// Ladder returns the profiles of a named ladder,
+// or the default ladder if the name is empty
+func (c Config) Ladder(name string) ([]entity.EncodingProfile, error) {
+	if name == "" {
+		name = c.DefaultLadder
+	}
+
+	profileNames, ok := c.Ladders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown encoding ladder: %s", name)
+	}
+
+	var profiles []entity.EncodingProfile
+
+	for _, profile := range c.Profiles {
+		for _, profileName := range profileNames {
+			if profile.Name == profileName {
+				profiles = append(profiles, profile)
+				break
+			}
+		}
+	}
+
+	return profiles, nil
+}
+
+// Resolve returns the profiles a video should be encoded with.
+// Explicit renditions win over a named ladder.
+func (c Config) Resolve(ladder string, renditions []entity.EncodingProfile) ([]entity.EncodingProfile, error) {
+	if len(renditions) == 0 {
+		return c.Ladder(ladder)
+	}
+
+	profiles := make([]entity.EncodingProfile, len(renditions))
+	copy(profiles, renditions)
+
+	if err := ValidateRenditions(profiles); err != nil {
+		return nil, err
+	}
+
+	sortByHeight(profiles)
+
+	return profiles, nil
+}
+
+// ValidateRenditions checks an explicit list of renditions
+// sent by a client and fills their defaults
+func ValidateRenditions(renditions []entity.EncodingProfile) error {
+	if len(renditions) > maxRenditions {
+		return fmt.Errorf("too many renditions: %d (max %d)", len(renditions), maxRenditions)
+	}
+
+	names := map[string]bool{}
+
+	for index := range renditions {
+		if err := Validate(&renditions[index]); err != nil {
+			return err
+		}
+
+		if names[renditions[index].Name] {
+			return fmt.Errorf("duplicate rendition: %s", renditions[index].Name)
+		}
+
+		names[renditions[index].Name] = true
+	}
+
+	return nil
+}
+
+// SelectForHeight picks the renditions worth encoding for a source video height.
+// Profiles taller than the source are skipped,
+// but the smallest one is always kept.
+func SelectForHeight(profiles []entity.EncodingProfile, sourceHeight int) []entity.EncodingProfile {
+	var selected []entity.EncodingProfile
+
+	for _, profile := range profiles {
+		if profile.Height <= sourceHeight {
+			selected = append(selected, profile)
+		}
+	}
+
+	if len(selected) == 0 && len(profiles) > 0 {
+		selected = append(selected, profiles[len(profiles)-1])
+	}
+
+	return selected
+}
+
+// sortByHeight keeps profiles ordered from the highest rendition
+func sortByHeight(profiles []entity.EncodingProfile) {
+	sort.SliceStable(profiles, func(i, j int) bool {
+		return profiles[i].Height > profiles[j].Height
+	})
+}
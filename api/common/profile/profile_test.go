@@ -0,0 +1,109 @@
+package profile
+
+import (
+	"testing"
+
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+)
+
+func TestValidateDefaults(t *testing.T) {
+	profile := entity.EncodingProfile{Name: "720p", Height: 720, VideoBitrateKbps: 2400}
+
+	if err := Validate(&profile); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	expected := entity.EncodingProfile{
+		Name:             "720p",
+		Height:           720,
+		VideoCodec:       "libx264",
+		VideoBitrateKbps: 2400,
+		MaxRateKbps:      2400,
+		BufSizeKbps:      2400,
+		Preset:           "slow",
+		KeyframeInterval: 24,
+		AudioCodec:       "libfdk_aac",
+		AudioBitrateKbps: 128,
+		AudioChannels:    2,
+	}
+
+	if profile != expected {
+		t.Errorf("unexpected defaults:\n got: %+v\nwant: %+v", profile, expected)
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(profile *entity.EncodingProfile)
+	}{
+		{"invalid name", func(p *entity.EncodingProfile) { p.Name = "720p; rm -rf" }},
+		{"video codec injection", func(p *entity.EncodingProfile) { p.VideoCodec = "libx264 -f mp4 /etc/passwd" }},
+		{"unknown video codec", func(p *entity.EncodingProfile) { p.VideoCodec = "mpeg4" }},
+		{"preset injection", func(p *entity.EncodingProfile) { p.Preset = "slow -map 0" }},
+		{"unknown preset", func(p *entity.EncodingProfile) { p.Preset = "fastest" }},
+		{"audio codec injection", func(p *entity.EncodingProfile) { p.AudioCodec = "aac -i /dev/zero" }},
+		{"unknown audio codec", func(p *entity.EncodingProfile) { p.AudioCodec = "mp3" }},
+		{"negative height", func(p *entity.EncodingProfile) { p.Height = -720 }},
+		{"odd height", func(p *entity.EncodingProfile) { p.Height = 721 }},
+		{"height too large", func(p *entity.EncodingProfile) { p.Height = 8640 }},
+		{"negative video bitrate", func(p *entity.EncodingProfile) { p.VideoBitrateKbps = -1 }},
+		{"video bitrate too large", func(p *entity.EncodingProfile) { p.VideoBitrateKbps = maxBitrateKbps + 1 }},
+		{"negative maxrate", func(p *entity.EncodingProfile) { p.MaxRateKbps = -1 }},
+		{"negative bufsize", func(p *entity.EncodingProfile) { p.BufSizeKbps = -1 }},
+		{"negative keyframe interval", func(p *entity.EncodingProfile) { p.KeyframeInterval = -24 }},
+		{"keyframe interval too large", func(p *entity.EncodingProfile) { p.KeyframeInterval = maxKeyframeInterval + 1 }},
+		{"negative audio bitrate", func(p *entity.EncodingProfile) { p.AudioBitrateKbps = -128 }},
+		{"audio bitrate too small", func(p *entity.EncodingProfile) { p.AudioBitrateKbps = 4 }},
+		{"negative audio channels", func(p *entity.EncodingProfile) { p.AudioChannels = -2 }},
+		{"too many audio channels", func(p *entity.EncodingProfile) { p.AudioChannels = maxAudioChannels + 1 }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profile := entity.EncodingProfile{Name: "720p", Height: 720, VideoBitrateKbps: 2400}
+			test.modify(&profile)
+
+			if err := Validate(&profile); err == nil {
+				t.Errorf("Validate accepted %+v", profile)
+			}
+		})
+	}
+}
+
+func TestValidateAccepts(t *testing.T) {
+	profile := entity.EncodingProfile{
+		Name:             "2160p_vp9",
+		Height:           2160,
+		VideoCodec:       "libvpx-vp9",
+		VideoBitrateKbps: 16000,
+		MaxRateKbps:      20000,
+		BufSizeKbps:      40000,
+		Preset:           "medium",
+		KeyframeInterval: 48,
+		AudioCodec:       "aac",
+		AudioBitrateKbps: 192,
+		AudioChannels:    6,
+	}
+
+	expected := profile
+
+	if err := Validate(&profile); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	if profile != expected {
+		t.Errorf("Validate changed explicit settings:\n got: %+v\nwant: %+v", profile, expected)
+	}
+}
+
+func TestValidateRenditionsDuplicates(t *testing.T) {
+	renditions := []entity.EncodingProfile{
+		{Name: "720p", Height: 720, VideoBitrateKbps: 2400},
+		{Name: "720p", Height: 720, VideoBitrateKbps: 3000},
+	}
+
+	if err := ValidateRenditions(renditions); err == nil {
+		t.Error("ValidateRenditions accepted duplicate names")
+	}
+}
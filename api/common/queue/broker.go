@@ -0,0 +1,63 @@
+package queue
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// Config selects a queue backend and holds what it connects with,
+// only the fields of the selected backend are used
+type Config struct {
+	Backend string
+
+	// RedisTag names the rmq connection of the process,
+	// or the consumer group with the stream backend
+	RedisTag    string
+	RedisClient *redis.Client
+
+	PostgresConnection *gorm.DB
+
+	// ErrorLog logs fetch errors of consuming queues, the standard logger is used without it
+	ErrorLog ErrorLogger
+}
+
+// NewBroker returns a Broker of the configured backend
+func NewBroker(config Config) (Broker, error) {
+	switch config.Backend {
+	case BackendRedis, "":
+		if config.RedisClient == nil {
+			return nil, fmt.Errorf("redis queue backend needs a redis client")
+		}
+
+		return NewRedisBroker(config.RedisTag, config.RedisClient), nil
+	case BackendStream:
+		if config.RedisClient == nil {
+			return nil, fmt.Errorf("stream queue backend needs a redis client")
+		}
+
+		broker := NewStreamBroker(config.RedisTag, config.RedisClient)
+		if config.ErrorLog != nil {
+			broker.ErrorLog = config.ErrorLog
+		}
+
+		return broker, nil
+	case BackendPostgres:
+		if config.PostgresConnection == nil {
+			return nil, fmt.Errorf("postgres queue backend needs a database connection")
+		}
+
+		broker, err := NewPostgresBroker(config.PostgresConnection)
+		if err == nil && config.ErrorLog != nil {
+			broker.ErrorLog = config.ErrorLog
+		}
+
+		return broker, err
+	case BackendMemory:
+		return NewMemoryBroker(), nil
+	default:
+		return nil, fmt.Errorf("unknown queue backend: %s", config.Backend)
+	}
+}
@@ -0,0 +1,233 @@
+package queue
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// MemoryBroker opens TaskQueues living in the process memory.
+// Tasks are lost on exit, so it is meant for tests and single process setups.
+type MemoryBroker struct {
+	mutex  sync.Mutex
+	queues map[string]*memoryQueue
+}
+
+// NewMemoryBroker returns an empty MemoryBroker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		queues: map[string]*memoryQueue{},
+	}
+}
+
+// OpenQueue returns the queue of given name, creating it on first use
+func (b *MemoryBroker) OpenQueue(name string) (TaskQueue, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	queue, ok := b.queues[name]
+	if !ok {
+		queue = &memoryQueue{name: name}
+		b.queues[name] = queue
+	}
+
+	return queue, nil
+}
+
+// Close does nothing, memory queues have nothing to release
+func (b *MemoryBroker) Close() error {
+	return nil
+}
+
+type memoryQueue struct {
+	name string
+
+	mutex     sync.Mutex
+	ready     []string
+	scheduled []memoryScheduledTask
+	rejected  []string
+	unacked   int
+	consumers int
+
+	prefetchLimit int
+	deliveries    chan Delivery
+	stopping      chan struct{}
+}
+
+// memoryScheduledTask is a payload held back until notBefore
+type memoryScheduledTask struct {
+	payload   string
+	notBefore time.Time
+}
+
+func (q *memoryQueue) Name() string {
+	return q.name
+}
+
+func (q *memoryQueue) Publish(payload []byte) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.ready = append(q.ready, string(payload))
+	q.fetch()
+
+	return nil
+}
+
+func (q *memoryQueue) PublishAt(payload []byte, notBefore time.Time) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.scheduled = append(q.scheduled, memoryScheduledTask{
+		payload:   string(payload),
+		notBefore: notBefore,
+	})
+
+	return nil
+}
+
+func (q *memoryQueue) StartConsuming(prefetchLimit int, pollInterval time.Duration) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.deliveries != nil {
+		return errors.New("memory queue " + q.name + " is already consuming")
+	}
+
+	q.prefetchLimit = prefetchLimit
+	q.deliveries = make(chan Delivery, prefetchLimit)
+	q.stopping = make(chan struct{})
+
+	go q.poll(pollInterval, q.stopping)
+
+	return nil
+}
+
+// StopConsuming closes the deliveries channel, so consumers return once
+// they handled what is in it, and the queue can start consuming again.
+// Deliveries are only sent with the mutex held, so none is sent after it.
+func (q *memoryQueue) StopConsuming() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.stopping != nil {
+		close(q.stopping)
+		q.stopping = nil
+	}
+
+	if q.deliveries != nil {
+		close(q.deliveries)
+		q.deliveries = nil
+	}
+
+	q.prefetchLimit = 0
+}
+
+func (q *memoryQueue) AddConsumer(name string, consumer Consumer) {
+	q.mutex.Lock()
+	deliveries := q.deliveries
+	q.consumers++
+	q.mutex.Unlock()
+
+	go func() {
+		for delivery := range deliveries {
+			consumer.Consume(delivery)
+		}
+	}()
+}
+
+func (q *memoryQueue) Stats() (Stats, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return Stats{
+		Ready:     len(q.ready),
+		Scheduled: len(q.scheduled),
+		Unacked:   q.unacked,
+		Rejected:  len(q.rejected),
+		Consumers: q.consumers,
+	}, nil
+}
+
+// poll moves ready tasks to consumers, Publish does it right away as well
+func (q *memoryQueue) poll(pollInterval time.Duration, stopping chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopping:
+			return
+		case <-ticker.C:
+			q.mutex.Lock()
+			q.releaseScheduled(time.Now())
+			q.fetch()
+			q.mutex.Unlock()
+		}
+	}
+}
+
+// releaseScheduled moves due scheduled tasks to the ready ones
+func (q *memoryQueue) releaseScheduled(now time.Time) {
+	var scheduled []memoryScheduledTask
+
+	for _, task := range q.scheduled {
+		if task.notBefore.After(now) {
+			scheduled = append(scheduled, task)
+		} else {
+			q.ready = append(q.ready, task.payload)
+		}
+	}
+
+	q.scheduled = scheduled
+}
+
+// fetch hands ready tasks to consumers up to the prefetch limit.
+// The channel never blocks as it holds fewer deliveries than unacked ones.
+func (q *memoryQueue) fetch() {
+	for len(q.ready) > 0 && q.unacked < q.prefetchLimit {
+		payload := q.ready[0]
+		q.ready = q.ready[1:]
+		q.unacked++
+
+		q.deliveries <- &memoryDelivery{queue: q, payload: payload}
+	}
+}
+
+type memoryDelivery struct {
+	queue    *memoryQueue
+	payload  string
+	isClosed bool
+}
+
+func (d *memoryDelivery) Payload() string {
+	return d.payload
+}
+
+func (d *memoryDelivery) Ack() error {
+	return d.close(false)
+}
+
+func (d *memoryDelivery) Reject() error {
+	return d.close(true)
+}
+
+func (d *memoryDelivery) close(isRejected bool) error {
+	d.queue.mutex.Lock()
+	defer d.queue.mutex.Unlock()
+
+	if d.isClosed {
+		return ErrDeliveryClosed
+	}
+
+	d.isClosed = true
+	d.queue.unacked--
+
+	if isRejected {
+		d.queue.rejected = append(d.queue.rejected, d.payload)
+	}
+
+	d.queue.fetch()
+
+	return nil
+}
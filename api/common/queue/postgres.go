@@ -0,0 +1,350 @@
+package queue
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// States of a PostgresTask
+const (
+	postgresStateReady    = "ready"
+	postgresStateUnacked  = "unacked"
+	postgresStateRejected = "rejected"
+)
+
+// DefaultUnackedTimeout is how long a fetched task stays unacked
+// before it is handed to another consumer, as its consumer is assumed dead
+const DefaultUnackedTimeout = 30 * time.Minute
+
+// PostgresTask represents a task row of a Postgres backed TaskQueue
+type PostgresTask struct {
+	ID        uint      `gorm:"primary_key"`
+	CreatedAt time.Time `gorm:"not null"`
+	UpdatedAt time.Time `gorm:"not null"`
+
+	Queue   string `gorm:"not null"`
+	Payload string `gorm:"type:text;not null"`
+	State   string `gorm:"not null"`
+
+	// DeliveryCount tells deliveries of the same task apart,
+	// so a consumer whose task timed out can't ack the next delivery
+	DeliveryCount int `gorm:"not null"`
+	FetchedAt     *time.Time
+
+	// NotBefore holds a ready task back until then
+	NotBefore *time.Time
+}
+
+// TableName returns the table holding tasks of every queue
+func (PostgresTask) TableName() string {
+	return "queue_tasks"
+}
+
+// PostgresBroker opens TaskQueues stored in a Postgres table,
+// consumers lock tasks with SELECT ... FOR UPDATE SKIP LOCKED
+type PostgresBroker struct {
+	connection     *gorm.DB
+	UnackedTimeout time.Duration
+	ErrorLog       ErrorLogger
+}
+
+// NewPostgresBroker creates the task table if needed.
+// The connection is kept open until the broker is closed.
+func NewPostgresBroker(connection *gorm.DB) (*PostgresBroker, error) {
+	if err := connection.AutoMigrate(&PostgresTask{}).Error; err != nil {
+		return nil, err
+	}
+
+	connection.Model(&PostgresTask{}).AddIndex("idx_queue_task_queue_state", "queue", "state")
+
+	return &PostgresBroker{
+		connection:     connection,
+		UnackedTimeout: DefaultUnackedTimeout,
+		ErrorLog:       log.Printf,
+	}, nil
+}
+
+// OpenQueue returns the queue of given name
+func (b *PostgresBroker) OpenQueue(name string) (TaskQueue, error) {
+	return &postgresQueue{
+		name:   name,
+		broker: b,
+	}, nil
+}
+
+// Close closes the database connection
+func (b *PostgresBroker) Close() error {
+	return b.connection.Close()
+}
+
+type postgresQueue struct {
+	name   string
+	broker *PostgresBroker
+
+	mutex         sync.Mutex
+	unacked       int
+	consumers     int
+	prefetchLimit int
+	deliveries    chan Delivery
+	stopping      chan struct{}
+}
+
+func (q *postgresQueue) Name() string {
+	return q.name
+}
+
+func (q *postgresQueue) Publish(payload []byte) error {
+	task := PostgresTask{
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		Queue:     q.name,
+		Payload:   string(payload),
+		State:     postgresStateReady,
+	}
+
+	return q.broker.connection.Create(&task).Error
+}
+
+// PublishAt adds a ready task which isn't fetched before given time
+func (q *postgresQueue) PublishAt(payload []byte, notBefore time.Time) error {
+	task := PostgresTask{
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		Queue:     q.name,
+		Payload:   string(payload),
+		State:     postgresStateReady,
+		NotBefore: &notBefore,
+	}
+
+	return q.broker.connection.Create(&task).Error
+}
+
+func (q *postgresQueue) StartConsuming(prefetchLimit int, pollInterval time.Duration) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.deliveries != nil {
+		return errors.New("postgres queue " + q.name + " is already consuming")
+	}
+
+	q.prefetchLimit = prefetchLimit
+	q.deliveries = make(chan Delivery, prefetchLimit)
+	q.stopping = make(chan struct{})
+
+	go q.poll(pollInterval, q.stopping, q.deliveries)
+
+	return nil
+}
+
+// StopConsuming stops the poll goroutine, which closes the deliveries channel
+// after its last fetch, so consumers return once they handled what is in it.
+// The queue can start consuming again right away.
+func (q *postgresQueue) StopConsuming() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.stopping != nil {
+		close(q.stopping)
+		q.stopping = nil
+		q.deliveries = nil
+	}
+}
+
+func (q *postgresQueue) AddConsumer(name string, consumer Consumer) {
+	q.mutex.Lock()
+	deliveries := q.deliveries
+	q.consumers++
+	q.mutex.Unlock()
+
+	go func() {
+		for delivery := range deliveries {
+			consumer.Consume(delivery)
+		}
+	}()
+}
+
+func (q *postgresQueue) Stats() (Stats, error) {
+	stats := Stats{}
+
+	rows, err := q.broker.connection.Model(&PostgresTask{}).
+		Select("state, count(*)").
+		Where("queue = ?", q.name).
+		Group("state").
+		Rows()
+	if err != nil {
+		return stats, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var state string
+		var count int
+
+		if err = rows.Scan(&state, &count); err != nil {
+			return stats, err
+		}
+
+		switch state {
+		case postgresStateReady:
+			stats.Ready = count
+		case postgresStateUnacked:
+			stats.Unacked = count
+		case postgresStateRejected:
+			stats.Rejected = count
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return stats, err
+	}
+
+	err = q.broker.connection.Model(&PostgresTask{}).
+		Where("queue = ? AND state = ? AND not_before > ?", q.name, postgresStateReady, time.Now()).
+		Count(&stats.Scheduled).Error
+	stats.Ready -= stats.Scheduled
+
+	q.mutex.Lock()
+	stats.Consumers = q.consumers
+	q.mutex.Unlock()
+
+	return stats, err
+}
+
+// poll fetches into deliveries until stopping is closed, then closes deliveries.
+// It is the only sender, so no fetch in flight sends to a closed channel.
+func (q *postgresQueue) poll(pollInterval time.Duration, stopping chan struct{}, deliveries chan Delivery) {
+	defer close(deliveries)
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopping:
+			return
+		case <-ticker.C:
+			q.fetch(deliveries)
+		}
+	}
+}
+
+// fetch locks ready tasks, and tasks whose consumer timed out,
+// up to the prefetch limit and hands them to consumers
+func (q *postgresQueue) fetch(deliveries chan Delivery) {
+	q.mutex.Lock()
+	limit := q.prefetchLimit - q.unacked
+	q.mutex.Unlock()
+
+	if limit <= 0 {
+		return
+	}
+
+	tasks, err := q.lockTasks(limit)
+	if err != nil {
+		q.broker.ErrorLog("Failed to fetch tasks of postgres queue %s: %s", q.name, err.Error())
+		return
+	}
+
+	if len(tasks) == 0 {
+		return
+	}
+
+	q.mutex.Lock()
+	q.unacked += len(tasks)
+	q.mutex.Unlock()
+
+	for _, task := range tasks {
+		deliveries <- &postgresDelivery{queue: q, task: task}
+	}
+}
+
+func (q *postgresQueue) lockTasks(limit int) ([]PostgresTask, error) {
+	var tasks []PostgresTask
+
+	now := time.Now()
+	transaction := q.broker.connection.Begin()
+
+	err := transaction.Raw(
+		"SELECT * FROM queue_tasks WHERE queue = ? AND ((state = ? AND (not_before IS NULL OR not_before <= ?)) OR (state = ? AND fetched_at < ?)) ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED",
+		q.name,
+		postgresStateReady,
+		now,
+		postgresStateUnacked,
+		now.Add(-q.broker.UnackedTimeout),
+		limit,
+	).Scan(&tasks).Error
+	if err != nil {
+		transaction.Rollback()
+		return nil, err
+	}
+
+	for index := range tasks {
+		tasks[index].State = postgresStateUnacked
+		tasks[index].DeliveryCount++
+		tasks[index].FetchedAt = &now
+
+		if err = transaction.Save(&tasks[index]).Error; err != nil {
+			transaction.Rollback()
+			return nil, err
+		}
+	}
+
+	return tasks, transaction.Commit().Error
+}
+
+type postgresDelivery struct {
+	queue    *postgresQueue
+	task     PostgresTask
+	isClosed bool
+}
+
+func (d *postgresDelivery) Payload() string {
+	return d.task.Payload
+}
+
+// DeliveryCount returns how many times the task was fetched
+func (d *postgresDelivery) DeliveryCount() int {
+	return d.task.DeliveryCount
+}
+
+func (d *postgresDelivery) Ack() error {
+	query := d.queue.broker.connection.
+		Where("id = ? AND state = ? AND delivery_count = ?", d.task.ID, postgresStateUnacked, d.task.DeliveryCount).
+		Delete(PostgresTask{})
+
+	return d.close(query)
+}
+
+func (d *postgresDelivery) Reject() error {
+	query := d.queue.broker.connection.Model(&PostgresTask{}).
+		Where("id = ? AND state = ? AND delivery_count = ?", d.task.ID, postgresStateUnacked, d.task.DeliveryCount).
+		Updates(map[string]interface{}{"state": postgresStateRejected, "updated_at": time.Now()})
+
+	return d.close(query)
+}
+
+func (d *postgresDelivery) close(query *gorm.DB) error {
+	if query.Error != nil {
+		return query.Error
+	}
+
+	d.queue.mutex.Lock()
+	defer d.queue.mutex.Unlock()
+
+	// The prefetch slot is freed once even if the task timed out meanwhile
+	if !d.isClosed {
+		d.isClosed = true
+		d.queue.unacked--
+	}
+
+	if query.RowsAffected == 0 {
+		return ErrDeliveryClosed
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package queue
+
+import (
+	"fmt"
+)
+
+// Priority of a task, each priority is published into its own lane queue
+type Priority string
+
+// Task priorities from the most to the least urgent
+const (
+	PriorityHigh   Priority = "high"
+	PriorityNormal Priority = "normal"
+	PriorityLow    Priority = "low"
+)
+
+// Priorities lists every priority from the most to the least urgent
+var Priorities = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+// ParsePriority returns the Priority of given name,
+// an empty name is the normal priority
+func ParsePriority(name string) (Priority, error) {
+	if len(name) == 0 {
+		return PriorityNormal, nil
+	}
+
+	for _, priority := range Priorities {
+		if string(priority) == name {
+			return priority, nil
+		}
+	}
+
+	return PriorityNormal, fmt.Errorf("unknown priority %q, expected one of high, normal or low", name)
+}
+
+// LaneName returns the queue name of given priority lane of a topic.
+// The normal lane keeps the topic name so tasks published
+// before priorities existed are still consumed.
+func LaneName(topic string, priority Priority) string {
+	if priority == PriorityNormal {
+		return topic
+	}
+
+	return fmt.Sprintf("%s_%s", topic, priority)
+}
@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"errors"
+	"time"
+)
+
+// Names of the TaskQueue backends
+const (
+	BackendRedis    = "redis"
+	BackendStream   = "stream"
+	BackendPostgres = "postgres"
+	BackendMemory   = "memory"
+)
+
+// ErrDeliveryClosed is returned when a delivery is acked or rejected twice
+var ErrDeliveryClosed = errors.New("delivery is already acked or rejected")
+
+// Delivery represents a task payload handed over to a Consumer.
+// It stays unacked until it is acked or rejected.
+type Delivery interface {
+	Payload() string
+	Ack() error
+	Reject() error
+}
+
+// CountedDelivery is a Delivery of a backend
+// which counts how many times a task was delivered
+type CountedDelivery interface {
+	Delivery
+	DeliveryCount() int
+}
+
+// Consumer handles deliveries of a TaskQueue
+type Consumer interface {
+	Consume(delivery Delivery)
+}
+
+// ConsumerFunc is an adapter to use a function as a Consumer
+type ConsumerFunc func(delivery Delivery)
+
+// Consume calls f(delivery)
+func (f ConsumerFunc) Consume(delivery Delivery) {
+	f(delivery)
+}
+
+// Stats represents how many tasks of a TaskQueue are in each state
+type Stats struct {
+	Ready     int `json:"ready"`
+	Scheduled int `json:"scheduled"`
+	Unacked   int `json:"unacked"`
+	Rejected  int `json:"rejected"`
+	Consumers int `json:"consumers"`
+}
+
+// TaskQueue is a named queue of task payloads
+// published by producers and consumed at least once by consumers
+type TaskQueue interface {
+	// Name returns the queue name
+	Name() string
+
+	// Publish adds a payload to the ready tasks
+	Publish(payload []byte) error
+
+	// PublishAt holds a payload back until given time,
+	// consuming processes move it to the ready tasks once it is due
+	PublishAt(payload []byte, notBefore time.Time) error
+
+	// StartConsuming fetches up to prefetchLimit unacked deliveries,
+	// checking for new ready tasks every pollInterval
+	StartConsuming(prefetchLimit int, pollInterval time.Duration) error
+
+	// StopConsuming stops fetching new deliveries,
+	// deliveries already fetched are still handed to consumers.
+	// Consumer goroutines return after them, and except for the redis backend,
+	// whose rmq queues can't be restarted, StartConsuming may be called again.
+	StopConsuming()
+
+	// AddConsumer registers a consumer running in its own goroutine
+	AddConsumer(name string, consumer Consumer)
+
+	Stats() (Stats, error)
+}
+
+// ErrorLogger logs errors of background fetches, which have no caller to return them to.
+// glog.Errorf and the Errorf method of a zap SugaredLogger both fit.
+type ErrorLogger func(format string, args ...interface{})
+
+// Broker opens named TaskQueues on one queue backend
+type Broker interface {
+	OpenQueue(name string) (TaskQueue, error)
+	Close() error
+}
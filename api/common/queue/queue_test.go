@@ -0,0 +1,360 @@
+package queue
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/n1207n/video-transcode-queue/api/common/database"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// testPollInterval keeps tests quick while still polling like production
+const testPollInterval = 20 * time.Millisecond
+
+// testTimeout is how long a test waits for a delivery it expects
+const testTimeout = 3 * time.Second
+
+func TestMemoryQueue(t *testing.T) {
+	testTaskQueue(t, NewMemoryBroker())
+	testRestart(t, NewMemoryBroker())
+}
+
+// TestPostgresQueue runs against the PostgreSQL database of the TEST_PG* environment variables
+func TestPostgresQueue(t *testing.T) {
+	host := os.Getenv("TEST_PGHOST")
+	if len(host) == 0 {
+		t.Skip("No TEST_PGHOST environment variable")
+	}
+
+	connection := database.GetConnection(os.Getenv("TEST_PGUSER"), os.Getenv("TEST_PGPASSWORD"), host, os.Getenv("TEST_PGDB"))
+
+	broker, err := NewPostgresBroker(connection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer broker.Close()
+
+	testTaskQueue(t, broker)
+	testRestart(t, broker)
+}
+
+// TestRedisQueue runs against the Redis server of TEST_REDIS_ADDR, e.g. "localhost:6379"
+func TestRedisQueue(t *testing.T) {
+	client := testRedisClient(t)
+	defer client.Close()
+
+	testTaskQueue(t, NewRedisBroker(fmt.Sprintf("test-%d", time.Now().UnixNano()), client))
+}
+
+// TestStreamQueue runs against the Redis server of TEST_REDIS_ADDR, which must be 6.2 or newer
+func TestStreamQueue(t *testing.T) {
+	client := testRedisClient(t)
+	defer client.Close()
+
+	testTaskQueue(t, NewStreamBroker("test", client))
+	testRestart(t, NewStreamBroker("test", client))
+}
+
+func testRedisClient(t *testing.T) *redis.Client {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if len(addr) == 0 {
+		t.Skip("No TEST_REDIS_ADDR environment variable")
+	}
+
+	return redis.NewClient(&redis.Options{
+		Network:  "tcp",
+		Addr:     addr,
+		Password: os.Getenv("TEST_REDIS_PASSWORD"),
+	})
+}
+
+// testTaskQueue checks the behavior every TaskQueue backend shares,
+// each case on a queue of its own
+func testTaskQueue(t *testing.T, broker Broker) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, taskQueue TaskQueue)
+	}{
+		{"PublishConsume", testPublishConsume},
+		{"PrefetchLimit", testPrefetchLimit},
+		{"AckReject", testAckReject},
+		{"PublishAt", testPublishAt},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			taskQueue, err := broker.OpenQueue(fmt.Sprintf("test-%s-%d", test.name, time.Now().UnixNano()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer taskQueue.StopConsuming()
+
+			test.test(t, taskQueue)
+		})
+	}
+}
+
+// consume starts consuming and returns the channel deliveries are passed on to
+func consume(t *testing.T, taskQueue TaskQueue, prefetchLimit int) chan Delivery {
+	deliveries := make(chan Delivery, 100)
+
+	if err := taskQueue.StartConsuming(prefetchLimit, testPollInterval); err != nil {
+		t.Fatalf("StartConsuming failed: %v", err)
+	}
+
+	taskQueue.AddConsumer("test", ConsumerFunc(func(delivery Delivery) {
+		deliveries <- delivery
+	}))
+
+	return deliveries
+}
+
+func receive(t *testing.T, deliveries chan Delivery) Delivery {
+	select {
+	case delivery := <-deliveries:
+		return delivery
+	case <-time.After(testTimeout):
+		t.Fatal("no delivery received")
+		return nil
+	}
+}
+
+// expectNone fails if a delivery is received within given duration
+func expectNone(t *testing.T, deliveries chan Delivery, duration time.Duration) {
+	select {
+	case delivery := <-deliveries:
+		t.Fatalf("unexpected delivery %q", delivery.Payload())
+	case <-time.After(duration):
+	}
+}
+
+// waitForStats polls Stats until check accepts them
+func waitForStats(t *testing.T, taskQueue TaskQueue, check func(stats Stats) bool) {
+	deadline := time.Now().Add(testTimeout)
+
+	for {
+		stats, err := taskQueue.Stats()
+		if err != nil {
+			t.Fatalf("Stats failed: %v", err)
+		}
+
+		if check(stats) {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+
+		time.Sleep(testPollInterval)
+	}
+}
+
+func publish(t *testing.T, taskQueue TaskQueue, payloads ...string) {
+	for _, payload := range payloads {
+		if err := taskQueue.Publish([]byte(payload)); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+}
+
+func testPublishConsume(t *testing.T, taskQueue TaskQueue) {
+	publish(t, taskQueue, "first", "second", "third")
+
+	deliveries := consume(t, taskQueue, 10)
+
+	for _, expected := range []string{"first", "second", "third"} {
+		delivery := receive(t, deliveries)
+		if delivery.Payload() != expected {
+			t.Fatalf("received %q, want %q", delivery.Payload(), expected)
+		}
+
+		if err := delivery.Ack(); err != nil {
+			t.Fatalf("Ack failed: %v", err)
+		}
+	}
+
+	waitForStats(t, taskQueue, func(stats Stats) bool {
+		return stats.Unacked == 0
+	})
+}
+
+func testPrefetchLimit(t *testing.T, taskQueue TaskQueue) {
+	publish(t, taskQueue, "1", "2", "3", "4", "5")
+
+	deliveries := consume(t, taskQueue, 2)
+
+	first := receive(t, deliveries)
+	receive(t, deliveries)
+	expectNone(t, deliveries, 10*testPollInterval)
+
+	// Acking frees a prefetch slot for the next task
+	if err := first.Ack(); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+
+	third := receive(t, deliveries)
+	if third.Payload() != "3" {
+		t.Fatalf("received %q after Ack, want %q", third.Payload(), "3")
+	}
+
+	expectNone(t, deliveries, 10*testPollInterval)
+}
+
+func testAckReject(t *testing.T, taskQueue TaskQueue) {
+	publish(t, taskQueue, "acked", "rejected")
+
+	deliveries := consume(t, taskQueue, 10)
+
+	acked := receive(t, deliveries)
+	rejected := receive(t, deliveries)
+
+	if err := acked.Ack(); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+
+	if err := rejected.Reject(); err != nil {
+		t.Fatalf("Reject failed: %v", err)
+	}
+
+	if err := acked.Ack(); err != ErrDeliveryClosed {
+		t.Errorf("second Ack returned %v, want ErrDeliveryClosed", err)
+	}
+
+	if err := acked.Reject(); err != ErrDeliveryClosed {
+		t.Errorf("Reject after Ack returned %v, want ErrDeliveryClosed", err)
+	}
+
+	if err := rejected.Ack(); err != ErrDeliveryClosed {
+		t.Errorf("Ack after Reject returned %v, want ErrDeliveryClosed", err)
+	}
+
+	waitForStats(t, taskQueue, func(stats Stats) bool {
+		return stats.Unacked == 0 && stats.Rejected == 1
+	})
+
+	expectNone(t, deliveries, 10*testPollInterval)
+}
+
+func testPublishAt(t *testing.T, taskQueue TaskQueue) {
+	delay := 500 * time.Millisecond
+	publishedAt := time.Now()
+
+	if err := taskQueue.PublishAt([]byte("later"), publishedAt.Add(delay)); err != nil {
+		t.Fatalf("PublishAt failed: %v", err)
+	}
+
+	publish(t, taskQueue, "now")
+
+	stats, err := taskQueue.Stats()
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+
+	if stats.Scheduled != 1 {
+		t.Errorf("Scheduled = %d, want 1", stats.Scheduled)
+	}
+
+	deliveries := consume(t, taskQueue, 10)
+
+	delivery := receive(t, deliveries)
+	if delivery.Payload() != "now" {
+		t.Fatalf("received %q first, want %q", delivery.Payload(), "now")
+	}
+
+	delivery.Ack()
+
+	delivery = receive(t, deliveries)
+	if delivery.Payload() != "later" {
+		t.Fatalf("received %q, want %q", delivery.Payload(), "later")
+	}
+
+	if receivedAfter := time.Since(publishedAt); receivedAfter < delay {
+		t.Errorf("scheduled task received after %s, before it was due", receivedAfter)
+	}
+
+	delivery.Ack()
+
+	waitForStats(t, taskQueue, func(stats Stats) bool {
+		return stats.Scheduled == 0 && stats.Unacked == 0
+	})
+}
+
+// TestStreamQueueDeletesAcked checks that the task stream holds
+// only unread and pending entries, however many were published
+func TestStreamQueueDeletesAcked(t *testing.T) {
+	client := testRedisClient(t)
+	defer client.Close()
+
+	broker := NewStreamBroker("test", client)
+	broker.MaxLength = 1
+
+	taskQueue, err := broker.OpenQueue(fmt.Sprintf("test-%s-%d", t.Name(), time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer taskQueue.StopConsuming()
+
+	streamKey := StreamKey(taskQueue.Name())
+	defer client.Del(streamKey, StreamKey(taskQueue.Name()+"::rejected"))
+
+	publish(t, taskQueue, "acked", "rejected", "pending")
+
+	if length := replyInt(broker.do("XLEN", streamKey).Val()); length != 3 {
+		t.Fatalf("stream holds %d entries after publishing, want 3", length)
+	}
+
+	deliveries := consume(t, taskQueue, 10)
+
+	receive(t, deliveries).Ack()
+	receive(t, deliveries).Reject()
+	receive(t, deliveries)
+
+	if length := replyInt(broker.do("XLEN", streamKey).Val()); length != 1 {
+		t.Errorf("stream holds %d entries after Ack and Reject, want the pending one", length)
+	}
+}
+
+// testRestart checks that StopConsuming ends the consumer goroutines
+// and that the queue consumes again after StartConsuming
+func testRestart(t *testing.T, broker Broker) {
+	t.Run("Restart", func(t *testing.T) {
+		taskQueue, err := broker.OpenQueue(fmt.Sprintf("test-Restart-%d", time.Now().UnixNano()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		goroutines := runtime.NumGoroutine()
+
+		deliveries := consume(t, taskQueue, 10)
+		publish(t, taskQueue, "first")
+		receive(t, deliveries).Ack()
+
+		taskQueue.StopConsuming()
+
+		deadline := time.Now().Add(testTimeout)
+		for runtime.NumGoroutine() > goroutines {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d goroutines left after StopConsuming, want %d", runtime.NumGoroutine(), goroutines)
+			}
+
+			time.Sleep(testPollInterval)
+		}
+
+		deliveries = consume(t, taskQueue, 10)
+		defer taskQueue.StopConsuming()
+
+		publish(t, taskQueue, "second")
+
+		if delivery := receive(t, deliveries); delivery.Payload() != "second" {
+			t.Errorf("received %q after restart, want %q", delivery.Payload(), "second")
+		}
+	})
+}
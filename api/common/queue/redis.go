@@ -0,0 +1,142 @@
+package queue
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/adjust/rmq"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// RedisBroker opens TaskQueues stored in Redis by rmq
+type RedisBroker struct {
+	connection rmq.Connection
+	client     *redis.Client
+}
+
+// NewRedisBroker opens an rmq connection with given tag on the redis client
+func NewRedisBroker(tag string, redisClient *redis.Client) *RedisBroker {
+	return &RedisBroker{
+		connection: rmq.OpenConnectionWithRedisClient(tag, redisClient),
+		client:     redisClient,
+	}
+}
+
+// OpenQueue returns the rmq queue of given name
+func (b *RedisBroker) OpenQueue(name string) (TaskQueue, error) {
+	return &redisQueue{
+		name:       name,
+		queue:      b.connection.OpenQueue(name),
+		connection: b.connection,
+		schedule:   newRedisSchedule(name, b.client),
+	}, nil
+}
+
+// Close does nothing, rmq connections live as long as the process
+// and dead ones are removed by the queue cleaner
+func (b *RedisBroker) Close() error {
+	return nil
+}
+
+type redisQueue struct {
+	name       string
+	queue      rmq.Queue
+	connection rmq.Connection
+	schedule   *redisSchedule
+
+	mutex    sync.Mutex
+	stopping chan struct{}
+}
+
+func (q *redisQueue) Name() string {
+	return q.name
+}
+
+func (q *redisQueue) Publish(payload []byte) error {
+	if !q.queue.PublishBytes(payload) {
+		return errors.New("failed to publish to redis queue " + q.name)
+	}
+
+	return nil
+}
+
+// PublishAt keeps the payload in the schedule sorted set until it is due
+func (q *redisQueue) PublishAt(payload []byte, notBefore time.Time) error {
+	return q.schedule.add(payload, notBefore)
+}
+
+func (q *redisQueue) StartConsuming(prefetchLimit int, pollInterval time.Duration) error {
+	if !q.queue.StartConsuming(prefetchLimit, pollInterval) {
+		return errors.New("redis queue " + q.name + " is already consuming")
+	}
+
+	q.mutex.Lock()
+	q.stopping = make(chan struct{})
+	go releaseScheduled(q.schedule, q.Publish, pollInterval, q.stopping)
+	q.mutex.Unlock()
+
+	return nil
+}
+
+func (q *redisQueue) StopConsuming() {
+	q.queue.StopConsuming()
+
+	q.mutex.Lock()
+	if q.stopping != nil {
+		close(q.stopping)
+		q.stopping = nil
+	}
+	q.mutex.Unlock()
+}
+
+func (q *redisQueue) AddConsumer(name string, consumer Consumer) {
+	q.queue.AddConsumer(name, &redisConsumer{consumer: consumer})
+}
+
+func (q *redisQueue) Stats() (Stats, error) {
+	queueStat := q.connection.CollectStats([]string{q.name}).QueueStats[q.name]
+	scheduled, err := q.schedule.count()
+
+	return Stats{
+		Ready:     queueStat.ReadyCount,
+		Scheduled: scheduled,
+		Unacked:   queueStat.UnackedCount(),
+		Rejected:  queueStat.RejectedCount,
+		Consumers: queueStat.ConsumerCount(),
+	}, err
+}
+
+// redisConsumer adapts a Consumer to rmq
+type redisConsumer struct {
+	consumer Consumer
+}
+
+func (c *redisConsumer) Consume(delivery rmq.Delivery) {
+	c.consumer.Consume(&redisDelivery{delivery: delivery})
+}
+
+type redisDelivery struct {
+	delivery rmq.Delivery
+}
+
+func (d *redisDelivery) Payload() string {
+	return d.delivery.Payload()
+}
+
+func (d *redisDelivery) Ack() error {
+	if !d.delivery.Ack() {
+		return ErrDeliveryClosed
+	}
+
+	return nil
+}
+
+func (d *redisDelivery) Reject() error {
+	if !d.delivery.Reject() {
+		return ErrDeliveryClosed
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// scheduleReleaseBatch is how many due tasks are moved at once
+const scheduleReleaseBatch = 100
+
+// redisSchedule keeps tasks of a queue in a Redis sorted set,
+// scored by their not-before time, until they are due
+type redisSchedule struct {
+	client *redis.Client
+	key    string
+}
+
+// ScheduleKey returns the redis key of the sorted set holding scheduled tasks of given queue
+func ScheduleKey(name string) string {
+	return fmt.Sprintf("schedule::%s", name)
+}
+
+func newRedisSchedule(name string, redisClient *redis.Client) *redisSchedule {
+	return &redisSchedule{
+		client: redisClient,
+		key:    ScheduleKey(name),
+	}
+}
+
+// add stores a payload until given time.
+// Members get a random prefix, so equal payloads are kept apart.
+func (s *redisSchedule) add(payload []byte, notBefore time.Time) error {
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+
+	return s.client.ZAdd(s.key, redis.Z{
+		Score:  scheduleScore(notBefore),
+		Member: hex.EncodeToString(prefix) + ":" + string(payload),
+	}).Err()
+}
+
+// scheduleScore returns the Unix time in seconds with a fraction,
+// so tasks aren't released up to a second before they are due
+func scheduleScore(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// release hands due payloads to publish and returns how many were released.
+// Only the process removing a member publishes it, so several consumers
+// can release the same schedule, and a payload failing to publish is put back.
+func (s *redisSchedule) release(now time.Time, publish func([]byte) error) (int, error) {
+	released := 0
+
+	for {
+		members, err := s.client.ZRangeByScoreWithScores(s.key, redis.ZRangeByScore{
+			Min:   "-inf",
+			Max:   strconv.FormatFloat(scheduleScore(now), 'f', -1, 64),
+			Count: scheduleReleaseBatch,
+		}).Result()
+		if err != nil || len(members) == 0 {
+			return released, err
+		}
+
+		for _, member := range members {
+			value, _ := member.Member.(string)
+
+			removed, err := s.client.ZRem(s.key, value).Result()
+			if err != nil {
+				return released, err
+			}
+
+			if removed == 0 {
+				continue
+			}
+
+			payload := value
+			if index := strings.Index(value, ":"); index >= 0 {
+				payload = value[index+1:]
+			}
+
+			if err = publish([]byte(payload)); err != nil {
+				s.client.ZAdd(s.key, member)
+				return released, err
+			}
+
+			released++
+		}
+	}
+}
+
+// count returns how many tasks are waiting for their time
+func (s *redisSchedule) count() (int, error) {
+	count, err := s.client.ZCard(s.key).Result()
+	return int(count), err
+}
+
+// releaseScheduled moves due tasks of a schedule to the ready queue
+// every poll interval until stopping is closed
+func releaseScheduled(schedule *redisSchedule, publish func([]byte) error, pollInterval time.Duration, stopping chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopping:
+			return
+		case <-ticker.C:
+			schedule.release(time.Now(), publish)
+		}
+	}
+}
@@ -0,0 +1,489 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// DefaultStreamMaxLength is roughly how many entries the rejected stream of a queue keeps.
+// Task streams are never trimmed, since trimming drops unread and pending entries as well;
+// entries are deleted once acked instead.
+const DefaultStreamMaxLength = 100000
+
+// streamPayloadField is the entry field holding the task payload
+const streamPayloadField = "payload"
+
+// StreamBroker opens TaskQueues stored in Redis Streams, consumed
+// through a consumer group. Deliveries left pending by a dead consumer
+// are claimed with XAUTOCLAIM once idle for UnackedTimeout,
+// so it needs Redis 6.2 or newer.
+type StreamBroker struct {
+	client *redis.Client
+	group  string
+
+	// consumer names this process in the consumer groups
+	consumer string
+
+	UnackedTimeout time.Duration
+	MaxLength      int64
+	ErrorLog       ErrorLogger
+}
+
+// NewStreamBroker returns a StreamBroker reading as consumer group of given name
+func NewStreamBroker(group string, redisClient *redis.Client) *StreamBroker {
+	hostname, _ := os.Hostname()
+
+	return &StreamBroker{
+		client:         redisClient,
+		group:          group,
+		consumer:       fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		UnackedTimeout: DefaultUnackedTimeout,
+		MaxLength:      DefaultStreamMaxLength,
+		ErrorLog:       log.Printf,
+	}
+}
+
+// OpenQueue returns the stream queue of given name
+func (b *StreamBroker) OpenQueue(name string) (TaskQueue, error) {
+	return &StreamQueue{
+		name:     name,
+		broker:   b,
+		schedule: newRedisSchedule(StreamKey(name), b.client),
+	}, nil
+}
+
+// Close does nothing, the redis client is owned by the caller
+func (b *StreamBroker) Close() error {
+	return nil
+}
+
+// StreamKey returns the redis key of the stream of given queue
+func StreamKey(name string) string {
+	return fmt.Sprintf("stream::%s", name)
+}
+
+// StreamQueue is a TaskQueue stored in a Redis Stream
+type StreamQueue struct {
+	name     string
+	broker   *StreamBroker
+	schedule *redisSchedule
+
+	mutex         sync.Mutex
+	unacked       int
+	consumers     int
+	prefetchLimit int
+	deliveries    chan Delivery
+	stopping      chan struct{}
+}
+
+// PendingEntry represents a delivered but unacked stream entry
+type PendingEntry struct {
+	ID            string        `json:"id"`
+	Consumer      string        `json:"consumer"`
+	Idle          time.Duration `json:"idle"`
+	DeliveryCount int           `json:"delivery_count"`
+}
+
+// Name returns the queue name
+func (q *StreamQueue) Name() string {
+	return q.name
+}
+
+// Publish appends the payload to the stream
+func (q *StreamQueue) Publish(payload []byte) error {
+	return q.broker.do("XADD", StreamKey(q.name), "*", streamPayloadField, string(payload)).Err()
+}
+
+// PublishAt keeps the payload in the schedule sorted set until it is due
+func (q *StreamQueue) PublishAt(payload []byte, notBefore time.Time) error {
+	return q.schedule.add(payload, notBefore)
+}
+
+// StartConsuming creates the consumer group if needed
+// and starts reading new and stuck entries
+func (q *StreamQueue) StartConsuming(prefetchLimit int, pollInterval time.Duration) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.deliveries != nil {
+		return errors.New("stream queue " + q.name + " is already consuming")
+	}
+
+	if err := q.createGroup(); err != nil {
+		return err
+	}
+
+	// Claiming entries idle for longer than possible claims none,
+	// but fails on Redis versions without XAUTOCLAIM
+	err := q.broker.do(
+		"XAUTOCLAIM", StreamKey(q.name), q.broker.group, q.broker.consumer, int64(math.MaxInt64), "0-0", "COUNT", 1,
+	).Err()
+	if err != nil {
+		return fmt.Errorf("stream queue %s can't claim stuck entries, Redis 6.2 or newer is needed: %s", q.name, err.Error())
+	}
+
+	q.prefetchLimit = prefetchLimit
+	q.deliveries = make(chan Delivery, prefetchLimit)
+	q.stopping = make(chan struct{})
+
+	go q.poll(pollInterval, q.stopping, q.deliveries)
+	go releaseScheduled(q.schedule, q.Publish, pollInterval, q.stopping)
+
+	return nil
+}
+
+// StopConsuming stops reading entries. The poll goroutine closes the deliveries
+// channel after its last fetch, so consumers return once they handled what is in it.
+func (q *StreamQueue) StopConsuming() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.stopping != nil {
+		close(q.stopping)
+		q.stopping = nil
+		q.deliveries = nil
+	}
+}
+
+// AddConsumer registers a consumer running in its own goroutine
+func (q *StreamQueue) AddConsumer(name string, consumer Consumer) {
+	q.mutex.Lock()
+	deliveries := q.deliveries
+	q.consumers++
+	q.mutex.Unlock()
+
+	go func() {
+		for delivery := range deliveries {
+			consumer.Consume(delivery)
+		}
+	}()
+}
+
+// Stats returns entry counts of the stream.
+// Ready is the group lag, which Redis reports from 7.0 on, and -1 before.
+func (q *StreamQueue) Stats() (Stats, error) {
+	stats := Stats{Ready: -1}
+
+	groups, err := q.broker.do("XINFO", "GROUPS", StreamKey(q.name)).Result()
+	if err != nil && err != redis.Nil {
+		return stats, err
+	}
+
+	for _, group := range replySlice(groups) {
+		fields := replyMap(group)
+		if replyString(fields["name"]) != q.broker.group {
+			continue
+		}
+
+		stats.Unacked = int(replyInt(fields["pending"]))
+
+		if lag, ok := fields["lag"]; ok && lag != nil {
+			stats.Ready = int(replyInt(lag))
+		}
+	}
+
+	rejected, err := q.broker.do("XLEN", StreamKey(q.rejectedName())).Result()
+	if err != nil && err != redis.Nil {
+		return stats, err
+	}
+
+	stats.Rejected = int(replyInt(rejected))
+
+	if stats.Scheduled, err = q.schedule.count(); err != nil {
+		return stats, err
+	}
+
+	q.mutex.Lock()
+	stats.Consumers = q.consumers
+	q.mutex.Unlock()
+
+	return stats, nil
+}
+
+// Pending lists up to count delivered but unacked entries with their delivery counts
+func (q *StreamQueue) Pending(count int) ([]PendingEntry, error) {
+	var entries []PendingEntry
+
+	reply, err := q.broker.do("XPENDING", StreamKey(q.name), q.broker.group, "-", "+", count).Result()
+	if err == redis.Nil {
+		return entries, nil
+	} else if err != nil {
+		return entries, err
+	}
+
+	for _, entry := range replySlice(reply) {
+		fields := replySlice(entry)
+		if len(fields) < 4 {
+			continue
+		}
+
+		entries = append(entries, PendingEntry{
+			ID:            replyString(fields[0]),
+			Consumer:      replyString(fields[1]),
+			Idle:          time.Duration(replyInt(fields[2])) * time.Millisecond,
+			DeliveryCount: int(replyInt(fields[3])),
+		})
+	}
+
+	return entries, nil
+}
+
+// Rewind moves the consumer group back to given entry ID,
+// so entries after it are delivered again. Acked entries are deleted, so they aren't.
+func (q *StreamQueue) Rewind(id string) error {
+	if err := q.createGroup(); err != nil {
+		return err
+	}
+
+	return q.broker.do("XGROUP", "SETID", StreamKey(q.name), q.broker.group, id).Err()
+}
+
+func (q *StreamQueue) rejectedName() string {
+	return q.name + "::rejected"
+}
+
+func (q *StreamQueue) createGroup() error {
+	err := q.broker.do("XGROUP", "CREATE", StreamKey(q.name), q.broker.group, "0", "MKSTREAM").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+
+	return nil
+}
+
+// poll fetches into deliveries until stopping is closed, then closes deliveries
+func (q *StreamQueue) poll(pollInterval time.Duration, stopping chan struct{}, deliveries chan Delivery) {
+	defer close(deliveries)
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopping:
+			return
+		case <-ticker.C:
+			q.fetch(deliveries)
+		}
+	}
+}
+
+// fetch claims entries stuck with dead consumers first,
+// then reads new entries up to the prefetch limit
+func (q *StreamQueue) fetch(deliveries chan Delivery) {
+	limit := q.freeSlots()
+	if limit <= 0 {
+		return
+	}
+
+	reply, err := q.broker.do(
+		"XAUTOCLAIM", StreamKey(q.name), q.broker.group, q.broker.consumer,
+		int64(q.broker.UnackedTimeout/time.Millisecond), "0-0", "COUNT", limit,
+	).Result()
+	if err != nil {
+		q.broker.ErrorLog("Failed to claim stuck entries of stream queue %s: %s", q.name, err.Error())
+	} else if claimReply := replySlice(reply); len(claimReply) > 1 {
+		q.deliver(claimReply[1], true, deliveries)
+	}
+
+	limit = q.freeSlots()
+	if limit <= 0 {
+		return
+	}
+
+	reply, err = q.broker.do(
+		"XREADGROUP", "GROUP", q.broker.group, q.broker.consumer, "COUNT", limit, "STREAMS", StreamKey(q.name), ">",
+	).Result()
+	if err == redis.Nil {
+		return
+	} else if err != nil {
+		q.broker.ErrorLog("Failed to read entries of stream queue %s: %s", q.name, err.Error())
+		return
+	}
+
+	for _, stream := range replySlice(reply) {
+		if streamReply := replySlice(stream); len(streamReply) > 1 {
+			q.deliver(streamReply[1], false, deliveries)
+		}
+	}
+}
+
+func (q *StreamQueue) freeSlots() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.prefetchLimit - q.unacked
+}
+
+// deliver hands stream entries to consumers. Entries deleted while pending,
+// e.g. by an XTRIM run by hand, can't be delivered, so they are logged and acked.
+func (q *StreamQueue) deliver(entries interface{}, isClaimed bool, deliveries chan Delivery) {
+	for _, entry := range replySlice(entries) {
+		fields := replySlice(entry)
+		if len(fields) < 2 || fields[1] == nil {
+			if len(fields) > 0 {
+				id := replyString(fields[0])
+
+				q.broker.ErrorLog("Entry %s of stream queue %s was deleted while pending, its task is lost", id, q.name)
+				q.broker.do("XACK", StreamKey(q.name), q.broker.group, id)
+			}
+
+			continue
+		}
+
+		delivery := &streamDelivery{
+			queue:   q,
+			id:      replyString(fields[0]),
+			payload: replyString(replyMap(fields[1])[streamPayloadField]),
+		}
+
+		if isClaimed {
+			delivery.deliveryCount = q.deliveryCount(delivery.id)
+		} else {
+			delivery.deliveryCount = 1
+		}
+
+		q.mutex.Lock()
+		q.unacked++
+		q.mutex.Unlock()
+
+		deliveries <- delivery
+	}
+}
+
+func (q *StreamQueue) deliveryCount(id string) int {
+	reply, err := q.broker.do("XPENDING", StreamKey(q.name), q.broker.group, id, id, 1).Result()
+	if err != nil {
+		return 0
+	}
+
+	for _, entry := range replySlice(reply) {
+		if fields := replySlice(entry); len(fields) >= 4 {
+			return int(replyInt(fields[3]))
+		}
+	}
+
+	return 0
+}
+
+func (b *StreamBroker) do(args ...interface{}) *redis.Cmd {
+	cmd := redis.NewCmd(args...)
+	b.client.Process(cmd)
+
+	return cmd
+}
+
+type streamDelivery struct {
+	queue         *StreamQueue
+	id            string
+	payload       string
+	deliveryCount int
+	isClosed      bool
+}
+
+func (d *streamDelivery) Payload() string {
+	return d.payload
+}
+
+// DeliveryCount returns how many times the entry was delivered
+func (d *streamDelivery) DeliveryCount() int {
+	return d.deliveryCount
+}
+
+// Ack acks the entry and deletes it from the stream
+func (d *streamDelivery) Ack() error {
+	return d.close(false)
+}
+
+// Reject copies the entry to the rejected stream of the queue and acks it
+func (d *streamDelivery) Reject() error {
+	return d.close(true)
+}
+
+func (d *streamDelivery) close(isRejected bool) error {
+	d.queue.mutex.Lock()
+	if d.isClosed {
+		d.queue.mutex.Unlock()
+		return ErrDeliveryClosed
+	}
+
+	d.isClosed = true
+	d.queue.unacked--
+	d.queue.mutex.Unlock()
+
+	broker := d.queue.broker
+
+	if isRejected {
+		err := broker.do(
+			"XADD", StreamKey(d.queue.rejectedName()), "MAXLEN", "~", broker.MaxLength, "*", streamPayloadField, d.payload,
+		).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	acked, err := broker.do("XACK", StreamKey(d.queue.name), broker.group, d.id).Result()
+	if err != nil {
+		return err
+	}
+
+	if replyInt(acked) == 0 {
+		return ErrDeliveryClosed
+	}
+
+	// Acked entries are deleted rather than trimmed, so the stream only holds
+	// unread and pending ones
+	return broker.do("XDEL", StreamKey(d.queue.name), d.id).Err()
+}
+
+// replySlice converts a redis array reply, nil stays an empty slice
+func replySlice(reply interface{}) []interface{} {
+	values, _ := reply.([]interface{})
+	return values
+}
+
+// replyMap converts a flat field-value array reply to a map
+func replyMap(reply interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+	values := replySlice(reply)
+
+	for index := 0; index+1 < len(values); index += 2 {
+		fields[replyString(values[index])] = values[index+1]
+	}
+
+	return fields
+}
+
+func replyString(reply interface{}) string {
+	switch value := reply.(type) {
+	case string:
+		return value
+	case []byte:
+		return string(value)
+	case int64:
+		return fmt.Sprintf("%d", value)
+	default:
+		return ""
+	}
+}
+
+func replyInt(reply interface{}) int64 {
+	switch value := reply.(type) {
+	case int64:
+		return value
+	case string:
+		var number int64
+		fmt.Sscanf(value, "%d", &number)
+		return number
+	default:
+		return 0
+	}
+}
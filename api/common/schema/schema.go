@@ -0,0 +1,201 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+	"github.com/n1207n/video-transcode-queue/api/common/queue"
+)
+
+// Schema versions of task payloads.
+// Version 1 is the bare task object published before envelopes existed.
+const (
+	VersionLegacy = 1
+	Version       = 2
+)
+
+// TypeTranscode is the task type of a TranscodeTask
+const TypeTranscode = "transcode"
+
+// ErrUnsupportedVersion is returned for payloads of a newer schema than this build knows
+var ErrUnsupportedVersion = errors.New("unsupported task schema version")
+
+// Envelope wraps a task payload with its schema version and task type
+type Envelope struct {
+	Version int             `json:"version"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// TranscodeTask represents a task to transcode an uploaded video file
+type TranscodeTask struct {
+	VideoID   string    `json:"video_id"`
+	FilePath  string    `json:"file_path"`
+	Timestamp time.Time `json:"timestamp"`
+
+	EncodingLadder string                  `json:"encoding_ladder,omitempty"`
+	Renditions     entity.EncodingProfiles `json:"renditions,omitempty"`
+
+	// Priority picks the lane the task is queued in, empty is normal
+	Priority string `json:"priority,omitempty"`
+
+	// IdempotencyKey stays the same across retries of the task,
+	// the transcoder creates one job per key
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// Attempts counts failed transcode requests of the task,
+	// LastError is the reason of the last failure
+	Attempts  int    `json:"attempts,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// legacyTranscodeTask is the version 1 task, encoded with Go field names
+type legacyTranscodeTask struct {
+	ID        string
+	FilePath  string
+	Timestamp time.Time
+
+	EncodingLadder string
+	Renditions     entity.EncodingProfiles
+
+	Priority       string
+	IdempotencyKey string
+
+	Attempts  int
+	LastError string
+}
+
+// TranscodeRequest represents a JSON POST data for video-transcode API
+type TranscodeRequest struct {
+	Path    string `json:"path" binding:"required"`
+	VideoID string `json:"video_id" binding:"required"`
+
+	EncodingLadder string                  `json:"encoding_ladder,omitempty"`
+	Renditions     entity.EncodingProfiles `json:"renditions,omitempty"`
+	IdempotencyKey string                  `json:"idempotency_key,omitempty"`
+}
+
+// Validate returns an error if the task misses fields a transcoder needs
+func (t TranscodeTask) Validate() error {
+	if _, err := strconv.Atoi(t.VideoID); err != nil {
+		return fmt.Errorf("invalid video_id %q", t.VideoID)
+	}
+
+	if len(t.FilePath) == 0 {
+		return errors.New("no file_path")
+	}
+
+	if _, err := queue.ParsePriority(t.Priority); err != nil {
+		return err
+	}
+
+	if t.Attempts < 0 {
+		return fmt.Errorf("invalid attempts %d", t.Attempts)
+	}
+
+	return nil
+}
+
+// TranscodeRequest returns the transcode API request of the task
+func (t TranscodeTask) TranscodeRequest() TranscodeRequest {
+	return TranscodeRequest{
+		Path:           t.FilePath,
+		VideoID:        t.VideoID,
+		EncodingLadder: t.EncodingLadder,
+		Renditions:     t.Renditions,
+		IdempotencyKey: t.IdempotencyKey,
+	}
+}
+
+// EncodeTranscodeTask validates a task and encodes it in given schema version,
+// so producers can keep publishing the legacy payload until every consumer reads envelopes
+func EncodeTranscodeTask(task TranscodeTask, version int) ([]byte, error) {
+	if err := task.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch version {
+	case VersionLegacy:
+		return json.Marshal(legacyTranscodeTask{
+			ID:             task.VideoID,
+			FilePath:       task.FilePath,
+			Timestamp:      task.Timestamp,
+			EncodingLadder: task.EncodingLadder,
+			Renditions:     task.Renditions,
+			Priority:       task.Priority,
+			IdempotencyKey: task.IdempotencyKey,
+			Attempts:       task.Attempts,
+			LastError:      task.LastError,
+		})
+	case Version:
+		payload, err := json.Marshal(task)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(Envelope{
+			Version: Version,
+			Type:    TypeTranscode,
+			Payload: payload,
+		})
+	default:
+		return nil, ErrUnsupportedVersion
+	}
+}
+
+// DecodeTranscodeTask reads a task of any known schema version,
+// returning the version it was encoded in along with the validated task
+func DecodeTranscodeTask(data []byte) (TranscodeTask, int, error) {
+	var task TranscodeTask
+	var fields map[string]json.RawMessage
+
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return task, 0, err
+	}
+
+	// Legacy tasks are bare objects without a version field
+	if _, ok := fields["version"]; !ok {
+		var legacyTask legacyTranscodeTask
+
+		if err := json.Unmarshal(data, &legacyTask); err != nil {
+			return task, VersionLegacy, err
+		}
+
+		task = TranscodeTask{
+			VideoID:        legacyTask.ID,
+			FilePath:       legacyTask.FilePath,
+			Timestamp:      legacyTask.Timestamp,
+			EncodingLadder: legacyTask.EncodingLadder,
+			Renditions:     legacyTask.Renditions,
+			Priority:       legacyTask.Priority,
+			IdempotencyKey: legacyTask.IdempotencyKey,
+			Attempts:       legacyTask.Attempts,
+			LastError:      legacyTask.LastError,
+		}
+
+		return task, VersionLegacy, task.Validate()
+	}
+
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return task, 0, err
+	}
+
+	if envelope.Version != Version {
+		return task, envelope.Version, fmt.Errorf("%s: %d", ErrUnsupportedVersion, envelope.Version)
+	}
+
+	if envelope.Type != TypeTranscode {
+		return task, envelope.Version, fmt.Errorf("unknown task type %q", envelope.Type)
+	}
+
+	if err := json.Unmarshal(envelope.Payload, &task); err != nil {
+		return task, envelope.Version, err
+	}
+
+	return task, envelope.Version, task.Validate()
+}
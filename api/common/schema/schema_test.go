@@ -0,0 +1,155 @@
+package schema
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+)
+
+var testTimestamp = time.Date(2018, 3, 4, 5, 6, 7, 0, time.UTC)
+
+func TestDecodeTranscodeTask(t *testing.T) {
+	tests := []struct {
+		name            string
+		payload         string
+		expectedTask    TranscodeTask
+		expectedVersion int
+		expectedError   string
+	}{
+		{
+			name:            "legacy unversioned",
+			payload:         `{"ID":"12","FilePath":"12/source.mp4","Timestamp":"2018-03-04T05:06:07Z","Priority":"high","Attempts":2,"LastError":"busy"}`,
+			expectedTask:    TranscodeTask{VideoID: "12", FilePath: "12/source.mp4", Timestamp: testTimestamp, Priority: "high", Attempts: 2, LastError: "busy"},
+			expectedVersion: VersionLegacy,
+		},
+		{
+			name:            "legacy without optional fields",
+			payload:         `{"ID":"12","FilePath":"12/source.mp4","Timestamp":"2018-03-04T05:06:07Z"}`,
+			expectedTask:    TranscodeTask{VideoID: "12", FilePath: "12/source.mp4", Timestamp: testTimestamp},
+			expectedVersion: VersionLegacy,
+		},
+		{
+			name:            "versioned envelope",
+			payload:         `{"version":2,"type":"transcode","payload":{"video_id":"12","file_path":"12/source.mp4","timestamp":"2018-03-04T05:06:07Z","encoding_ladder":"mobile","idempotency_key":"abc"}}`,
+			expectedTask:    TranscodeTask{VideoID: "12", FilePath: "12/source.mp4", Timestamp: testTimestamp, EncodingLadder: "mobile", IdempotencyKey: "abc"},
+			expectedVersion: Version,
+		},
+		{
+			name:            "unknown future version",
+			payload:         `{"version":3,"type":"transcode","payload":{"video_id":"12","file_path":"12/source.mp4"}}`,
+			expectedVersion: 3,
+			expectedError:   ErrUnsupportedVersion.Error(),
+		},
+		{
+			name:            "unknown task type",
+			payload:         `{"version":2,"type":"thumbnail","payload":{"video_id":"12","file_path":"12/source.mp4"}}`,
+			expectedVersion: Version,
+			expectedError:   "unknown task type",
+		},
+		{
+			name:            "legacy missing file path",
+			payload:         `{"ID":"12"}`,
+			expectedTask:    TranscodeTask{VideoID: "12"},
+			expectedVersion: VersionLegacy,
+			expectedError:   "no file_path",
+		},
+		{
+			name:            "versioned invalid video id",
+			payload:         `{"version":2,"type":"transcode","payload":{"video_id":"twelve","file_path":"12/source.mp4"}}`,
+			expectedTask:    TranscodeTask{VideoID: "twelve", FilePath: "12/source.mp4"},
+			expectedVersion: Version,
+			expectedError:   "invalid video_id",
+		},
+		{
+			name:          "garbage",
+			payload:       `not a task`,
+			expectedError: "invalid character",
+		},
+		{
+			name:          "JSON array",
+			payload:       `["12","12/source.mp4"]`,
+			expectedError: "cannot unmarshal array",
+		},
+		{
+			name:            "malformed envelope payload",
+			payload:         `{"version":2,"type":"transcode","payload":"12/source.mp4"}`,
+			expectedVersion: Version,
+			expectedError:   "cannot unmarshal string",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			task, version, err := DecodeTranscodeTask([]byte(test.payload))
+
+			if len(test.expectedError) == 0 && err != nil {
+				t.Fatalf("DecodeTranscodeTask failed: %v", err)
+			}
+
+			if len(test.expectedError) != 0 && (err == nil || !strings.Contains(err.Error(), test.expectedError)) {
+				t.Fatalf("DecodeTranscodeTask returned error %v, want one containing %q", err, test.expectedError)
+			}
+
+			if version != test.expectedVersion {
+				t.Errorf("version = %d, want %d", version, test.expectedVersion)
+			}
+
+			if len(test.expectedError) == 0 && !reflect.DeepEqual(task, test.expectedTask) {
+				t.Errorf("unexpected task:\n got: %+v\nwant: %+v", task, test.expectedTask)
+			}
+		})
+	}
+}
+
+func TestTranscodeTaskRoundTrip(t *testing.T) {
+	task := TranscodeTask{
+		VideoID:        "12",
+		FilePath:       "12/source.mp4",
+		Timestamp:      testTimestamp,
+		EncodingLadder: "mobile",
+		Renditions: entity.EncodingProfiles{
+			{Name: "720p", Height: 720, VideoBitrateKbps: 2400},
+		},
+		Priority:       "low",
+		IdempotencyKey: "abc",
+		Attempts:       1,
+		LastError:      "transcoder busy",
+	}
+
+	for _, version := range []int{VersionLegacy, Version} {
+		payload, err := EncodeTranscodeTask(task, version)
+		if err != nil {
+			t.Fatalf("EncodeTranscodeTask of version %d failed: %v", version, err)
+		}
+
+		decodedTask, decodedVersion, err := DecodeTranscodeTask(payload)
+		if err != nil {
+			t.Fatalf("DecodeTranscodeTask of version %d failed: %v", version, err)
+		}
+
+		if decodedVersion != version {
+			t.Errorf("decoded version %d, want %d", decodedVersion, version)
+		}
+
+		if !reflect.DeepEqual(decodedTask, task) {
+			t.Errorf("version %d round trip changed the task:\n got: %+v\nwant: %+v", version, decodedTask, task)
+		}
+	}
+}
+
+func TestEncodeTranscodeTaskRejects(t *testing.T) {
+	task := TranscodeTask{VideoID: "12", FilePath: "12/source.mp4"}
+
+	if _, err := EncodeTranscodeTask(task, Version+1); err != ErrUnsupportedVersion {
+		t.Errorf("encoding an unknown version returned %v, want ErrUnsupportedVersion", err)
+	}
+
+	task.Priority = "urgent"
+
+	if _, err := EncodeTranscodeTask(task, Version); err == nil {
+		t.Error("encoding a task of unknown priority succeeded")
+	}
+}
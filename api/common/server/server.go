@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultShutdownTimeout is how long in-flight requests may take
+// to finish once a shutdown signal arrives,
+// it stays below the 30 seconds grace period of Kubernetes
+const DefaultShutdownTimeout = 25 * time.Second
+
+// RunGracefully serves HTTP until SIGTERM or SIGINT is received,
+// then stops accepting connections and waits for in-flight requests
+// up to given timeout before returning.
+// onShutdown is called first so long-lived handlers can end, it may be nil.
+func RunGracefully(httpServer *http.Server, timeout time.Duration, onShutdown func(), logger *zap.SugaredLogger) error {
+	serverErrors := make(chan error, 1)
+
+	go func() {
+		logger.Infof("Listening and serving HTTP on %s", httpServer.Addr)
+		serverErrors <- httpServer.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-serverErrors:
+		return err
+	case receivedSignal := <-signals:
+		logger.Infof("Received %s, shutting down HTTP server", receivedSignal)
+	}
+
+	if onShutdown != nil {
+		onShutdown()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		logger.Warnf("HTTP server did not shut down cleanly: %s", err.Error())
+		return err
+	}
+
+	logger.Info("HTTP server shut down")
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LocalStorage keeps objects as files under a root folder,
+// shared by services through a mounted volume
+type LocalStorage struct {
+	root    string
+	baseURL string
+}
+
+// NewLocalStorage returns a LocalStorage of given root folder,
+// whose files are served under baseURL
+func NewLocalStorage(root string, baseURL string) *LocalStorage {
+	return &LocalStorage{root: root, baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Root returns the folder keys are relative to
+func (s *LocalStorage) Root() string {
+	return s.root
+}
+
+// Path returns the file path of a key
+func (s *LocalStorage) Path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+// Put writes to a temporary file renamed to the key once complete,
+// so readers never see a partial object
+func (s *LocalStorage) Put(key string, reader io.Reader, size int64, contentType string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+
+	path := s.Path(key)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), ".put-")
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(file, reader); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	os.Chmod(file.Name(), 0644)
+
+	return os.Rename(file.Name(), path)
+}
+
+// PutFile moves a local file to the key, replacing a file already there
+func (s *LocalStorage) PutFile(key string, path string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+
+	targetPath := s.Path(key)
+	if err := os.MkdirAll(filepath.Dir(targetPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path, targetPath); err == nil {
+		return nil
+	}
+
+	// Renaming fails across filesystems, then the file is copied
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if err = s.Put(key, file, -1, ContentType(key)); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func (s *LocalStorage) Get(key string) (io.ReadCloser, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(s.Path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+
+	return file, err
+}
+
+func (s *LocalStorage) Stat(key string) (Object, error) {
+	if err := validKey(key); err != nil {
+		return Object{}, err
+	}
+
+	info, err := os.Stat(s.Path(key))
+	if os.IsNotExist(err) {
+		return Object{}, ErrNotFound
+	}
+
+	if err != nil {
+		return Object{}, err
+	}
+
+	return s.object(key, info), nil
+}
+
+// List walks the folder of prefix, skipping temporary files of Put
+func (s *LocalStorage) List(prefix string) ([]Object, error) {
+	var objects []Object
+
+	folderPath := s.Path(prefix)
+	if !strings.HasSuffix(prefix, "/") {
+		folderPath = filepath.Dir(folderPath)
+	}
+
+	err := filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".put-") {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(relativePath)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, s.object(key, info))
+		}
+
+		return nil
+	})
+
+	return objects, err
+}
+
+func (s *LocalStorage) Delete(key string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+
+	err := os.Remove(s.Path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// SignedURL returns the URL of the file under the base URL.
+// Local files are served as they are, so the URL is not signed and doesn't expire.
+func (s *LocalStorage) SignedURL(key string, expiry time.Duration) (string, error) {
+	if err := validKey(key); err != nil {
+		return "", err
+	}
+
+	return s.baseURL + "/" + key, nil
+}
+
+func (s *LocalStorage) object(key string, info os.FileInfo) Object {
+	return Object{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+		ContentType:  ContentType(key),
+	}
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestLocalStorage(t *testing.T) (*LocalStorage, func()) {
+	root, err := ioutil.TempDir("", "local-storage-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewLocalStorage(root, "http://localhost:8000/files/"), func() {
+		os.RemoveAll(root)
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	storage, cleanup := newTestLocalStorage(t)
+	defer cleanup()
+
+	testStorage(t, storage, "")
+}
+
+func TestLocalStorageInvalidKeys(t *testing.T) {
+	storage, cleanup := newTestLocalStorage(t)
+	defer cleanup()
+
+	keys := []string{"", "/etc/passwd", "../outside.mp4", "12/../../outside.mp4", "12/.."}
+
+	for _, key := range keys {
+		if err := storage.Put(key, strings.NewReader("x"), 1, ""); err == nil {
+			t.Errorf("Put accepted key %q", key)
+		}
+
+		if _, err := storage.Get(key); err == nil || err == ErrNotFound {
+			t.Errorf("Get of key %q returned %v, want an invalid key error", key, err)
+		}
+
+		if _, err := storage.Stat(key); err == nil || err == ErrNotFound {
+			t.Errorf("Stat of key %q returned %v, want an invalid key error", key, err)
+		}
+
+		if err := storage.Delete(key); err == nil {
+			t.Errorf("Delete accepted key %q", key)
+		}
+
+		if _, err := storage.SignedURL(key, 0); err == nil {
+			t.Errorf("SignedURL accepted key %q", key)
+		}
+
+		path := writeTempFile(t, "x")
+		if err := storage.PutFile(key, path); err == nil {
+			t.Errorf("PutFile accepted key %q", key)
+		}
+
+		os.RemoveAll(filepath.Dir(path))
+	}
+
+	if _, err := os.Stat(filepath.Join(filepath.Dir(storage.Root()), "outside.mp4")); !os.IsNotExist(err) {
+		t.Errorf("a file was written outside of the root: %v", err)
+	}
+}
+
+func TestLocalStorageSkipsPartialPuts(t *testing.T) {
+	storage, cleanup := newTestLocalStorage(t)
+	defer cleanup()
+
+	if err := os.MkdirAll(storage.Path("12"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(storage.Path("12/.put-123"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	expectKeys(t, storage, "12/", nil)
+}
+
+func TestLocalStorageSignedURL(t *testing.T) {
+	storage, cleanup := newTestLocalStorage(t)
+	defer cleanup()
+
+	url, err := storage.SignedURL("12/video.mpd", 0)
+	if err != nil {
+		t.Fatalf("SignedURL failed: %v", err)
+	}
+
+	if url != "http://localhost:8000/files/12/video.mpd" {
+		t.Errorf("SignedURL returned %q", url)
+	}
+}
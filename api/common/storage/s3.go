@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// S3Storage keeps objects in a bucket of an S3 compatible service, e.g. MinIO
+type S3Storage struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3Storage connects to an S3 compatible endpoint like "localhost:9000"
+// and creates the bucket if it doesn't exist
+func NewS3Storage(endpoint string, accessKeyID string, secretAccessKey string, bucket string, region string, useSSL bool) (*S3Storage, error) {
+	client, err := minio.NewWithRegion(endpoint, accessKeyID, secretAccessKey, useSSL, region)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		if err = client.MakeBucket(bucket, region); err != nil {
+			return nil, err
+		}
+	}
+
+	return &S3Storage{client: client, bucket: bucket}, nil
+}
+
+func (s *S3Storage) Put(key string, reader io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(s.bucket, key, reader, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+// PutFile uploads a local file and removes it
+func (s *S3Storage) PutFile(key string, path string) error {
+	if _, err := s.client.FPutObject(s.bucket, key, path, minio.PutObjectOptions{ContentType: ContentType(key)}); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// Get returns the object as a reader, a missing object fails on Get already
+func (s *S3Storage) Get(key string) (io.ReadCloser, error) {
+	if _, err := s.Stat(key); err != nil {
+		return nil, err
+	}
+
+	return s.client.GetObject(s.bucket, key, minio.GetObjectOptions{})
+}
+
+func (s *S3Storage) Stat(key string) (Object, error) {
+	info, err := s.client.StatObject(s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return Object{}, s3Error(err)
+	}
+
+	return s3Object(info), nil
+}
+
+func (s *S3Storage) List(prefix string) ([]Object, error) {
+	var objects []Object
+
+	done := make(chan struct{})
+	defer close(done)
+
+	for info := range s.client.ListObjectsV2(s.bucket, prefix, true, done) {
+		if info.Err != nil {
+			return objects, info.Err
+		}
+
+		objects = append(objects, s3Object(info))
+	}
+
+	return objects, nil
+}
+
+func (s *S3Storage) Delete(key string) error {
+	return s.client.RemoveObject(s.bucket, key)
+}
+
+// SignedURL returns a presigned GET URL of the object
+func (s *S3Storage) SignedURL(key string, expiry time.Duration) (string, error) {
+	signedURL, err := s.client.PresignedGetObject(s.bucket, key, expiry, url.Values{})
+	if err != nil {
+		return "", err
+	}
+
+	return signedURL.String(), nil
+}
+
+func s3Object(info minio.ObjectInfo) Object {
+	return Object{
+		Key:          strings.TrimPrefix(info.Key, "/"),
+		Size:         info.Size,
+		LastModified: info.LastModified,
+		ContentType:  info.ContentType,
+	}
+}
+
+// s3Error maps missing keys to ErrNotFound
+func s3Error(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotFound
+	}
+
+	return err
+}
@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestS3Storage runs against the S3 compatible service of the TEST_S3_* environment variables,
+// e.g. a MinIO server started with "minio server /data" and TEST_S3_ENDPOINT=localhost:9000
+func TestS3Storage(t *testing.T) {
+	endpoint := os.Getenv("TEST_S3_ENDPOINT")
+	if len(endpoint) == 0 {
+		t.Skip("No TEST_S3_ENDPOINT environment variable")
+	}
+
+	bucket := os.Getenv("TEST_S3_BUCKET")
+	if len(bucket) == 0 {
+		bucket = "storage-test"
+	}
+
+	storage, err := NewS3Storage(endpoint, os.Getenv("TEST_S3_ACCESS_KEY_ID"), os.Getenv("TEST_S3_SECRET_ACCESS_KEY"), bucket, os.Getenv("TEST_S3_REGION"), os.Getenv("TEST_S3_USE_SSL") == "true")
+	if err != nil {
+		t.Fatalf("NewS3Storage failed: %v", err)
+	}
+
+	testStorage(t, storage, fmt.Sprintf("test-%d/", time.Now().UnixNano()))
+}
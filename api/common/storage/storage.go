@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage backends
+const (
+	BackendLocal = "local"
+	BackendS3    = "s3"
+)
+
+// ErrNotFound is returned for keys without an object
+var ErrNotFound = errors.New("storage object not found")
+
+// Object represents a stored file
+type Object struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	ContentType  string    `json:"content_type"`
+}
+
+// Storage keeps video files by slash separated keys like "12/video_720p.mp4",
+// so services share them without sharing a filesystem
+type Storage interface {
+	// Put stores size bytes of reader under key, replacing an existing object
+	Put(key string, reader io.Reader, size int64, contentType string) error
+	Get(key string) (io.ReadCloser, error)
+	Stat(key string) (Object, error)
+
+	// List returns the objects whose key starts with prefix
+	List(prefix string) ([]Object, error)
+	Delete(key string) error
+
+	// SignedURL returns a URL clients can download the object from until expiry
+	SignedURL(key string, expiry time.Duration) (string, error)
+}
+
+// filePutter is implemented by storages which can store a local file
+// more cheaply than by reading it, the file is gone afterwards
+type filePutter interface {
+	PutFile(key string, path string) error
+}
+
+// Config selects a storage backend and holds what it connects with,
+// only the fields of the selected backend are used
+type Config struct {
+	Backend string
+
+	// LocalRoot is the folder keys are relative to,
+	// LocalBaseURL the URL prefix it is served from
+	LocalRoot    string
+	LocalBaseURL string
+
+	S3Endpoint        string
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	S3Bucket          string
+	S3Region          string
+	S3UseSSL          bool
+}
+
+// New returns a Storage of the configured backend
+func New(config Config) (Storage, error) {
+	switch config.Backend {
+	case BackendLocal, "":
+		if len(config.LocalRoot) == 0 {
+			return nil, errors.New("local storage backend needs a root folder")
+		}
+
+		return NewLocalStorage(config.LocalRoot, config.LocalBaseURL), nil
+	case BackendS3:
+		return NewS3Storage(config.S3Endpoint, config.S3AccessKeyID, config.S3SecretAccessKey, config.S3Bucket, config.S3Region, config.S3UseSSL)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", config.Backend)
+	}
+}
+
+// ConfigFromEnvironment reads STORAGE_BACKEND and the S3_* variables,
+// the local backend is rooted at given folder
+func ConfigFromEnvironment(localRoot string, localBaseURL string) (Config, error) {
+	config := Config{
+		Backend:      os.Getenv("STORAGE_BACKEND"),
+		LocalRoot:    localRoot,
+		LocalBaseURL: localBaseURL,
+	}
+
+	if config.Backend != BackendS3 {
+		return config, nil
+	}
+
+	required := map[string]*string{
+		"S3_ENDPOINT":          &config.S3Endpoint,
+		"S3_ACCESS_KEY_ID":     &config.S3AccessKeyID,
+		"S3_SECRET_ACCESS_KEY": &config.S3SecretAccessKey,
+		"S3_BUCKET":            &config.S3Bucket,
+	}
+
+	for name, value := range required {
+		*value = os.Getenv(name)
+		if len(*value) == 0 {
+			return config, fmt.Errorf("No %s environment variable", name)
+		}
+	}
+
+	config.S3Region = os.Getenv("S3_REGION")
+	config.S3UseSSL = true
+
+	if useSSL := os.Getenv("S3_USE_SSL"); len(useSSL) != 0 {
+		isSSL, err := strconv.ParseBool(useSSL)
+		if err != nil {
+			return config, errors.New("Invalid S3_USE_SSL environment variable")
+		}
+
+		config.S3UseSSL = isSSL
+	}
+
+	return config, nil
+}
+
+// PutFile moves a local file into the storage under key,
+// the local file is removed once it is stored
+func PutFile(storage Storage, key string, path string) error {
+	if putter, ok := storage.(filePutter); ok {
+		return putter.PutFile(key, path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err == nil {
+		err = storage.Put(key, file, info.Size(), ContentType(key))
+	}
+
+	file.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// GetFile downloads the object of key to a local file
+func GetFile(storage Storage, key string, path string) error {
+	reader, err := storage.Get(key)
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(file, reader); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+
+	return file.Close()
+}
+
+// ContentType returns the MIME type of a key by its extension
+func ContentType(key string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(key)); len(contentType) != 0 {
+		return contentType
+	}
+
+	return "application/octet-stream"
+}
+
+// Key returns the key of a path recorded before files were kept by key,
+// which was the key under the local upload folder
+func Key(path string, localRoot string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(path, localRoot), "/")
+}
+
+// validKey rejects keys which would escape the root of a local storage
+func validKey(key string) error {
+	if len(key) == 0 || strings.HasPrefix(key, "/") {
+		return fmt.Errorf("invalid storage key %q", key)
+	}
+
+	for _, part := range strings.Split(key, "/") {
+		if part == ".." {
+			return fmt.Errorf("invalid storage key %q", key)
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	// Streaming manifests and segments need their own MIME types,
+	// both when they are stored and when they are served
+	mime.AddExtensionType(".m3u8", "application/vnd.apple.mpegurl")
+	mime.AddExtensionType(".ts", "video/mp2t")
+	mime.AddExtensionType(".mpd", "application/dash+xml")
+}
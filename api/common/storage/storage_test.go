@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testStorage checks the behavior every Storage backend shares,
+// keys are put under prefix so runs don't see each other's objects
+func testStorage(t *testing.T, storage Storage, prefix string) {
+	key := prefix + "12/video_720p.mp4"
+
+	if _, err := storage.Stat(key); err != ErrNotFound {
+		t.Fatalf("Stat of missing key returned %v, want ErrNotFound", err)
+	}
+
+	if _, err := storage.Get(key); err != ErrNotFound {
+		t.Fatalf("Get of missing key returned %v, want ErrNotFound", err)
+	}
+
+	if err := storage.Put(key, strings.NewReader("first"), 5, "video/mp4"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// Put replaces an existing object
+	if err := storage.Put(key, strings.NewReader("rendition"), 9, "video/mp4"); err != nil {
+		t.Fatalf("second Put failed: %v", err)
+	}
+
+	expectContent(t, storage, key, "rendition")
+
+	object, err := storage.Stat(key)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+
+	if object.Key != key || object.Size != 9 || object.ContentType != "video/mp4" {
+		t.Errorf("unexpected object %+v", object)
+	}
+
+	// PutFile moves a local file into the storage, replacing an existing object
+	path := writeTempFile(t, "moved")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if err = PutFile(storage, key, path); err != nil {
+		t.Fatalf("PutFile failed: %v", err)
+	}
+
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("PutFile left the local file behind: %v", err)
+	}
+
+	expectContent(t, storage, key, "moved")
+
+	otherKeys := []string{prefix + "12/video.m3u8", prefix + "12/video_720p_00001.ts", prefix + "120/video.mp4"}
+
+	for _, otherKey := range otherKeys {
+		if err = storage.Put(otherKey, strings.NewReader("x"), 1, ContentType(otherKey)); err != nil {
+			t.Fatalf("Put of %s failed: %v", otherKey, err)
+		}
+	}
+
+	expectKeys(t, storage, prefix+"12/", []string{prefix + "12/video.m3u8", key, prefix + "12/video_720p_00001.ts"})
+	expectKeys(t, storage, prefix+"12/video_720p", []string{key, prefix + "12/video_720p_00001.ts"})
+	expectKeys(t, storage, prefix+"13/", nil)
+
+	if err = storage.Delete(key); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	if _, err = storage.Stat(key); err != ErrNotFound {
+		t.Errorf("Stat of deleted key returned %v, want ErrNotFound", err)
+	}
+
+	if err = storage.Delete(key); err != nil {
+		t.Errorf("Delete of missing key failed: %v", err)
+	}
+
+	for _, otherKey := range otherKeys {
+		storage.Delete(otherKey)
+	}
+}
+
+func expectContent(t *testing.T, storage Storage, key string, expected string) {
+	reader, err := storage.Get(key)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+
+	defer reader.Close()
+
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading %s failed: %v", key, err)
+	}
+
+	if string(content) != expected {
+		t.Errorf("%s holds %q, want %q", key, content, expected)
+	}
+}
+
+func expectKeys(t *testing.T, storage Storage, prefix string, expected []string) {
+	objects, err := storage.List(prefix)
+	if err != nil {
+		t.Fatalf("List of %s failed: %v", prefix, err)
+	}
+
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+
+	sort.Strings(keys)
+	sort.Strings(expected)
+
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Errorf("List of %s returned %v, want %v", prefix, keys, expected)
+	}
+}
+
+func writeTempFile(t *testing.T, content string) string {
+	folderPath, err := ioutil.TempDir("", "storage-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(folderPath, "upload.part")
+
+	if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
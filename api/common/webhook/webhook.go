@@ -0,0 +1,331 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/n1207n/video-transcode-queue/api/common/database"
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+
+	"go.uber.org/zap"
+)
+
+// Headers sent along with every webhook POST
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+// Payload represents the JSON body POSTed to subscriptions
+type Payload struct {
+	DeliveryID string      `json:"delivery_id"`
+	Event      string      `json:"event"`
+	VideoID    uint        `json:"video_id"`
+	JobID      uint        `json:"job_id,omitempty"`
+	Timestamp  time.Time   `json:"timestamp"`
+	Data       interface{} `json:"data,omitempty"`
+}
+
+// Sign returns hex encoded HMAC-SHA256 of body with given secret,
+// receivers compare it with the signature header value after "sha256="
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewSecret returns a random secret for a new subscription
+func NewSecret() (string, error) {
+	return randomHex(32)
+}
+
+func randomHex(size int) (string, error) {
+	randomBytes := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, randomBytes); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(randomBytes), nil
+}
+
+// Dispatcher POSTs events to every subscription registered for them,
+// retrying failed deliveries with exponential backoff in background.
+// Attempts are kept in webhook_deliveries until they are made,
+// so retries pending on shutdown are made by any dispatcher after it.
+type Dispatcher struct {
+	// Connect opens a new database connection,
+	// it is closed after each operation like the rest of database package
+	Connect func() *gorm.DB
+
+	Client         *http.Client
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	Logger         *zap.SugaredLogger
+
+	// PollInterval is how often due attempts are looked for, BatchSize how many
+	// are made at once. An attempt not finished within ClaimTimeout is made again.
+	PollInterval time.Duration
+	BatchSize    int
+	ClaimTimeout time.Duration
+
+	wakeup   chan struct{}
+	stopping chan struct{}
+	done     chan struct{}
+}
+
+// NewDispatcher returns a Dispatcher with default retry settings
+func NewDispatcher(connect func() *gorm.DB, logger *zap.SugaredLogger) *Dispatcher {
+	return &Dispatcher{
+		Connect:        connect,
+		Client:         &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts:    5,
+		InitialBackoff: 2 * time.Second,
+		Logger:         logger,
+		PollInterval:   time.Second,
+		BatchSize:      20,
+		ClaimTimeout:   time.Minute,
+		wakeup:         make(chan struct{}, 1),
+		stopping:       make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+}
+
+// Start makes due delivery attempts in background until Stop
+func (d *Dispatcher) Start() {
+	go d.run()
+}
+
+// Stop waits up to given timeout for the attempts being made
+// and tells if they finished. Attempts still pending are made after a restart.
+func (d *Dispatcher) Stop(timeout time.Duration) bool {
+	close(d.stopping)
+
+	select {
+	case <-d.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Notify records the first delivery attempt of an event of a video
+// to each of its subscriptions, they are made without blocking the caller
+func (d *Dispatcher) Notify(eventName string, videoID uint, jobID uint, data interface{}) {
+	subscriptions, err := database.GetActiveWebhookSubscriptionObjects(eventName, d.Connect())
+	if err != nil {
+		d.Logger.Errorf("Failed to load webhook subscriptions for %s: %s\n", eventName, err.Error())
+		return
+	}
+
+	for _, subscription := range subscriptions {
+		deliveryID, err := randomHex(16)
+		if err != nil {
+			d.Logger.Errorf("Failed to create webhook delivery ID: %s\n", err.Error())
+			return
+		}
+
+		payload := Payload{
+			DeliveryID: deliveryID,
+			Event:      eventName,
+			VideoID:    videoID,
+			JobID:      jobID,
+			Timestamp:  time.Now(),
+			Data:       data,
+		}
+
+		body, err := json.Marshal(payload)
+		if err != nil {
+			d.Logger.Errorf("Failed to encode webhook payload for %s: %s\n", eventName, err.Error())
+			return
+		}
+
+		now := time.Now()
+
+		delivery := entity.WebhookDelivery{
+			CreatedAt:      now,
+			UpdatedAt:      now,
+			SubscriptionID: subscription.ID,
+			DeliveryID:     deliveryID,
+			Event:          eventName,
+			Payload:        string(body),
+			Attempt:        1,
+			NextAttemptAt:  &now,
+		}
+
+		if _, err = database.CreateWebhookDeliveryObject(delivery, d.Connect()); err != nil {
+			d.Logger.Errorf("Failed to record %s delivery to %s: %s\n", eventName, subscription, err.Error())
+		}
+	}
+
+	select {
+	case d.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(d.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stopping:
+			return
+		case <-ticker.C:
+		case <-d.wakeup:
+		}
+
+		d.deliverDue()
+	}
+}
+
+// deliverDue makes due attempts in batches until none is left or the dispatcher stops,
+// the attempts of a batch run concurrently so a slow subscriber doesn't hold back others
+func (d *Dispatcher) deliverDue() {
+	for {
+		deliveries, err := database.ClaimDueWebhookDeliveries(d.BatchSize, d.ClaimTimeout, d.Connect())
+		if err != nil {
+			d.Logger.Errorf("Failed to claim webhook deliveries: %s\n", err.Error())
+			return
+		}
+
+		var waitGroup sync.WaitGroup
+
+		for _, delivery := range deliveries {
+			waitGroup.Add(1)
+
+			go func(delivery entity.WebhookDelivery) {
+				defer waitGroup.Done()
+				d.deliver(delivery)
+			}(delivery)
+		}
+
+		waitGroup.Wait()
+
+		if len(deliveries) < d.BatchSize {
+			return
+		}
+
+		select {
+		case <-d.stopping:
+			return
+		default:
+		}
+	}
+}
+
+// deliver makes a claimed attempt and records its outcome,
+// scheduling the next attempt with doubled backoff until the attempts run out
+func (d *Dispatcher) deliver(delivery entity.WebhookDelivery) {
+	subscription, err := database.GetWebhookSubscriptionObject(int(delivery.SubscriptionID), d.Connect())
+	if err != nil {
+		// Deliveries of a deleted subscription are deleted along with it
+		if err != gorm.ErrRecordNotFound {
+			d.Logger.Warnf("Failed to load subscription of %s: %s\n", delivery, err.Error())
+		}
+
+		return
+	}
+
+	if subscription.IsActive {
+		delivery.StatusCode, err = d.post(subscription, delivery)
+	} else {
+		err = errors.New("subscription is inactive")
+	}
+
+	delivery.IsDelivered = err == nil
+
+	var nextDelivery *entity.WebhookDelivery
+
+	if err != nil {
+		delivery.Error = err.Error()
+
+		if subscription.IsActive && delivery.Attempt < d.MaxAttempts {
+			nextAttemptAt := time.Now().Add(d.backoff(delivery.Attempt))
+
+			nextDelivery = &entity.WebhookDelivery{
+				SubscriptionID: delivery.SubscriptionID,
+				DeliveryID:     delivery.DeliveryID,
+				Event:          delivery.Event,
+				Payload:        delivery.Payload,
+				Attempt:        delivery.Attempt + 1,
+				NextAttemptAt:  &nextAttemptAt,
+			}
+		}
+	}
+
+	isCompleted, dbErr := database.CompleteWebhookDeliveryAttempt(delivery, nextDelivery, d.Connect())
+	if dbErr != nil {
+		d.Logger.Warnf("Failed to record %s: %s\n", delivery, dbErr.Error())
+		return
+	}
+
+	if !isCompleted {
+		d.Logger.Warnf("%s took longer than its claim and is made again\n", delivery)
+		return
+	}
+
+	switch {
+	case err == nil:
+		d.Logger.Infof("Delivered %s to %s\n", delivery.Event, subscription)
+	case nextDelivery != nil:
+		d.Logger.Warnf("Webhook attempt %d of %s to %s failed: %s\n", delivery.Attempt, delivery.Event, subscription, err.Error())
+	default:
+		d.Logger.Errorf("Gave up delivering %s to %s after %d attempts: %s\n", delivery.Event, subscription, delivery.Attempt, err.Error())
+	}
+}
+
+// backoff returns how long to wait after given failed attempt
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	backoff := d.InitialBackoff
+
+	for failed := 1; failed < attempt; failed++ {
+		backoff *= 2
+	}
+
+	return backoff
+}
+
+func (d *Dispatcher) post(subscription entity.WebhookSubscription, delivery entity.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+
+	request, err := http.NewRequest("POST", subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(EventHeader, delivery.Event)
+	request.Header.Set(DeliveryHeader, delivery.DeliveryID)
+	request.Header.Set(SignatureHeader, "sha256="+Sign(subscription.Secret, body))
+
+	response, err := d.Client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("unexpected response status: %s", response.Status)
+	}
+
+	return response.StatusCode, nil
+}
@@ -0,0 +1,247 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/n1207n/video-transcode-queue/api/common/database"
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+
+	"go.uber.org/zap"
+)
+
+func TestSign(t *testing.T) {
+	// HMAC-SHA256 test case 2 of RFC 4231
+	signature := Sign("Jefe", []byte("what do ya want for nothing?"))
+
+	expected := "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	if signature != expected {
+		t.Errorf("Sign = %s, want %s", signature, expected)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	dispatcher := &Dispatcher{InitialBackoff: 2 * time.Second}
+
+	for attempt, expected := range map[int]time.Duration{1: 2 * time.Second, 2: 4 * time.Second, 4: 16 * time.Second} {
+		if backoff := dispatcher.backoff(attempt); backoff != expected {
+			t.Errorf("backoff after attempt %d = %s, want %s", attempt, backoff, expected)
+		}
+	}
+}
+
+// testDispatcher returns a quick Dispatcher on the PostgreSQL database
+// of the TEST_PG* environment variables, and skips the test without TEST_PGHOST.
+// Tests delete webhook tables, so never point it at a database in use.
+func testDispatcher(t *testing.T) *Dispatcher {
+	host := os.Getenv("TEST_PGHOST")
+	if len(host) == 0 {
+		t.Skip("No TEST_PGHOST environment variable")
+	}
+
+	user, password, db := os.Getenv("TEST_PGUSER"), os.Getenv("TEST_PGPASSWORD"), os.Getenv("TEST_PGDB")
+
+	database.CreateSchemas(user, password, host, db)
+
+	dispatcher := NewDispatcher(func() *gorm.DB {
+		return database.GetConnection(user, password, host, db)
+	}, zap.NewNop().Sugar())
+
+	dispatcher.InitialBackoff = 50 * time.Millisecond
+	dispatcher.PollInterval = 20 * time.Millisecond
+
+	connection := dispatcher.Connect()
+	connection.Exec("DELETE FROM webhook_subscriptions")
+	connection.Close()
+
+	return dispatcher
+}
+
+// testReceiver answers requests with the given statuses in turn, 200 after them
+type testReceiver struct {
+	mutex    sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func (r *testReceiver) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	status := http.StatusOK
+	if len(r.requests) < len(r.statuses) {
+		status = r.statuses[len(r.requests)]
+	}
+
+	r.requests = append(r.requests, request)
+	r.bodies = append(r.bodies, string(body))
+
+	w.WriteHeader(status)
+}
+
+func createSubscription(t *testing.T, dispatcher *Dispatcher, url string) entity.WebhookSubscription {
+	subscription, err := database.CreateWebhookSubscriptionObject(entity.WebhookSubscription{
+		URL:      url,
+		Secret:   "secret",
+		IsActive: true,
+	}, dispatcher.Connect())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return subscription
+}
+
+// waitForDeliveries polls the delivery log of a subscription until every attempt was made
+func waitForDeliveries(t *testing.T, dispatcher *Dispatcher, subscriptionID uint, count int) []entity.WebhookDelivery {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		deliveries, err := database.GetWebhookDeliveryObjects(int(subscriptionID), 100, dispatcher.Connect())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		isPending := false
+		for _, delivery := range deliveries {
+			isPending = isPending || delivery.NextAttemptAt != nil
+		}
+
+		if len(deliveries) == count && !isPending {
+			return deliveries
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("delivery log %+v, want %d attempts made", deliveries, count)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	dispatcher := testDispatcher(t)
+
+	receiver := &testReceiver{statuses: []int{http.StatusInternalServerError, http.StatusServiceUnavailable}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	subscription := createSubscription(t, dispatcher, server.URL)
+
+	dispatcher.Start()
+	dispatcher.Notify(entity.WebhookEventVideoReady, 12, 34, nil)
+
+	// Newest first
+	deliveries := waitForDeliveries(t, dispatcher, subscription.ID, 3)
+
+	if !dispatcher.Stop(time.Second) {
+		t.Error("Stop timed out")
+	}
+
+	for index, expected := range []struct {
+		attempt     int
+		statusCode  int
+		isDelivered bool
+	}{
+		{3, http.StatusOK, true},
+		{2, http.StatusServiceUnavailable, false},
+		{1, http.StatusInternalServerError, false},
+	} {
+		delivery := deliveries[index]
+
+		if delivery.Attempt != expected.attempt || delivery.StatusCode != expected.statusCode || delivery.IsDelivered != expected.isDelivered {
+			t.Errorf("attempt %d %+v, want status %d and delivered %t", delivery.Attempt, delivery, expected.statusCode, expected.isDelivered)
+		}
+
+		if delivery.DeliveryID != deliveries[0].DeliveryID {
+			t.Errorf("attempt %d has delivery ID %s, want %s", delivery.Attempt, delivery.DeliveryID, deliveries[0].DeliveryID)
+		}
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	for index, request := range receiver.requests {
+		if request.Header.Get(DeliveryHeader) != deliveries[0].DeliveryID {
+			t.Errorf("request %d has delivery header %q", index, request.Header.Get(DeliveryHeader))
+		}
+
+		if signature := "sha256=" + Sign("secret", []byte(receiver.bodies[index])); request.Header.Get(SignatureHeader) != signature {
+			t.Errorf("request %d has signature %q, want %q", index, request.Header.Get(SignatureHeader), signature)
+		}
+	}
+}
+
+func TestDispatcherGivesUp(t *testing.T) {
+	dispatcher := testDispatcher(t)
+	dispatcher.MaxAttempts = 2
+
+	receiver := &testReceiver{statuses: []int{http.StatusGone, http.StatusGone, http.StatusGone}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	subscription := createSubscription(t, dispatcher, server.URL)
+
+	dispatcher.Start()
+	defer dispatcher.Stop(time.Second)
+
+	dispatcher.Notify(entity.WebhookEventVideoFailed, 12, 34, nil)
+
+	deliveries := waitForDeliveries(t, dispatcher, subscription.ID, 2)
+
+	for _, delivery := range deliveries {
+		if delivery.IsDelivered || delivery.StatusCode != http.StatusGone {
+			t.Errorf("unexpected attempt %+v", delivery)
+		}
+	}
+
+	// No attempt is scheduled after the last one
+	time.Sleep(3 * dispatcher.InitialBackoff)
+	waitForDeliveries(t, dispatcher, subscription.ID, 2)
+}
+
+// TestDispatcherResumes makes the attempts a stopped dispatcher left behind:
+// one scheduled and one claimed by it, whose claim expired
+func TestDispatcherResumes(t *testing.T) {
+	dispatcher := testDispatcher(t)
+
+	receiver := &testReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	subscription := createSubscription(t, dispatcher, server.URL)
+
+	now := time.Now()
+	expiredClaim := now.Add(-time.Second)
+
+	for _, delivery := range []entity.WebhookDelivery{
+		{DeliveryID: "scheduled", Attempt: 2, NextAttemptAt: &now},
+		{DeliveryID: "claimed", Attempt: 1, NextAttemptAt: &expiredClaim},
+	} {
+		delivery.SubscriptionID = subscription.ID
+		delivery.Event = entity.WebhookEventVideoReady
+		delivery.Payload = "{}"
+
+		if _, err := database.CreateWebhookDeliveryObject(delivery, dispatcher.Connect()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dispatcher.Start()
+	defer dispatcher.Stop(time.Second)
+
+	for _, delivery := range waitForDeliveries(t, dispatcher, subscription.ID, 2) {
+		if !delivery.IsDelivered {
+			t.Errorf("%s was not delivered: %+v", delivery, delivery)
+		}
+	}
+}
@@ -1,18 +1,31 @@
 package main
 
 import (
+	"io"
+	"net/http"
 	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
+	"github.com/n1207n/video-transcode-queue/api/common/database"
+	"github.com/n1207n/video-transcode-queue/api/common/storage"
 )
 
+// contentsPathPrefix is the URL prefix static video contents are served from
+const contentsPathPrefix = "/contents"
+
 var (
 	pgDb, pgUser, pgPassword, pgHost string
 	uploadFolderPath                 string
+	videoStorage                     storage.Storage
+	signedURLExpiry                  = time.Hour
 	logger                           *zap.SugaredLogger
 )
 
@@ -48,6 +61,31 @@ func loadEnvironmentVariables() {
 	if len(uploadFolderPath) == 0 {
 		panic("No UPLOAD_FOLDER_PATH environment variable")
 	}
+
+	if expiry := os.Getenv("STORAGE_SIGNED_URL_EXPIRY"); len(expiry) != 0 {
+		duration, err := time.ParseDuration(expiry)
+		if err != nil || duration <= 0 {
+			panic("Invalid STORAGE_SIGNED_URL_EXPIRY environment variable")
+		}
+
+		signedURLExpiry = duration
+	}
+}
+
+// openStorage connects to the configured storage of video files,
+// the local one is the upload folder
+func openStorage() storage.Storage {
+	config, err := storage.ConfigFromEnvironment(uploadFolderPath, contentsPathPrefix)
+	if err != nil {
+		panic(err)
+	}
+
+	videoStorage, err := storage.New(config)
+	if err != nil {
+		panic(err)
+	}
+
+	return videoStorage
 }
 
 func startStreamingAPIServer() {
@@ -57,6 +95,8 @@ func startStreamingAPIServer() {
 	logger = log.Sugar()
 	logger.Info("Starting streaming API server")
 
+	videoStorage = openStorage()
+
 	// Creates a gin router with default middleware:
 	// logger and recovery (crash-free) middleware
 	router := gin.Default()
@@ -67,9 +107,112 @@ func startStreamingAPIServer() {
 
 	router.Use(cors.New(corsConfig))
 
-	// TODO: Use uploadFolderPath later for better security
-	router.Use(static.Serve("/contents", static.LocalFile("/", false)))
+	// Local files are served as they are,
+	// files of other storages through their signed URLs
+	if localStorage, ok := videoStorage.(*storage.LocalStorage); ok {
+		router.Use(static.Serve(contentsPathPrefix, static.LocalFile(localStorage.Root(), false)))
+	} else {
+		router.GET(contentsPathPrefix+"/*key", getStoredContents)
+	}
+
+	v1 := router.Group("/api/v1")
+	{
+		v1.GET("/videos/:id/dash", getDASHManifest)
+		v1.GET("/videos/:id/hls", getHLSManifest)
+	}
 
 	// By default it serves on :8080
 	router.Run(":8880")
 }
+
+// getDASHManifest redirects to the MPD file of a ready Video
+func getDASHManifest(c *gin.Context) {
+	redirectToManifest(c, "dash")
+}
+
+// getHLSManifest redirects to the HLS master playlist of a ready Video
+func getHLSManifest(c *gin.Context) {
+	redirectToManifest(c, "hls")
+}
+
+// redirectToManifest sends clients to the static contents URL of a manifest,
+// so that relative segment URLs in it resolve correctly
+func redirectToManifest(c *gin.Context, format string) {
+	videoID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	video, err := database.GetVideoObject(videoID, connection)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	manifestPath := video.StreamFilePath
+	if format == "hls" {
+		manifestPath = video.HLSManifestPath
+	}
+
+	if !video.IsReadyToServe || manifestPath == "" {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "video is not ready to serve",
+		})
+
+		return
+	}
+
+	// Videos transcoded before storage keys recorded paths under the upload folder
+	c.Redirect(http.StatusFound, contentsPathPrefix+"/"+storage.Key(manifestPath, uploadFolderPath))
+}
+
+// getStoredContents serves manifests itself and redirects to signed URLs of other files,
+// so relative URLs in manifests resolve to this server and get signed as well
+func getStoredContents(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+
+	if extension := path.Ext(key); extension != ".mpd" && extension != ".m3u8" {
+		signedURL, err := videoStorage.SignedURL(key, signedURLExpiry)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+
+		c.Redirect(http.StatusFound, signedURL)
+		return
+	}
+
+	reader, err := videoStorage.Get(key)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err == storage.ErrNotFound {
+			status = http.StatusNotFound
+		}
+
+		c.JSON(status, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	defer reader.Close()
+
+	c.Header("Content-Type", storage.ContentType(key))
+	c.Status(http.StatusOK)
+
+	if _, err = io.Copy(c.Writer, reader); err != nil {
+		logger.Warnf("Failed to serve %s: %s", key, err.Error())
+	}
+}
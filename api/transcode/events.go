@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/n1207n/video-transcode-queue/api/common/event"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// redisClient publishes job events to subscribers of the backend API
+var redisClient *redis.Client
+
+// openEventPublisher connects to redis for publishing video events
+func openEventPublisher() {
+	if len(redisURL) == 0 {
+		logger.Info("No REDIS_URL, video events are disabled")
+		return
+	}
+
+	redisClient = redis.NewClient(&redis.Options{
+		Network:  "tcp",
+		Addr:     fmt.Sprintf("%s:%s", redisURL, redisPort),
+		DB:       int64(1),
+		Password: redisPassword,
+	})
+
+	logger.Infof("Connected to Redis for video events: %s:%s\n", redisURL, redisPort)
+}
+
+// publishEvent sends a video event, a failed publish is only logged
+// as subscribers can always fall back to the detail APIs
+func publishEvent(videoEvent event.Event) {
+	if redisClient == nil {
+		return
+	}
+
+	if err := event.Publish(redisClient, videoEvent); err != nil {
+		logger.Warnf("Failed to publish %s event of video %d: %s\n", videoEvent.Type, videoEvent.VideoID, err.Error())
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/n1207n/video-transcode-queue/api/common/database"
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+
+	"go.uber.org/zap"
+)
+
+// hlsSegmentDuration is the target duration of each HLS segment in seconds
+const hlsSegmentDuration = 6
+
+// ConstructHLS creates HLS media playlists for each rendition
+// and a master playlist referencing them, returning the master playlist path.
+// It runs after ConstructMPD, which records the codecs of the renderings.
+func ConstructHLS(ctx context.Context, videoName string, videoID int, folderPath string, transcodeTargets []entity.EncodingProfile, dbConnectionInfo map[string]string, logger *zap.SugaredLogger) (string, error) {
+	logger.Infof("Constructing HLS playlists: %s\n", videoName)
+
+	pgDb := dbConnectionInfo["pgDb"]
+	pgUser := dbConnectionInfo["pgUser"]
+	pgPassword := dbConnectionInfo["pgPassword"]
+	pgHost := dbConnectionInfo["pgHost"]
+
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	object, err := database.GetVideoObject(videoID, connection)
+	if err != nil {
+		logger.Errorw("Video object GET failed for updating:", err.Error())
+		return "", err
+	}
+
+	renderingsByTitle := renderingsOfFolder(object.Renderings, folderPath)
+
+	// The audio track is only packaged if the source has one
+	audioCodecs := ""
+	if audioRendering, ok := renderingsByTitle[fmt.Sprintf("%s_audio", videoName)]; ok && isInFolder(audioRendering, folderPath) {
+		audioCodecs = audioRendering.Codecs
+	}
+
+	masterPlaylist := new(bytes.Buffer)
+	masterPlaylist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+
+	for _, profile := range transcodeTargets {
+		renderingTitle := fmt.Sprintf("%s_%s", videoName, profile.Name)
+
+		hlsCommand := fmt.Sprintf(
+			"ffmpeg -y -i %s/%s.mp4 -c copy -hls_time %d -hls_playlist_type vod -hls_segment_filename %s/%s_%%05d.ts %s/%s.m3u8",
+			folderPath, renderingTitle, hlsSegmentDuration, folderPath, renderingTitle, folderPath, renderingTitle,
+		)
+
+		_, err := ExecuteCLI(ctx, hlsCommand, false)
+		if err != nil {
+			logger.Errorf("Error during command execution: %s\nError: %s", hlsCommand, err.Error())
+			return "", fmt.Errorf("HLS packaging of %s failed: %s", profile.Name, err.Error())
+		}
+
+		var rendering *entity.VideoRendering
+		if renderingOfTitle, ok := renderingsByTitle[renderingTitle]; ok && isInFolder(renderingOfTitle, folderPath) {
+			rendering = &renderingOfTitle
+		}
+
+		masterPlaylist.WriteString(hlsStreamInf(profile, rendering, audioCodecs))
+		masterPlaylist.WriteString(fmt.Sprintf("\n%s.m3u8\n", renderingTitle))
+	}
+
+	masterPlaylistPath := fmt.Sprintf("%s/%s.m3u8", folderPath, videoName)
+
+	if err = ioutil.WriteFile(masterPlaylistPath, masterPlaylist.Bytes(), 0644); err != nil {
+		logger.Errorf("Failed to write HLS master playlist: %s\n", err.Error())
+		return "", fmt.Errorf("HLS packaging failed: %s", err.Error())
+	}
+
+	return masterPlaylistPath, nil
+}
+
+// hlsStreamInf returns the EXT-X-STREAM-INF tag of a rendition with the RESOLUTION
+// and CODECS Apple's HLS authoring rules ask for, as far as the rendering is known
+func hlsStreamInf(profile entity.EncodingProfile, rendering *entity.VideoRendering, audioCodecs string) string {
+	tag := fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d", (profile.MaxRateKbps+profile.AudioBitrateKbps)*1000)
+
+	if rendering == nil {
+		return tag
+	}
+
+	tag += fmt.Sprintf(",RESOLUTION=%dx%d", rendering.Width, rendering.Height)
+
+	// CODECS without the video codec would announce an audio-only stream
+	if len(rendering.Codecs) == 0 {
+		return tag
+	}
+
+	codecs := rendering.Codecs
+	if len(audioCodecs) != 0 {
+		codecs += "," + audioCodecs
+	}
+
+	return tag + fmt.Sprintf(",CODECS=\"%s\"", codecs)
+}
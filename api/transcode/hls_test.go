@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+)
+
+func TestRenderingsOfFolder(t *testing.T) {
+	renderings := []entity.VideoRendering{
+		{RenderingTitle: "clip_720p", FilePath: "/videos/12/job-1/clip_720p.mp4", Width: 1280, Height: 720},
+		{RenderingTitle: "clip_720p", FilePath: "/videos/12/job-2/clip_720p.mp4", Width: 1280, Height: 544},
+		{RenderingTitle: "clip_720p", FilePath: "/videos/12/job-3/clip_720p.mp4", Width: 960, Height: 720},
+		{RenderingTitle: "clip_480p", FilePath: "/videos/12/job-1/clip_480p.mp4", Width: 854, Height: 480},
+		{RenderingTitle: "clip_audio", FilePath: "/videos/12/job-2/clip_audio.mp4", Codecs: "mp4a.40.2"},
+	}
+
+	renderingsByTitle := renderingsOfFolder(renderings, "/videos/12/job-2")
+
+	expectedPaths := map[string]string{
+		"clip_720p":  "/videos/12/job-2/clip_720p.mp4",
+		"clip_480p":  "/videos/12/job-1/clip_480p.mp4",
+		"clip_audio": "/videos/12/job-2/clip_audio.mp4",
+	}
+
+	if len(renderingsByTitle) != len(expectedPaths) {
+		t.Errorf("renderingsOfFolder returned %d titles, want %d", len(renderingsByTitle), len(expectedPaths))
+	}
+
+	for title, expectedPath := range expectedPaths {
+		if rendering := renderingsByTitle[title]; rendering.FilePath != expectedPath {
+			t.Errorf("rendering %s = %s, want %s", title, rendering.FilePath, expectedPath)
+		}
+	}
+}
+
+func TestHLSStreamInf(t *testing.T) {
+	profile := entity.EncodingProfile{Name: "720p", MaxRateKbps: 3000, AudioBitrateKbps: 128}
+
+	tests := []struct {
+		name        string
+		rendering   *entity.VideoRendering
+		audioCodecs string
+		expectedTag string
+	}{
+		{
+			name:        "video and audio",
+			rendering:   &entity.VideoRendering{Width: 1280, Height: 720, Codecs: "avc1.64001f"},
+			audioCodecs: "mp4a.40.2",
+			expectedTag: `#EXT-X-STREAM-INF:BANDWIDTH=3128000,RESOLUTION=1280x720,CODECS="avc1.64001f,mp4a.40.2"`,
+		},
+		{
+			name:        "no audio track",
+			rendering:   &entity.VideoRendering{Width: 1280, Height: 720, Codecs: "avc1.64001f"},
+			expectedTag: `#EXT-X-STREAM-INF:BANDWIDTH=3128000,RESOLUTION=1280x720,CODECS="avc1.64001f"`,
+		},
+		{
+			name:        "unknown video codecs",
+			rendering:   &entity.VideoRendering{Width: 1280, Height: 720},
+			audioCodecs: "mp4a.40.2",
+			expectedTag: `#EXT-X-STREAM-INF:BANDWIDTH=3128000,RESOLUTION=1280x720`,
+		},
+		{
+			name:        "unknown rendering",
+			audioCodecs: "mp4a.40.2",
+			expectedTag: `#EXT-X-STREAM-INF:BANDWIDTH=3128000`,
+		},
+	}
+
+	for _, test := range tests {
+		if tag := hlsStreamInf(profile, test.rendering, test.audioCodecs); tag != test.expectedTag {
+			t.Errorf("%s: hlsStreamInf = %s, want %s", test.name, tag, test.expectedTag)
+		}
+	}
+}
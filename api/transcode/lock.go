@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/n1207n/video-transcode-queue/api/common/lock"
+)
+
+const (
+	// videoLockTTL is how long a video lock outlives a transcoder
+	// which died without releasing it
+	videoLockTTL = 30 * time.Second
+
+	// videoLockRetryInterval is how long a job waits
+	// before trying again to lock a video busy in another job
+	videoLockRetryInterval = 10 * time.Second
+)
+
+var (
+	// localVideoLocks stands in for redis locks without REDIS_URL,
+	// protecting videos within this transcoder only
+	localVideoLocks      = map[uint]bool{}
+	localVideoLocksMutex sync.Mutex
+)
+
+// videoLock is a held lock of a video, so one job at a time writes its files
+type videoLock struct {
+	videoID uint
+	lease   *lock.Lease
+}
+
+// lockVideo takes the lock of a video, returning lock.ErrLocked
+// while another job of the video runs on any transcoder.
+// onLost is called if the lock expires before it is released.
+func lockVideo(videoID uint, onLost func(err error)) (*videoLock, error) {
+	if redisClient == nil {
+		localVideoLocksMutex.Lock()
+		defer localVideoLocksMutex.Unlock()
+
+		if localVideoLocks[videoID] {
+			return nil, lock.ErrLocked
+		}
+
+		localVideoLocks[videoID] = true
+
+		return &videoLock{videoID: videoID}, nil
+	}
+
+	lease, err := lock.Acquire(redisClient, lock.VideoKey(videoID), videoLockTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	lease.KeepAlive(onLost)
+
+	return &videoLock{videoID: videoID, lease: lease}, nil
+}
+
+// release gives the video lock back
+func (l *videoLock) release() {
+	if l.lease == nil {
+		localVideoLocksMutex.Lock()
+		delete(localVideoLocks, l.videoID)
+		localVideoLocksMutex.Unlock()
+
+		return
+	}
+
+	if err := l.lease.Release(); err != nil {
+		logger.Warnf("Failed to release lock of video %d: %s", l.videoID, err.Error())
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/n1207n/video-transcode-queue/api/common/database"
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+	"github.com/n1207n/video-transcode-queue/api/common/storage"
+)
+
+// publishTranscodeOutputs stores the files rendered in the scratch folder of a job
+// under keyPrefix, points the video and its renderings to the stored keys
+// and marks the video ready to serve
+func publishTranscodeOutputs(job entity.TranscodeJob, folderPath string, sourceFilename string, keyPrefix string, mpdFilePath string, hlsManifestPath string) error {
+	outputKey := func(filePath string) string {
+		return path.Join(keyPrefix, filepath.Base(filePath))
+	}
+
+	files, err := ioutil.ReadDir(folderPath)
+	if err != nil {
+		return err
+	}
+
+	var manifestPaths []string
+
+	stored := 0
+
+	for _, file := range files {
+		if file.IsDir() || file.Name() == sourceFilename {
+			continue
+		}
+
+		filePath := filepath.Join(folderPath, file.Name())
+
+		// Manifests are stored last, so no player finds one before its media files
+		if extension := filepath.Ext(file.Name()); extension == ".m3u8" || extension == ".mpd" {
+			manifestPaths = append(manifestPaths, filePath)
+			continue
+		}
+
+		if err = storage.PutFile(videoStorage, outputKey(filePath), filePath); err != nil {
+			return err
+		}
+
+		stored++
+	}
+
+	for _, filePath := range manifestPaths {
+		if err = storage.PutFile(videoStorage, outputKey(filePath), filePath); err != nil {
+			return err
+		}
+
+		stored++
+	}
+
+	logger.Infof("Stored %d transcoded files of %s under %s", stored, job, keyPrefix)
+
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	object, err := database.GetVideoObject(int(job.VideoID), connection)
+	if err != nil {
+		return err
+	}
+
+	isRendered := func(filePath string) bool {
+		return strings.HasPrefix(filePath, folderPath+"/")
+	}
+
+	storedKey := func(filePath string) string {
+		if isRendered(filePath) {
+			return outputKey(filePath)
+		}
+
+		return filePath
+	}
+
+	// Renderings are updated in place, as saving the video saves them too
+	for index := range object.Renderings {
+		rendering := &object.Renderings[index]
+
+		if !isRendered(rendering.FilePath) && !isRendered(rendering.DashFilePath) {
+			continue
+		}
+
+		rendering.FilePath = storedKey(rendering.FilePath)
+		rendering.URL = storedKey(rendering.URL)
+		rendering.DashFilePath = storedKey(rendering.DashFilePath)
+
+		connection = database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+		if _, err = database.UpdateVideoRenderingObject(*rendering, connection); err != nil {
+			return err
+		}
+	}
+
+	object.UpdatedAt = time.Now()
+	object.StreamFilePath = outputKey(mpdFilePath)
+	object.HLSManifestPath = outputKey(hlsManifestPath)
+	object.IsReadyToServe = true
+
+	connection = database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	object, err = database.UpdateVideoObject(object, connection)
+	if err != nil {
+		logger.Errorw("Video object Update failed:", err.Error())
+		return err
+	}
+
+	if err = UpdateJobState(job.ID, entity.JobStateReady, "", getDBConnectionInfo(), logger); err != nil {
+		return err
+	}
+
+	webhooks.Notify(entity.WebhookEventVideoReady, object.ID, job.ID, object)
+
+	return nil
+}
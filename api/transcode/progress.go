@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// progressUpdateInterval throttles how often progress is written to database
+const progressUpdateInterval = 2 * time.Second
+
+// FFmpegProgress represents one block of key=value lines
+// written by ffmpeg's -progress option
+type FFmpegProgress struct {
+	Frame   uint
+	OutTime float64
+	Speed   float64
+	IsEnd   bool
+}
+
+// Percent returns how much of given duration is encoded
+func (p FFmpegProgress) Percent(duration float64) float64 {
+	if p.IsEnd {
+		return 100
+	}
+
+	if duration <= 0 {
+		return 0
+	}
+
+	percent := p.OutTime / duration * 100
+	if percent > 100 {
+		percent = 100
+	}
+
+	return percent
+}
+
+// ETA returns the estimated seconds left to encode given duration
+func (p FFmpegProgress) ETA(duration float64) float64 {
+	if p.IsEnd || duration <= 0 || p.Speed <= 0 || p.OutTime >= duration {
+		return 0
+	}
+
+	return (duration - p.OutTime) / p.Speed
+}
+
+// ReadFFmpegProgress parses ffmpeg progress stream
+// and calls onProgress for each completed block
+func ReadFFmpegProgress(reader io.Reader, onProgress func(FFmpegProgress)) error {
+	var progress FFmpegProgress
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		separatorIndex := strings.Index(line, "=")
+		if separatorIndex == -1 {
+			continue
+		}
+
+		key, value := line[:separatorIndex], strings.TrimSpace(line[separatorIndex+1:])
+
+		switch key {
+		case "frame":
+			if frame, err := strconv.ParseUint(value, 10, 64); err == nil {
+				progress.Frame = uint(frame)
+			}
+		case "out_time":
+			if outTime, ok := parseFFmpegTimestamp(value); ok {
+				progress.OutTime = outTime
+			}
+		case "speed":
+			if speed, err := strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64); err == nil {
+				progress.Speed = speed
+			}
+		case "progress":
+			progress.IsEnd = value == "end"
+			onProgress(progress)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// parseFFmpegTimestamp converts HH:MM:SS.micro timestamp to seconds
+func parseFFmpegTimestamp(timestamp string) (float64, bool) {
+	isNegative := strings.HasPrefix(timestamp, "-")
+	parts := strings.Split(strings.TrimPrefix(timestamp, "-"), ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+
+	seconds := 0.0
+	for _, part := range parts {
+		value, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, false
+		}
+
+		seconds = seconds*60 + value
+	}
+
+	if isNegative {
+		return 0, true
+	}
+
+	return seconds, true
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+)
+
+// testProgressOutput is captured from ffmpeg -progress pipe:1, the first block
+// is written before any frame is encoded
+const testProgressOutput = `frame=0
+fps=0.00
+stream_0_0_q=0.0
+bitrate=N/A
+total_size=48
+out_time_us=-9223372036854775807
+out_time_ms=-9223372036854775807
+out_time=-2562047:47:16.854775
+dup_frames=0
+drop_frames=0
+speed=N/A
+progress=continue
+frame=120
+fps=0.00
+stream_0_0_q=28.0
+bitrate= 180.4kbits/s
+total_size=111872
+out_time_us=4960000
+out_time_ms=4960000
+out_time=00:00:04.960000
+dup_frames=0
+drop_frames=0
+speed=9.89x
+progress=continue
+frame=300
+fps=238.41
+stream_0_0_q=-1.0
+bitrate= 195.2kbits/s
+total_size=292800
+out_time_us=12000000
+out_time_ms=12000000
+out_time=00:00:12.000000
+dup_frames=0
+drop_frames=0
+speed=10.1x
+progress=end
+`
+
+func TestReadFFmpegProgress(t *testing.T) {
+	var blocks []FFmpegProgress
+
+	err := ReadFFmpegProgress(strings.NewReader(testProgressOutput), func(progress FFmpegProgress) {
+		blocks = append(blocks, progress)
+	})
+	if err != nil {
+		t.Fatalf("ReadFFmpegProgress failed: %v", err)
+	}
+
+	expected := []FFmpegProgress{
+		{Frame: 0, OutTime: 0, Speed: 0},
+		{Frame: 120, OutTime: 4.96, Speed: 9.89},
+		{Frame: 300, OutTime: 12, Speed: 10.1, IsEnd: true},
+	}
+
+	if !reflect.DeepEqual(blocks, expected) {
+		t.Errorf("progress blocks\n got: %+v\nwant: %+v", blocks, expected)
+	}
+}
+
+func TestParseFFmpegTimestamp(t *testing.T) {
+	tests := []struct {
+		timestamp       string
+		expectedSeconds float64
+		isValid         bool
+	}{
+		{"00:00:04.960000", 4.96, true},
+		{"01:02:03.500000", 3723.5, true},
+		{"-2562047:47:16.854775", 0, true},
+		{"-00:00:00.040000", 0, true},
+		{"N/A", 0, false},
+		{"04.960000", 0, false},
+		{"00:aa:04", 0, false},
+	}
+
+	for _, test := range tests {
+		seconds, ok := parseFFmpegTimestamp(test.timestamp)
+
+		if ok != test.isValid || seconds != test.expectedSeconds {
+			t.Errorf("parseFFmpegTimestamp(%q) = %v, %t, want %v, %t", test.timestamp, seconds, ok, test.expectedSeconds, test.isValid)
+		}
+	}
+}
+
+func TestFFmpegProgressPercentETA(t *testing.T) {
+	tests := []struct {
+		name            string
+		progress        FFmpegProgress
+		duration        float64
+		expectedPercent float64
+		expectedETA     float64
+	}{
+		{"halfway", FFmpegProgress{OutTime: 5, Speed: 2}, 10, 50, 2.5},
+		{"unknown speed", FFmpegProgress{OutTime: 5}, 10, 50, 0},
+		{"unknown duration", FFmpegProgress{OutTime: 5, Speed: 2}, 0, 0, 0},
+		{"past duration", FFmpegProgress{OutTime: 10.5, Speed: 2}, 10, 100, 0},
+		{"end", FFmpegProgress{OutTime: 9.9, Speed: 2, IsEnd: true}, 10, 100, 0},
+		{"end of unknown duration", FFmpegProgress{IsEnd: true}, 0, 100, 0},
+	}
+
+	for _, test := range tests {
+		if percent := test.progress.Percent(test.duration); percent != test.expectedPercent {
+			t.Errorf("%s: Percent = %v, want %v", test.name, percent, test.expectedPercent)
+		}
+
+		if eta := test.progress.ETA(test.duration); eta != test.expectedETA {
+			t.Errorf("%s: ETA = %v, want %v", test.name, eta, test.expectedETA)
+		}
+	}
+}
+
+func TestStreamDuration(t *testing.T) {
+	tests := []struct {
+		name             string
+		stream           entity.FFProbeStreamData
+		format           *entity.FFProbeFormatData
+		expectedDuration float64
+	}{
+		{"stream duration", entity.FFProbeStreamData{Duration: 12.5}, &entity.FFProbeFormatData{Duration: "13.000000"}, 12.5},
+		{"matroska stream without duration", entity.FFProbeStreamData{}, &entity.FFProbeFormatData{Duration: "60.040000"}, 60.04},
+		{"unknown container duration", entity.FFProbeStreamData{}, &entity.FFProbeFormatData{Duration: "N/A"}, 0},
+		{"no container", entity.FFProbeStreamData{}, nil, 0},
+	}
+
+	for _, test := range tests {
+		if duration := streamDuration(test.stream, test.format); duration != test.expectedDuration {
+			t.Errorf("%s: streamDuration = %v, want %v", test.name, duration, test.expectedDuration)
+		}
+	}
+}
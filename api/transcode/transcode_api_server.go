@@ -1,28 +1,62 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/n1207n/video-transcode-queue/api/common/database"
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+	"github.com/n1207n/video-transcode-queue/api/common/event"
+	"github.com/n1207n/video-transcode-queue/api/common/profile"
+	"github.com/n1207n/video-transcode-queue/api/common/schema"
+	"github.com/n1207n/video-transcode-queue/api/common/server"
+	"github.com/n1207n/video-transcode-queue/api/common/storage"
+	"github.com/n1207n/video-transcode-queue/api/common/webhook"
 
 	"go.uber.org/zap"
 )
 
 var (
-	pgDb, pgUser, pgPassword, pgHost string
-	uploadFolderPath                 string
-	logger                           *zap.SugaredLogger
+	pgDb, pgUser, pgPassword, pgHost   string
+	redisURL, redisPort, redisPassword string
+	uploadFolderPath                   string
+	scratchFolderPath                  = filepath.Join(os.TempDir(), "transcode")
+	videoStorage                       storage.Storage
+	encodingProfilesPath               string
+	encodingProfiles                   profile.Config
+	transcodeWorkerCount               = 2
+	transcodeQueueSize                 = 32
+	webhooks                           *webhook.Dispatcher
+	shutdownTimeout                    = server.DefaultShutdownTimeout
+	logger                             *zap.SugaredLogger
 )
 
 func main() {
 	loadEnvironmentVariables()
+	loadEncodingProfiles()
 	startTranscodeAPIServer()
 }
 
+// loadEncodingProfiles reads the encoding ladder
+// used to render uploaded videos
+func loadEncodingProfiles() {
+	config, err := profile.Load(encodingProfilesPath)
+	if err != nil {
+		panic(err)
+	}
+
+	encodingProfiles = config
+}
+
 // loadEnvironmentVariables loads PostgreSQL
 // information from dotenv
 func loadEnvironmentVariables() {
@@ -50,6 +84,74 @@ func loadEnvironmentVariables() {
 	if len(uploadFolderPath) == 0 {
 		panic("No UPLOAD_FOLDER_PATH environment variable")
 	}
+
+	// Sources are downloaded to and rendered in the scratch folder,
+	// it only needs room for the jobs running at once
+	if scratchPath := os.Getenv("TRANSCODE_SCRATCH_PATH"); len(scratchPath) != 0 {
+		scratchFolderPath = scratchPath
+	}
+
+	encodingProfilesPath = os.Getenv("ENCODING_PROFILES_PATH")
+	if len(encodingProfilesPath) == 0 {
+		panic("No ENCODING_PROFILES_PATH environment variable")
+	}
+
+	// Redis only carries video events, they are disabled without it
+	redisURL = os.Getenv("REDIS_URL")
+	if len(redisURL) != 0 {
+		redisPort = os.Getenv("REDIS_PORT")
+		if len(redisPort) == 0 {
+			panic("No REDIS_PORT environment variable")
+		}
+
+		redisPassword = os.Getenv("REDIS_PASSWORD")
+		if len(redisPassword) == 0 {
+			panic("No REDIS_PASSWORD environment variable")
+		}
+	}
+
+	if workerCount := os.Getenv("TRANSCODE_WORKER_COUNT"); len(workerCount) != 0 {
+		count, err := strconv.Atoi(workerCount)
+		if err != nil || count < 1 {
+			panic("Invalid TRANSCODE_WORKER_COUNT environment variable")
+		}
+
+		transcodeWorkerCount = count
+	}
+
+	if queueSize := os.Getenv("TRANSCODE_QUEUE_SIZE"); len(queueSize) != 0 {
+		size, err := strconv.Atoi(queueSize)
+		if err != nil || size < 1 {
+			panic("Invalid TRANSCODE_QUEUE_SIZE environment variable")
+		}
+
+		transcodeQueueSize = size
+	}
+
+	if timeout := os.Getenv("SHUTDOWN_TIMEOUT"); len(timeout) != 0 {
+		duration, err := time.ParseDuration(timeout)
+		if err != nil || duration <= 0 {
+			panic("Invalid SHUTDOWN_TIMEOUT environment variable")
+		}
+
+		shutdownTimeout = duration
+	}
+}
+
+// openStorage connects to the configured storage of video files,
+// the local one is the upload folder
+func openStorage() storage.Storage {
+	config, err := storage.ConfigFromEnvironment(uploadFolderPath, "")
+	if err != nil {
+		panic(err)
+	}
+
+	videoStorage, err := storage.New(config)
+	if err != nil {
+		panic(err)
+	}
+
+	return videoStorage
 }
 
 func startTranscodeAPIServer() {
@@ -59,6 +161,17 @@ func startTranscodeAPIServer() {
 	logger = log.Sugar()
 	logger.Info("Starting transcode API server")
 
+	openEventPublisher()
+	videoStorage = openStorage()
+
+	webhooks = webhook.NewDispatcher(func() *gorm.DB {
+		return database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	}, logger)
+	webhooks.Start()
+
+	startTranscodeWorkers(transcodeWorkerCount, transcodeQueueSize)
+	resumeTranscodeJobs()
+
 	// Creates a gin router with default middleware:
 	// logger and recovery (crash-free) middleware
 	router := gin.Default()
@@ -66,96 +179,327 @@ func startTranscodeAPIServer() {
 	v1 := router.Group("/api/v1")
 	{
 		v1.POST("/video-transcode", transcodeVideo)
+		v1.GET("/jobs/:id", getJobDetail)
+		v1.POST("/jobs/:id/cancel", cancelJob)
 	}
 
-	// By default it serves on :8080
-	router.Run(":8800")
+	httpServer := &http.Server{
+		Addr:    ":8800",
+		Handler: router,
+	}
+
+	if err := server.RunGracefully(httpServer, shutdownTimeout, nil, logger); err != nil && err != http.ErrServerClosed {
+		logger.Errorf("Transcode API server stopped: %s", err.Error())
+	}
+
+	stopTranscodeWorkers(shutdownTimeout)
+
+	// Workers notify until they stop, so webhooks are stopped after them
+	if !webhooks.Stop(shutdownTimeout) {
+		logger.Warnf("Webhook deliveries still running after %s, unfinished attempts are made on restart", shutdownTimeout)
+	}
 }
 
 func transcodeVideo(c *gin.Context) {
-	var request TranscodeRequest
+	var request schema.TranscodeRequest
+
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+
+	videoID, err := strconv.Atoi(request.VideoID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	if _, err = database.GetVideoObject(videoID, connection); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	if _, err = encodingProfiles.Resolve(request.EncodingLadder, request.Renditions); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	// A retried or repeated task gets the job created for it the first time
+	if existingJob, ok := findIdempotentJob(request.IdempotencyKey); ok {
+		respondDuplicateJob(c, existingJob)
+		return
+	}
+
+	job := entity.TranscodeJob{
+		VideoID:        uint(videoID),
+		FilePath:       request.Path,
+		State:          entity.JobStateQueued,
+		EncodingLadder: request.EncodingLadder,
+		Renditions:     request.Renditions,
+		IdempotencyKey: request.IdempotencyKey,
+		Transitions: []entity.TranscodeJobTransition{
+			{ToState: entity.JobStateQueued},
+		},
+	}
+
+	connection = database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	job, err = database.CreateTranscodeJobObject(job, connection)
+	if err != nil {
+		// Another transcoder created the job of the same key meanwhile
+		if existingJob, ok := findIdempotentJob(request.IdempotencyKey); ok {
+			respondDuplicateJob(c, existingJob)
+			return
+		}
+
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	supersedeQueuedJobs(job)
+
+	if !enqueueTranscodeJob(job.ID) {
+		// The task is retried later, which must create a new job
+		if len(job.IdempotencyKey) != 0 {
+			job.IdempotencyKey = ""
+			connection = database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+			database.UpdateTranscodeJobObject(job, connection)
+		}
+
+		UpdateJobState(job.ID, entity.JobStateFailed, "transcode workers are busy", getDBConnectionInfo(), logger)
+
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"job_id":  job.ID,
+			"message": "Transcode workers are busy. Please try later.",
+		})
 
-	if c.BindJSON(&request) == nil {
-		// TODO: Check if video id exists in PostgreSQL
+		return
+	}
+
+	logger.Infof("Transcode job queued: %s", job)
+
+	publishEvent(event.NewJobStateEvent(job))
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"job_id":   job.ID,
+		"video_id": request.VideoID,
+		"state":    job.State,
+	})
+}
 
-		performTranscoding(request, c)
+// findIdempotentJob returns the job created for given idempotency key, if any
+func findIdempotentJob(idempotencyKey string) (entity.TranscodeJob, bool) {
+	if len(idempotencyKey) == 0 {
+		return entity.TranscodeJob{}, false
 	}
+
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	job, err := database.GetTranscodeJobObjectByIdempotencyKey(idempotencyKey, connection)
+
+	return job, err == nil
+}
+
+// respondDuplicateJob accepts a duplicate request without creating a job
+func respondDuplicateJob(c *gin.Context, job entity.TranscodeJob) {
+	logger.Infof("Duplicate transcode request of %s", job)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"job_id":    job.ID,
+		"video_id":  strconv.Itoa(int(job.VideoID)),
+		"state":     job.State,
+		"duplicate": true,
+	})
 }
 
-// TranscodeRequest represents a JSON POST data for video-transcode API
-type TranscodeRequest struct {
-	Path    string `json:"path" binding:"required"`
-	VideoID string `json:"video_id" binding:"required"`
+// supersedeQueuedJobs cancels older jobs of the same video which didn't start yet,
+// as the new job transcodes the latest upload and settings anyway.
+// Older jobs already running finish first, the video lock keeps the new one waiting.
+func supersedeQueuedJobs(job entity.TranscodeJob) {
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	queuedJobs, err := database.GetVideoTranscodeJobObjectsByState(job.VideoID, []string{entity.JobStateQueued}, connection)
+	if err != nil {
+		logger.Warnf("Failed to load queued jobs of video %d: %s", job.VideoID, err.Error())
+		return
+	}
+
+	for _, queuedJob := range queuedJobs {
+		if queuedJob.ID >= job.ID {
+			continue
+		}
+
+		// A worker may have started the job meanwhile, then the transition is refused
+		connection = database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+		cancelledJob, err := database.TransitionTranscodeJob(queuedJob.ID, entity.JobStateCancelled, fmt.Sprintf("superseded by job %d", job.ID), connection)
+		if err != nil {
+			continue
+		}
+
+		logger.Infof("%s superseded by job %d", cancelledJob, job.ID)
+		publishEvent(event.NewJobStateEvent(cancelledJob))
+	}
+}
+
+func getJobDetail(c *gin.Context) {
+	jobID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	job, err := database.GetTranscodeJobObject(jobID, connection)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+	} else {
+		c.JSON(http.StatusOK, gin.H{
+			"data": job,
+		})
+	}
+}
+
+func cancelJob(c *gin.Context) {
+	jobID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	job, err := database.TransitionTranscodeJob(uint(jobID), entity.JobStateCancelled, "cancelled by request", connection)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+	} else {
+		if stopRunningJob(job.ID) {
+			logger.Infof("Stopped running %s", job)
+		}
+
+		publishEvent(event.NewJobStateEvent(job))
+
+		c.JSON(http.StatusOK, gin.H{
+			"data": job,
+		})
+	}
 }
 
-func performTranscoding(request TranscodeRequest, c *gin.Context) (transcodedFilePaths []string, transcodeError error) {
-	splitStringPaths := strings.Split(request.Path, "/")
-	fileFolderPath := strings.Join(splitStringPaths[:len(splitStringPaths)-1], "/")
-	filename := splitStringPaths[len(splitStringPaths)-1]
+// performTranscoding renders the source file of a job in a scratch folder
+// and stores the renditions and manifests next to the source file.
+// Once ctx is done, running commands are killed and nothing more is stored.
+func performTranscoding(ctx context.Context, job entity.TranscodeJob) error {
+	// Jobs recorded before storage keys hold a path under the upload folder
+	sourceKey := storage.Key(job.FilePath, uploadFolderPath)
+	filename := path.Base(sourceKey)
+	outputKeyPrefix := path.Dir(sourceKey)
 
 	// Strip the file extension and convert any reverse subsequent dots to underscore
 	splitFilenameCharacters := strings.Split(filename, ".")
 	videoName := strings.Join(splitFilenameCharacters[:len(splitFilenameCharacters)-1], "_")
 
-	videoID, _ := strconv.Atoi(request.VideoID)
+	videoID := int(job.VideoID)
+	dbConnectionInfo := getDBConnectionInfo()
 
-	var waitGroup sync.WaitGroup
+	if err := UpdateJobState(job.ID, entity.JobStateProbing, "", dbConnectionInfo, logger); err != nil {
+		return err
+	}
+
+	fileFolderPath := filepath.Join(scratchFolderPath, strconv.Itoa(int(job.ID)))
+
+	// Leftovers of a job interrupted by a restart are started over
+	os.RemoveAll(fileFolderPath)
+	defer os.RemoveAll(fileFolderPath)
+
+	if err := storage.GetFile(videoStorage, sourceKey, filepath.Join(fileFolderPath, filename)); err != nil {
+		return fmt.Errorf("failed to download source file %s: %s", sourceKey, err.Error())
+	}
 
-	_, height, err := GetVideoDimensionInfo(filename, fileFolderPath, logger)
+	stream, err := GetVideoStreamInfo(ctx, filename, fileFolderPath, logger)
 	if err != nil {
 		logger.Errorf("Error from getting video dimension info: %s\n", err.Error())
 
-		c.JSON(http.StatusBadRequest, gin.H{"video_id": request.VideoID, "status": "Failed to get video metadata. Corrupted file?"})
-
 		// TODO: Delete the video file
-	} else {
-		var targets []int
-		dbConnectionInfo := map[string]string{
-			"pgDb":       pgDb,
-			"pgUser":     pgUser,
-			"pgPassword": pgPassword,
-			"pgHost":     pgHost,
-		}
+		return fmt.Errorf("failed to get video metadata, corrupted file?: %s", err.Error())
+	}
 
-		if height >= 720 {
-			targets = append(targets, 720)
-		}
+	profiles, err := encodingProfiles.Resolve(job.EncodingLadder, job.Renditions)
+	if err != nil {
+		return err
+	}
 
-		if height >= 540 {
-			targets = append(targets, 540)
-		}
+	targets := profile.SelectForHeight(profiles, *stream.Height)
 
-		if height >= 360 {
-			targets = append(targets, 360)
-		}
+	if err := UpdateJobState(job.ID, entity.JobStateEncoding, "", dbConnectionInfo, logger); err != nil {
+		return err
+	}
 
-		if height < 360 {
-			targets = append(targets, 360)
-		}
+	// The first failed rendition stops the others, the job fails once with its error
+	renditionCtx, cancelRenditions := context.WithCancel(ctx)
+	defer cancelRenditions()
+
+	renditionErrors := make(chan error, len(targets))
+
+	for _, target := range targets {
+		go func(target entity.EncodingProfile) {
+			renditionErrors <- TranscodeRendition(renditionCtx, job.ID, target, videoName, videoID, filename, fileFolderPath, stream.Duration, dbConnectionInfo, logger)
+		}(target)
+	}
 
-		waitGroup.Add(len(targets))
-
-		for _, target := range targets {
-			switch target {
-			case 720:
-				go TranscodeToHD720P(videoName, videoID, filename, fileFolderPath, dbConnectionInfo, &waitGroup, logger)
-			case 540:
-				go TranscodeToSD540P(videoName, videoID, filename, fileFolderPath, dbConnectionInfo, &waitGroup, logger)
-			case 360:
-				go TranscodeToSD360P(videoName, videoID, filename, fileFolderPath, dbConnectionInfo, &waitGroup, logger)
-			default:
-				go TranscodeToSD360P(videoName, videoID, filename, fileFolderPath, dbConnectionInfo, &waitGroup, logger)
-			}
+	var renditionErr error
+
+	for range targets {
+		if err := <-renditionErrors; err != nil && renditionErr == nil {
+			renditionErr = err
+			cancelRenditions()
 		}
+	}
 
-		waitGroup.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 
-		c.JSON(http.StatusOK, gin.H{"video_id": request.VideoID, "status": "In progress"})
+	if renditionErr != nil {
+		return renditionErr
+	}
 
-		logger.Infof("Constructing MPD for %s", videoName)
+	if err := UpdateJobState(job.ID, entity.JobStatePackaging, "", dbConnectionInfo, logger); err != nil {
+		return err
+	}
+
+	logger.Infof("Constructing MPD for %s", videoName)
+
+	mpdFilePath, err := ConstructMPD(ctx, videoName, videoID, fileFolderPath, targets, dbConnectionInfo, logger)
+	if err != nil {
+		return err
+	}
+
+	// The HLS master playlist lists the codecs DASH packaging recorded
+	hlsManifestPath, err := ConstructHLS(ctx, videoName, videoID, fileFolderPath, targets, dbConnectionInfo, logger)
+	if err != nil {
+		return err
+	}
 
-		ConstructMPD(videoName, videoID, filename, fileFolderPath, targets, dbConnectionInfo, logger)
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
 
-	return
+	return publishTranscodeOutputs(job, fileFolderPath, filename, outputKeyPrefix, mpdFilePath, hlsManifestPath)
 }
@@ -1,26 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os/exec"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/n1207n/video-transcode-queue/api/common/database"
 	"github.com/n1207n/video-transcode-queue/api/common/entity"
+	"github.com/n1207n/video-transcode-queue/api/common/event"
+	"github.com/n1207n/video-transcode-queue/api/common/mpd"
 
 	"go.uber.org/zap"
 )
 
-// ExecuteCLI executes constructed command string by os.exec.Command
-func ExecuteCLI(commandString string, returnOutput bool) ([]byte, error) {
+// ExecuteCLI executes constructed command string by os.exec.Command,
+// the command is killed once ctx is done
+func ExecuteCLI(ctx context.Context, commandString string, returnOutput bool) ([]byte, error) {
 	commandArguments := strings.Fields(commandString)
 	head, commandArguments := commandArguments[0], commandArguments[1:]
 
-	cmd := exec.Command(head, commandArguments...)
+	cmd := exec.CommandContext(ctx, head, commandArguments...)
 	outputBytes, err := cmd.Output()
 
 	if err != nil {
@@ -30,19 +35,47 @@ func ExecuteCLI(commandString string, returnOutput bool) ([]byte, error) {
 	return outputBytes, nil
 }
 
-// GetVideoDimensionInfo extracts video width and height values
-func GetVideoDimensionInfo(filename string, folderPath string, logger *zap.SugaredLogger) (int, int, error) {
-	logger.Infof("Getting video resolution info: %s/%s\n", folderPath, filename)
+// ExecuteCLIWithProgress executes constructed ffmpeg command string
+// whose -progress output goes to stdout and reports each progress block
+func ExecuteCLIWithProgress(ctx context.Context, commandString string, onProgress func(FFmpegProgress)) error {
+	commandArguments := strings.Fields(commandString)
+	head, commandArguments := commandArguments[0], commandArguments[1:]
+
+	cmd := exec.CommandContext(ctx, head, commandArguments...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	readErr := ReadFFmpegProgress(stdout, onProgress)
+
+	if err = cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+
+	return readErr
+}
 
-	ffprobeCommand := fmt.Sprintf("ffprobe -show_streams -print_format json -v quiet %s/%s", folderPath, filename)
+// GetVideoStreamInfo returns ffprobe data of the first video stream,
+// its Duration taken from the container if the stream has none
+func GetVideoStreamInfo(ctx context.Context, filename string, folderPath string, logger *zap.SugaredLogger) (entity.FFProbeStreamData, error) {
+	logger.Infof("Getting video stream info: %s/%s\n", folderPath, filename)
 
-	width, height := -1, -1
+	ffprobeCommand := fmt.Sprintf("ffprobe -show_streams -show_format -print_format json -v quiet %s/%s", folderPath, filename)
 
-	outputBytes, err := ExecuteCLI(ffprobeCommand, true)
+	outputBytes, err := ExecuteCLI(ctx, ffprobeCommand, true)
 	if err != nil {
 		logger.Errorf("Error during command execution: %s\nError: %s", ffprobeCommand, err.Error())
 
-		return width, height, err
+		return entity.FFProbeStreamData{}, err
 	}
 
 	var probeData entity.ProbeData
@@ -51,58 +84,120 @@ func GetVideoDimensionInfo(filename string, folderPath string, logger *zap.Sugar
 	if err != nil {
 		logger.Errorf("ffprobe JSON parse error: %s\n", err.Error())
 
-		return width, height, err
+		return entity.FFProbeStreamData{}, err
 	}
 
 	for index := 0; index < len(probeData.Stream); index++ {
 		stream := probeData.Stream[index]
 
-		if stream.Width != nil {
-			width = *probeData.Stream[0].Width
-			height = *probeData.Stream[0].Height
-			break
+		if stream.Width != nil && stream.Height != nil {
+			stream.Duration = streamDuration(stream, probeData.Format)
+			return stream, nil
 		}
 	}
 
-	if width == -1 {
-		return width, height, errors.New("no video stream found from file")
+	return entity.FFProbeStreamData{}, errors.New("no video stream found from file")
+}
+
+// streamDuration returns the duration of a stream in seconds. Matroska and WebM
+// streams usually have none, so the duration of the container is used for them.
+func streamDuration(stream entity.FFProbeStreamData, format *entity.FFProbeFormatData) float64 {
+	if stream.Duration > 0 || format == nil {
+		return stream.Duration
+	}
+
+	return format.DurationAsObject().Seconds()
+}
+
+// GetVideoDimensionInfo extracts video width and height values
+func GetVideoDimensionInfo(ctx context.Context, filename string, folderPath string, logger *zap.SugaredLogger) (int, int, error) {
+	stream, err := GetVideoStreamInfo(ctx, filename, folderPath, logger)
+	if err != nil {
+		return -1, -1, err
 	}
 
-	return width, height, nil
+	return *stream.Width, *stream.Height, nil
 }
 
-// TranscodeToSD360P transcodes video file to 360P
-func TranscodeToSD360P(videoName string, videoID int, filename string, folderPath string, dbConnectionInfo map[string]string, waitGroup *sync.WaitGroup, logger *zap.SugaredLogger) {
-	logger.Infof("Transcoding to SD 360P: %s\n", videoName)
+// BuildFFmpegCommand constructs ffmpeg command string
+// rendering a source file with given EncodingProfile
+func BuildFFmpegCommand(profile entity.EncodingProfile, sourceFilePath string, transcodedFilePath string) string {
+	return fmt.Sprintf(
+		"ffmpeg -y -nostats -progress pipe:1 -i %s -c:a %s -ac %d -b:a %dk -c:v %s -preset %s -g %d -keyint_min %d -sc_threshold 0 -b:v %dk -maxrate %dk -bufsize %dk -vf scale=-2:%d %s",
+		sourceFilePath,
+		profile.AudioCodec,
+		profile.AudioChannels,
+		profile.AudioBitrateKbps,
+		profile.VideoCodec,
+		profile.Preset,
+		profile.KeyframeInterval,
+		profile.KeyframeInterval,
+		profile.VideoBitrateKbps,
+		profile.MaxRateKbps,
+		profile.BufSizeKbps,
+		profile.Height,
+		transcodedFilePath,
+	)
+}
 
-	defer waitGroup.Done()
+// TranscodeRendition transcodes video file with given EncodingProfile
+// and records its progress against the source duration
+func TranscodeRendition(ctx context.Context, jobID uint, profile entity.EncodingProfile, videoName string, videoID int, filename string, folderPath string, duration float64, dbConnectionInfo map[string]string, logger *zap.SugaredLogger) error {
+	logger.Infof("Transcoding to %s: %s\n", profile.Name, videoName)
 
-	transcodedFileName := fmt.Sprintf("%s/%s_360.mp4", folderPath, videoName)
+	renderingTitle := fmt.Sprintf("%s_%s", videoName, profile.Name)
+	transcodedFileName := fmt.Sprintf("%s/%s.mp4", folderPath, renderingTitle)
 
-	ffmpegCommand360P := fmt.Sprintf("ffmpeg -y -i %s/%s -c:a libfdk_aac -ac 2 -ab 128k -preset slow -c:v libx264 -x264opts keyint=24:min-keyint=24:no-scenecut -b:v 400k -maxrate 400k -bufsize 400k -vf scale=-1:360 -pass 1 %s", folderPath, filename, transcodedFileName)
+	ffmpegCommand := BuildFFmpegCommand(profile, fmt.Sprintf("%s/%s", folderPath, filename), transcodedFileName)
 
-	_, err := ExecuteCLI(ffmpegCommand360P, false)
+	renderingProgress := entity.RenderingProgress{
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+		JobID:       jobID,
+		VideoID:     uint(videoID),
+		ProfileName: profile.Name,
+		Duration:    duration,
+	}
+	renderingProgress = saveRenderingProgress(renderingProgress, dbConnectionInfo, logger)
+
+	var lastSavedAt time.Time
+
+	err := ExecuteCLIWithProgress(ctx, ffmpegCommand, func(progress FFmpegProgress) {
+		renderingProgress.UpdatedAt = time.Now()
+		renderingProgress.Frame = progress.Frame
+		renderingProgress.OutTime = progress.OutTime
+		renderingProgress.Speed = progress.Speed
+		renderingProgress.Percent = progress.Percent(duration)
+		renderingProgress.ETASeconds = progress.ETA(duration)
+		renderingProgress.IsDone = progress.IsEnd
+
+		if progress.IsEnd || time.Since(lastSavedAt) >= progressUpdateInterval {
+			renderingProgress = saveRenderingProgress(renderingProgress, dbConnectionInfo, logger)
+			lastSavedAt = time.Now()
+		}
+	})
 	if err != nil {
-		logger.Errorf("Error during command execution: %s\nError: %s", ffmpegCommand360P, err.Error())
-		return
+		logger.Errorf("Error during command execution: %s\nError: %s", ffmpegCommand, err.Error())
+		return fmt.Errorf("%s rendering failed: %s", profile.Name, err.Error())
 	}
 
-	logger.Infof("Transcoded to SD 360P: %s\n", videoName)
+	logger.Infof("Transcoded to %s: %s\n", profile.Name, videoName)
 
-	width, height, err := GetVideoDimensionInfo(videoName+"_360.mp4", folderPath, logger)
+	width, height, err := GetVideoDimensionInfo(ctx, renderingTitle+".mp4", folderPath, logger)
 	if err != nil {
 		logger.Errorf("Error from getting video dimension info: %s\n", err.Error())
-		return
+		return fmt.Errorf("%s rendering is unreadable: %s", profile.Name, err.Error())
 	}
 
 	videoRendering := entity.VideoRendering{
 		CreatedAt:      time.Now(),
 		UpdatedAt:      time.Now(),
-		RenderingTitle: fmt.Sprintf("%s_360", videoName),
-		FilePath:       fmt.Sprintf("%s/%s_360.mp4", folderPath, videoName),
-		URL:            fmt.Sprintf("%s/%s_360.mp4", folderPath, videoName),
+		RenderingTitle: renderingTitle,
+		FilePath:       transcodedFileName,
+		URL:            transcodedFileName,
 		Width:          uint(width),
 		Height:         uint(height),
+		MediaType:      entity.MediaTypeVideo,
 		VideoID:        uint(videoID),
 	}
 
@@ -112,45 +207,44 @@ func TranscodeToSD360P(videoName string, videoID int, filename string, folderPat
 	pgHost := dbConnectionInfo["pgHost"]
 
 	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
-	database.CreateVideoRenderingObject(videoRendering, connection)
+	videoRendering, err = database.CreateVideoRenderingObject(videoRendering, connection)
+	if err != nil {
+		logger.Errorf("Video rendering object Create failed: %s\n", err.Error())
+		return fmt.Errorf("%s rendering record failed: %s", profile.Name, err.Error())
+	}
 
-	logger.Infof("Added DB record for SD 360P: %s\n", videoName)
-}
+	logger.Infof("Added DB record for %s: %s\n", profile.Name, videoName)
 
-// TranscodeToSD540P transcodes video file to 540P
-func TranscodeToSD540P(videoName string, videoID int, filename string, folderPath string, dbConnectionInfo map[string]string, waitGroup *sync.WaitGroup, logger *zap.SugaredLogger) {
-	logger.Infof("Transcoding to SD 540P: %s\n", videoName)
+	webhooks.Notify(entity.WebhookEventRenderingFinished, uint(videoID), jobID, videoRendering)
 
-	defer waitGroup.Done()
+	return nil
+}
 
-	transcodedFileName := fmt.Sprintf("%s/%s_540.mp4", folderPath, videoName)
+// renderingsOfFolder maps renderings of a video by title. Renderings of an earlier job
+// share titles with the ones rendered in folderPath, which are preferred.
+func renderingsOfFolder(renderings []entity.VideoRendering, folderPath string) map[string]entity.VideoRendering {
+	renderingsByTitle := map[string]entity.VideoRendering{}
 
-	ffmpegCommand540P := fmt.Sprintf("ffmpeg -y -i %s/%s -c:a libfdk_aac -ac 2 -ab 128k -preset slow -c:v libx264 -x264opts keyint=24:min-keyint=24:no-scenecut -b:v 800k -maxrate 800k -bufsize 500k -vf scale=-1:540 -pass 1 %s", folderPath, filename, transcodedFileName)
+	for _, rendering := range renderings {
+		if _, ok := renderingsByTitle[rendering.RenderingTitle]; ok && !isInFolder(rendering, folderPath) {
+			continue
+		}
 
-	_, err := ExecuteCLI(ffmpegCommand540P, false)
-	if err != nil {
-		logger.Errorf("Error during command execution: %s\nError: %s", ffmpegCommand540P, err.Error())
-		return
+		renderingsByTitle[rendering.RenderingTitle] = rendering
 	}
 
-	logger.Infof("Transcoded to SD 540P: %s\n", videoName)
+	return renderingsByTitle
+}
 
-	width, height, err := GetVideoDimensionInfo(videoName+"_540.mp4", folderPath, logger)
-	if err != nil {
-		logger.Errorf("Error from getting video dimension info: %s\n", err.Error())
-		return
-	}
+// isInFolder tells if a rendering was rendered in given folder
+func isInFolder(rendering entity.VideoRendering, folderPath string) bool {
+	return strings.HasPrefix(rendering.FilePath, folderPath+"/")
+}
 
-	videoRendering := entity.VideoRendering{
-		CreatedAt:      time.Now(),
-		UpdatedAt:      time.Now(),
-		RenderingTitle: fmt.Sprintf("%s_540", videoName),
-		FilePath:       fmt.Sprintf("%s/%s_540.mp4", folderPath, videoName),
-		URL:            fmt.Sprintf("%s/%s_540.mp4", folderPath, videoName),
-		Width:          uint(width),
-		Height:         uint(height),
-		VideoID:        uint(videoID),
-	}
+// ConstructMPD packages renditions for DASH on-demand streaming
+// and writes the MPD file describing them, returning its path
+func ConstructMPD(ctx context.Context, videoName string, videoID int, folderPath string, transcodeTargets []entity.EncodingProfile, dbConnectionInfo map[string]string, logger *zap.SugaredLogger) (string, error) {
+	logger.Infof("Constructing MPD file: %s\n", videoName)
 
 	pgDb := dbConnectionInfo["pgDb"]
 	pgUser := dbConnectionInfo["pgUser"]
@@ -158,107 +252,155 @@ func TranscodeToSD540P(videoName string, videoID int, filename string, folderPat
 	pgHost := dbConnectionInfo["pgHost"]
 
 	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
-	database.CreateVideoRenderingObject(videoRendering, connection)
+	object, err := database.GetVideoObject(videoID, connection)
+	if err != nil {
+		logger.Errorw("Video object GET failed for updating:", err.Error())
+		return "", err
+	}
 
-	logger.Infof("Added DB record for SD 540P: %s\n", videoName)
-}
+	renderingsByTitle := renderingsOfFolder(object.Renderings, folderPath)
 
-// TranscodeToHD720P transcodes video file to 720P
-func TranscodeToHD720P(videoName string, videoID int, filename string, folderPath string, dbConnectionInfo map[string]string, waitGroup *sync.WaitGroup, logger *zap.SugaredLogger) {
-	logger.Infof("Transcoding to HD 720P: %s\n", videoName)
+	var dashRenderings []entity.VideoRendering
 
-	defer waitGroup.Done()
+	for _, profile := range transcodeTargets {
+		rendering, ok := renderingsByTitle[fmt.Sprintf("%s_%s", videoName, profile.Name)]
+		if !ok {
+			return "", fmt.Errorf("no rendering found for %s", profile.Name)
+		}
+
+		rendering.MediaType = entity.MediaTypeVideo
+		rendering.Bandwidth = uint(profile.MaxRateKbps * 1000)
+		rendering.DashFilePath = fmt.Sprintf("%s/%s_dash.mp4", folderPath, rendering.RenderingTitle)
+
+		if err = packageDASHTrack(ctx, rendering.FilePath, "v", &rendering, logger); err != nil {
+			return "", err
+		}
+
+		connection = database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+		if rendering, err = database.UpdateVideoRenderingObject(rendering, connection); err != nil {
+			logger.Errorw("Video rendering object Update failed:", err.Error())
+			return "", err
+		}
+
+		dashRenderings = append(dashRenderings, rendering)
+	}
 
-	transcodedFileName := fmt.Sprintf("%s/%s_720.mp4", folderPath, videoName)
+	// All renditions share the same audio settings,
+	// so one audio track is enough for every video representation
+	if len(transcodeTargets) > 0 {
+		topProfile := transcodeTargets[0]
+
+		audioRendering := renderingsByTitle[fmt.Sprintf("%s_audio", videoName)]
+		audioRendering.CreatedAt = time.Now()
+		audioRendering.UpdatedAt = time.Now()
+		audioRendering.RenderingTitle = fmt.Sprintf("%s_audio", videoName)
+		audioRendering.MediaType = entity.MediaTypeAudio
+		audioRendering.VideoID = uint(videoID)
+		audioRendering.Bandwidth = uint(topProfile.AudioBitrateKbps * 1000)
+		audioRendering.DashFilePath = fmt.Sprintf("%s/%s_dash.mp4", folderPath, audioRendering.RenderingTitle)
+		audioRendering.FilePath = audioRendering.DashFilePath
+		audioRendering.URL = audioRendering.DashFilePath
+
+		if err = packageDASHTrack(ctx, fmt.Sprintf("%s/%s_%s.mp4", folderPath, videoName, topProfile.Name), "a", &audioRendering, logger); err != nil {
+			logger.Warnf("No audio track packaged for %s: %s\n", videoName, err.Error())
+		} else {
+			connection = database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+			if audioRendering, err = database.UpdateVideoRenderingObject(audioRendering, connection); err != nil {
+				logger.Errorw("Video rendering object Update failed:", err.Error())
+				return "", err
+			}
+
+			dashRenderings = append(dashRenderings, audioRendering)
+		}
+	}
 
-	ffmpegCommand720P := fmt.Sprintf("ffmpeg -y -i %s/%s -c:a libfdk_aac -ac 2 -ab 128k -preset slow -c:v libx264 -x264opts keyint=24:min-keyint=24:no-scenecut -b:v 1500k -maxrate 1500k -bufsize 1000k -vf scale=-1:720 -pass 1 %s", folderPath, filename, transcodedFileName)
+	manifest, err := mpd.BuildOnDemand(dashRenderings, mpd.DefaultMinBufferTime)
+	if err != nil {
+		return "", fmt.Errorf("MPD construction failed: %s", err.Error())
+	}
 
-	_, err := ExecuteCLI(ffmpegCommand720P, false)
+	manifestBytes, err := manifest.Marshal()
 	if err != nil {
-		logger.Errorf("Error during command execution: %s\nError: %s", ffmpegCommand720P, err.Error())
-		return
+		return "", fmt.Errorf("MPD construction failed: %s", err.Error())
+	}
+
+	mpdFilePath := fmt.Sprintf("%s/%s.mpd", folderPath, videoName)
+
+	if err = ioutil.WriteFile(mpdFilePath, manifestBytes, 0644); err != nil {
+		logger.Errorf("Failed to write MPD file: %s\n", err.Error())
+		return "", fmt.Errorf("MPD packaging failed: %s", err.Error())
 	}
 
-	logger.Infof("Transcoded to HD 720P: %s\n", videoName)
+	return mpdFilePath, nil
+}
+
+// packageDASHTrack remuxes one track of a rendition into a fragmented MP4 file
+// indexed by a sidx box and records its DASH metadata on the rendering
+func packageDASHTrack(ctx context.Context, sourceFilePath string, streamType string, rendering *entity.VideoRendering, logger *zap.SugaredLogger) error {
+	ffmpegCommand := fmt.Sprintf("ffmpeg -y -i %s -map 0:%s:0 -c copy -movflags +dash+frag_keyframe+global_sidx %s", sourceFilePath, streamType, rendering.DashFilePath)
 
-	width, height, err := GetVideoDimensionInfo(videoName+"_720.mp4", folderPath, logger)
+	_, err := ExecuteCLI(ctx, ffmpegCommand, false)
 	if err != nil {
-		logger.Errorf("Error from getting video dimension info: %s\n", err.Error())
-		return
+		logger.Errorf("Error during command execution: %s\nError: %s", ffmpegCommand, err.Error())
+		return fmt.Errorf("DASH packaging of %s failed: %s", rendering.RenderingTitle, err.Error())
 	}
 
-	videoRendering := entity.VideoRendering{
-		CreatedAt:      time.Now(),
-		UpdatedAt:      time.Now(),
-		RenderingTitle: fmt.Sprintf("%s_720", videoName),
-		FilePath:       fmt.Sprintf("%s/%s_720.mp4", folderPath, videoName),
-		URL:            fmt.Sprintf("%s/%s_720.mp4", folderPath, videoName),
-		Width:          uint(width),
-		Height:         uint(height),
-		VideoID:        uint(videoID),
+	info, err := mpd.InspectFile(rendering.DashFilePath)
+	if err != nil {
+		return fmt.Errorf("DASH packaging of %s is unreadable: %s", rendering.RenderingTitle, err.Error())
 	}
 
+	rendering.Codecs = info.Codecs
+	rendering.Duration = info.Duration
+	rendering.InitRange = info.InitRange
+	rendering.IndexRange = info.IndexRange
+	rendering.AudioSampleRate = info.AudioSampleRate
+	rendering.AudioChannels = info.AudioChannels
+
+	return nil
+}
+
+// UpdateJobState moves a TranscodeJob to given state.
+// A message is recorded along with failed or cancelled states.
+func UpdateJobState(jobID uint, state string, message string, dbConnectionInfo map[string]string, logger *zap.SugaredLogger) error {
 	pgDb := dbConnectionInfo["pgDb"]
 	pgUser := dbConnectionInfo["pgUser"]
 	pgPassword := dbConnectionInfo["pgPassword"]
 	pgHost := dbConnectionInfo["pgHost"]
 
 	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
-	database.CreateVideoRenderingObject(videoRendering, connection)
-
-	logger.Infof("Added DB record for HD 720P: %s\n", videoName)
-}
-
-// ConstructMPD creates MPD file for DASH streaming
-func ConstructMPD(videoName string, videoID int, filename string, folderPath string, transcodeTargets []int, dbConnectionInfo map[string]string, logger *zap.SugaredLogger) {
-	logger.Infof("Constructing MPD file: %s\n", videoName)
+	job, err := database.TransitionTranscodeJob(jobID, state, message, connection)
+	if err != nil {
+		logger.Warnf("Transcode job %d state not updated to %s: %s\n", jobID, state, err.Error())
+		return err
+	}
 
-	filePath := fmt.Sprintf("%s/%s", folderPath, videoName)
+	logger.Infof("Transcode job state updated: %s %s\n", job, message)
 
-	mp4boxCommand := fmt.Sprintf("MP4Box -dash 3000 -frag 3000 -rap -profile dashavc264:onDemand -out %s.mpd", filePath)
+	publishEvent(event.NewJobStateEvent(job))
 
-	// Appending video streams for each transcoded size
-	for _, resize := range transcodeTargets {
-		mp4boxCommand += fmt.Sprintf(" %s_%d.mp4#video", filePath, resize)
+	switch job.State {
+	case entity.JobStateProbing:
+		webhooks.Notify(entity.WebhookEventTranscodeStarted, job.VideoID, job.ID, job)
+	case entity.JobStateFailed:
+		webhooks.Notify(entity.WebhookEventVideoFailed, job.VideoID, job.ID, job)
 	}
 
-	// Appending audio streams for each transcoded size
-	for _, resize := range transcodeTargets {
-		mp4boxCommand += fmt.Sprintf(" %s_%d.mp4#audio", filePath, resize)
-	}
-
-	_, err := ExecuteCLI(mp4boxCommand, false)
-	if err != nil {
-		logger.Errorf("Error during command execution: %s\nError: %s", mp4boxCommand, err.Error())
-	} else {
-		pgDb := dbConnectionInfo["pgDb"]
-		pgUser := dbConnectionInfo["pgUser"]
-		pgPassword := dbConnectionInfo["pgPassword"]
-		pgHost := dbConnectionInfo["pgHost"]
-
-		connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
-		object, err := database.GetVideoObject(videoID, connection)
-		if err != nil {
-			logger.Errorw("Video object GET failed for updating:", err.Error())
-			return
-		}
+	return nil
+}
 
-		object.UpdatedAt = time.Now()
-		object.StreamFilePath = fmt.Sprintf("%s.mpd", filePath)
-		object.IsReadyToServe = true
+// saveRenderingProgress writes RenderingProgress to database,
+// a failed write is only logged as progress is informational
+func saveRenderingProgress(progress entity.RenderingProgress, dbConnectionInfo map[string]string, logger *zap.SugaredLogger) entity.RenderingProgress {
+	connection := database.GetConnection(dbConnectionInfo["pgUser"], dbConnectionInfo["pgPassword"], dbConnectionInfo["pgHost"], dbConnectionInfo["pgDb"])
 
-		connection = database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
-		_, renderings, renderingListErr := database.GetVideoRenderingObjects(object, connection)
-		if renderingListErr != nil {
-			logger.Errorw("Video rendering objects GET failed for updating:", renderingListErr.Error())
-		}
+	savedProgress, err := database.SaveRenderingProgressObject(progress, connection)
+	if err != nil {
+		logger.Warnf("Rendering progress object Save failed: %s\n", err.Error())
+		return progress
+	}
 
-		object.Renderings = renderings
+	publishEvent(event.NewProgressEvent(savedProgress))
 
-		connection = database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
-		_, updateErr := database.UpdateVideoObject(object, connection)
-		if updateErr != nil {
-			logger.Errorw("Video object Update failed:", updateErr.Error())
-		}
-	}
+	return savedProgress
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/n1207n/video-transcode-queue/api/common/database"
+	"github.com/n1207n/video-transcode-queue/api/common/entity"
+	"github.com/n1207n/video-transcode-queue/api/common/lock"
+)
+
+var (
+	// jobQueue holds TranscodeJob IDs waiting for a free transcode worker
+	jobQueue chan uint
+
+	// workersStopping is closed when the transcoder shuts down,
+	// workers finish their current job and take no new one
+	workersStopping = make(chan struct{})
+	workersDone     sync.WaitGroup
+
+	// runningJobs cancels the context of each job a worker is performing
+	runningJobs      = map[uint]context.CancelFunc{}
+	runningJobsMutex sync.Mutex
+)
+
+// startTranscodeWorkers launches a fixed pool of goroutines
+// performing queued TranscodeJobs in background
+func startTranscodeWorkers(workerCount int, queueSize int) {
+	jobQueue = make(chan uint, queueSize)
+
+	workersDone.Add(workerCount)
+
+	for index := 1; index <= workerCount; index++ {
+		go runTranscodeWorker(index)
+	}
+
+	logger.Infof("Started %d transcode workers", workerCount)
+}
+
+// stopTranscodeWorkers waits for running jobs up to given timeout.
+// Jobs still running or queued are resumed by the next transcoder process.
+func stopTranscodeWorkers(timeout time.Duration) {
+	close(workersStopping)
+
+	done := make(chan struct{})
+	go func() {
+		workersDone.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		logger.Info("Transcode workers stopped")
+	case <-time.After(timeout):
+		logger.Warnf("Transcode workers still running after %s, unfinished jobs resume on restart", timeout)
+	}
+}
+
+// enqueueTranscodeJob hands a job over to the worker pool
+// and returns false if the pool has no room left
+func enqueueTranscodeJob(jobID uint) bool {
+	select {
+	case <-workersStopping:
+		return false
+	default:
+	}
+
+	select {
+	case jobQueue <- jobID:
+		return true
+	default:
+		return false
+	}
+}
+
+// resumeTranscodeJobs puts unfinished jobs left behind
+// by a previous transcoder process back to the worker pool
+func resumeTranscodeJobs() {
+	connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	jobs, err := database.GetTranscodeJobObjectsByState(append([]string{entity.JobStateQueued}, entity.InProgressJobStates...), connection)
+	if err != nil {
+		logger.Errorf("Failed to load unfinished transcode jobs: %s", err.Error())
+		return
+	}
+
+	if len(jobs) == 0 {
+		return
+	}
+
+	logger.Infof("Resuming %d unfinished transcode jobs", len(jobs))
+
+	for _, job := range jobs {
+		if job.State != entity.JobStateQueued {
+			UpdateJobState(job.ID, entity.JobStateQueued, "transcoder restarted", getDBConnectionInfo(), logger)
+		}
+	}
+
+	go func() {
+		for _, job := range jobs {
+			select {
+			case jobQueue <- job.ID:
+			case <-workersStopping:
+				return
+			}
+		}
+	}()
+}
+
+func runTranscodeWorker(workerID int) {
+	defer workersDone.Done()
+
+	for {
+		var jobID uint
+
+		select {
+		case <-workersStopping:
+			return
+		case jobID = <-jobQueue:
+		}
+
+		connection := database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+		job, err := database.GetTranscodeJobObject(int(jobID), connection)
+		if err != nil {
+			logger.Errorf("Transcode worker %d failed to load job %d: %s", workerID, jobID, err.Error())
+			continue
+		}
+
+		if job.State != entity.JobStateQueued {
+			logger.Infof("Transcode worker %d skipped %s", workerID, job)
+			continue
+		}
+
+		// Commands of the job are killed once its context is cancelled
+		ctx, cancel := context.WithCancel(context.Background())
+
+		jobVideoLock, err := lockVideo(job.VideoID, func(err error) {
+			logger.Errorf("Transcode worker %d lost lock of video %d: %s", workerID, job.VideoID, err.Error())
+			UpdateJobState(job.ID, entity.JobStateFailed, "video lock lost: "+err.Error(), getDBConnectionInfo(), logger)
+			cancel()
+		})
+		if err != nil {
+			cancel()
+
+			if err == lock.ErrLocked {
+				logger.Infof("Transcode worker %d postponed %s, another job of the video is running", workerID, job)
+			} else {
+				logger.Errorf("Transcode worker %d failed to lock video %d: %s", workerID, job.VideoID, err.Error())
+			}
+
+			requeueTranscodeJob(job.ID, videoLockRetryInterval)
+			continue
+		}
+
+		logger.Infof("Transcode worker %d started %s", workerID, job)
+
+		runningJobsMutex.Lock()
+		runningJobs[job.ID] = cancel
+		runningJobsMutex.Unlock()
+
+		// A cancelled job already got its final state from whoever cancelled it
+		if err := performTranscoding(ctx, job); err != nil && ctx.Err() == nil {
+			UpdateJobState(job.ID, entity.JobStateFailed, err.Error(), getDBConnectionInfo(), logger)
+		}
+
+		runningJobsMutex.Lock()
+		delete(runningJobs, job.ID)
+		runningJobsMutex.Unlock()
+
+		jobVideoLock.release()
+		cancel()
+	}
+}
+
+// stopRunningJob kills the commands of a job if a worker of this transcoder performs it.
+// A job running on another transcoder stops at its next state change,
+// which is refused once the job is cancelled.
+func stopRunningJob(jobID uint) bool {
+	runningJobsMutex.Lock()
+	defer runningJobsMutex.Unlock()
+
+	cancel, ok := runningJobs[jobID]
+	if ok {
+		cancel()
+	}
+
+	return ok
+}
+
+// requeueTranscodeJob hands a job back to the worker pool after given delay.
+// A job still waiting on shutdown stays queued and resumes on restart.
+func requeueTranscodeJob(jobID uint, delay time.Duration) {
+	go func() {
+		select {
+		case <-time.After(delay):
+		case <-workersStopping:
+			return
+		}
+
+		select {
+		case jobQueue <- jobID:
+		case <-workersStopping:
+		}
+	}()
+}
+
+// getDBConnectionInfo returns PostgreSQL connection info
+// in the form the transcode functions take
+func getDBConnectionInfo() map[string]string {
+	return map[string]string{
+		"pgDb":       pgDb,
+		"pgUser":     pgUser,
+		"pgPassword": pgPassword,
+		"pgHost":     pgHost,
+	}
+}
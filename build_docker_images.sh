@@ -4,4 +4,4 @@ docker build -f api/Dockerfile-streaming -t n1207n/video-transcode-queue/streami
 
 docker build -f api/Dockerfile-transcoder -t n1207n/video-transcode-queue/transcoder_service:dev api
 
-docker build -t n1207n/video-transcode-queue/task_queue/consumer:dev -f task_queue/client/Dockerfile-consumer task_queue/client
+docker build -t n1207n/video-transcode-queue/task_queue/consumer:dev -f task_queue/client/Dockerfile-consumer .
@@ -15,3 +15,4 @@ kubectl create -f kubernetes/minikube/transcoder-api-deployment.yml
 kubectl create -f kubernetes/minikube/transcoder-api-service.yml
 
 kubectl create -f kubernetes/minikube/queue-consumer-job.yml
+kubectl create -f kubernetes/minikube/queue-cleaner-deployment.yml
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	taskqueue "github.com/n1207n/video-transcode-queue/api/common/queue"
+	"github.com/n1207n/video-transcode-queue/api/common/schema"
+	"gopkg.in/redis.v3"
+)
+
+// Task lists the admin command can inspect
+const (
+	adminQueueRejected = "rejected"
+	adminQueueDead     = "dead"
+	adminQueueAll      = "all"
+)
+
+const adminUsage = `Usage: task_queue admin <command> [options]
+
+Commands:
+  list     Lists rejected and dead-lettered tasks
+  purge    Deletes selected tasks
+  return   Moves selected tasks back to the ready queue
+
+Options:
+`
+
+// failedTaskList is a redis list holding failed tasks
+type failedTaskList struct {
+	queue string
+	key   string
+}
+
+// failedTask is a task payload stored in one of the failed task lists
+type failedTask struct {
+	queue   string
+	key     string
+	index   int
+	payload string
+	task    schema.TranscodeTask
+	version int
+	err     error
+}
+
+// runAdminCommand inspects, purges or replays failed tasks of the task queue
+// and returns the process exit code
+func runAdminCommand(arguments []string) int {
+	flags := flag.NewFlagSet("admin", flag.ContinueOnError)
+	queue := flags.String("queue", adminQueueAll, "task list to use: rejected, dead or all")
+	ids := flags.String("ids", "", "comma separated task IDs, or <queue>:<index> as printed by list, to purge or return")
+	all := flags.Bool("all", false, "purge or return every task of the list")
+
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, adminUsage)
+		flags.PrintDefaults()
+	}
+
+	if len(arguments) == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	command := arguments[0]
+	if err := flags.Parse(arguments[1:]); err != nil {
+		return 2
+	}
+
+	if *queue != adminQueueRejected && *queue != adminQueueDead && *queue != adminQueueAll {
+		fmt.Fprintf(os.Stderr, "Unknown queue: %s\n", *queue)
+		return 2
+	}
+
+	redisClient := openRedisClient()
+	defer redisClient.Close()
+
+	tasks, err := loadFailedTasks(redisClient, *queue)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load tasks: %s\n", err)
+		return 1
+	}
+
+	switch command {
+	case "list":
+		printFailedTasks(tasks)
+		return 0
+	case "purge", "return":
+		if !*all && len(*ids) == 0 {
+			fmt.Fprintln(os.Stderr, "Select tasks with -ids or -all")
+			return 2
+		}
+
+		selectedTasks, err := selectFailedTasks(tasks, *ids, *all)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -ids: %s\n", err)
+			return 2
+		}
+
+		result := "purged"
+		if command == "purge" {
+			err = purgeFailedTasks(redisClient, selectedTasks)
+		} else {
+			result = "returned to the ready queue"
+			err = returnFailedTasks(redisClient, selectedTasks)
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to %s tasks: %s\n", command, err)
+			return 1
+		}
+
+		fmt.Printf("%d tasks %s\n", len(selectedTasks), result)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
+		flags.Usage()
+		return 2
+	}
+}
+
+// requireRmqBackend returns an error for every backend but redis,
+// the admin and cleaner commands read its rmq lists and would find nothing of others
+func requireRmqBackend(command string, backend string) error {
+	if len(backend) == 0 || backend == taskqueue.BackendRedis {
+		return nil
+	}
+
+	return fmt.Errorf("%s command only works with TASK_QUEUE_BACKEND=%s, not %s", command, taskqueue.BackendRedis, backend)
+}
+
+// exitUnlessRmqBackend stops the process if the configured backend has no rmq lists
+func exitUnlessRmqBackend(command string) {
+	if err := requireRmqBackend(command, os.Getenv("TASK_QUEUE_BACKEND")); err != nil {
+		fmt.Fprintf(os.Stderr, "Unsupported queue backend: %s\n", err)
+		os.Exit(2)
+	}
+}
+
+// rmqQueueKey returns the redis list key rmq keeps a queue list in
+func rmqQueueKey(queueName string, list string) string {
+	return fmt.Sprintf("rmq::queue::[%s]::%s", queueName, list)
+}
+
+// failedTaskLists returns the failed task lists to use,
+// every priority lane has its own rejected list
+func failedTaskLists(queue string) []failedTaskList {
+	var lists []failedTaskList
+
+	if queue == adminQueueRejected || queue == adminQueueAll {
+		for _, priority := range taskqueue.Priorities {
+			lists = append(lists, failedTaskList{
+				queue: fmt.Sprintf("%s-%s", adminQueueRejected, priority),
+				key:   rmqQueueKey(taskqueue.LaneName(redisTopic, priority), "rejected"),
+			})
+		}
+	}
+
+	// Nothing consumes the dead-letter queue, so its tasks stay in the ready list
+	if queue == adminQueueDead || queue == adminQueueAll {
+		lists = append(lists, failedTaskList{
+			queue: adminQueueDead,
+			key:   rmqQueueKey(deadLetterQueueName(redisTopic), "ready"),
+		})
+	}
+
+	return lists
+}
+
+func loadFailedTasks(redisClient *redis.Client, queue string) ([]failedTask, error) {
+	var tasks []failedTask
+
+	for _, list := range failedTaskLists(queue) {
+		payloads, err := redisClient.LRange(list.key, 0, -1).Result()
+		if err != nil {
+			return tasks, err
+		}
+
+		for index, payload := range payloads {
+			task := failedTask{
+				queue:   list.queue,
+				key:     list.key,
+				index:   index,
+				payload: payload,
+			}
+
+			task.task, task.version, task.err = schema.DecodeTranscodeTask([]byte(payload))
+			tasks = append(tasks, task)
+		}
+	}
+
+	return tasks, nil
+}
+
+func printFailedTasks(tasks []failedTask) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer writer.Flush()
+
+	fmt.Fprintln(writer, "QUEUE\tINDEX\tTASK ID\tFILE PATH\tTIMESTAMP\tLADDER\tATTEMPTS\tLAST ERROR")
+
+	for _, task := range tasks {
+		if task.err != nil {
+			fmt.Fprintf(writer, "%s\t%d\t-\t-\t-\t-\t-\tunreadable payload: %s\n", task.queue, task.index, task.err)
+			continue
+		}
+
+		fmt.Fprintf(
+			writer,
+			"%s\t%d\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			task.queue,
+			task.index,
+			task.task.VideoID,
+			task.task.FilePath,
+			task.task.Timestamp.Format(time.RFC3339),
+			orDash(task.task.EncodingLadder),
+			task.task.Attempts,
+			orDash(task.task.LastError),
+		)
+	}
+}
+
+func orDash(value string) string {
+	if len(value) == 0 {
+		return "-"
+	}
+
+	return value
+}
+
+// selectFailedTasks picks tasks with given comma separated selectors, or all of them.
+// A selector is a task ID, or a queue and index like "dead:3" as printed by list,
+// which also picks tasks whose payload can't be read.
+func selectFailedTasks(tasks []failedTask, ids string, all bool) ([]failedTask, error) {
+	if all {
+		return tasks, nil
+	}
+
+	selectedIDs := map[string]bool{}
+	selectedPositions := map[string]bool{}
+
+	for _, id := range strings.Split(ids, ",") {
+		id = strings.TrimSpace(id)
+
+		separator := strings.LastIndex(id, ":")
+		if separator == -1 {
+			selectedIDs[id] = true
+			continue
+		}
+
+		index, err := strconv.Atoi(id[separator+1:])
+		if err != nil || index < 0 || separator == 0 {
+			return nil, fmt.Errorf("task selector %q is not a task ID or <queue>:<index>", id)
+		}
+
+		selectedPositions[taskPosition(id[:separator], index)] = true
+	}
+
+	var selectedTasks []failedTask
+	for _, task := range tasks {
+		isSelected := selectedPositions[taskPosition(task.queue, task.index)]
+		if task.err == nil && selectedIDs[task.task.VideoID] {
+			isSelected = true
+		}
+
+		if isSelected {
+			selectedTasks = append(selectedTasks, task)
+		}
+	}
+
+	return selectedTasks, nil
+}
+
+// taskPosition identifies a task by its list and index in it
+func taskPosition(queue string, index int) string {
+	return fmt.Sprintf("%s:%d", queue, index)
+}
+
+func purgeFailedTasks(redisClient *redis.Client, tasks []failedTask) error {
+	for _, task := range tasks {
+		if err := redisClient.LRem(task.key, 1, task.payload).Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// returnFailedTasks moves tasks to the ready queue of their priority lane,
+// dead-lettered tasks get a fresh set of attempts
+func returnFailedTasks(redisClient *redis.Client, tasks []failedTask) error {
+	for _, task := range tasks {
+		payload := task.payload
+
+		// Unreadable payloads go back to the normal lane
+		priority := taskqueue.PriorityNormal
+		if task.err == nil {
+			if taskPriority, err := taskqueue.ParsePriority(task.task.Priority); err == nil {
+				priority = taskPriority
+			}
+		}
+
+		readyKey := rmqQueueKey(taskqueue.LaneName(redisTopic, priority), "ready")
+
+		if task.err == nil && task.task.Attempts > 0 {
+			task.task.Attempts = 0
+
+			payloadBytes, err := schema.EncodeTranscodeTask(task.task, task.version)
+			if err != nil {
+				return err
+			}
+
+			payload = string(payloadBytes)
+		}
+
+		removed, err := redisClient.LRem(task.key, 1, task.payload).Result()
+		if err != nil {
+			return err
+		}
+
+		// Another admin or consumer already moved it
+		if removed == 0 {
+			continue
+		}
+
+		if err = redisClient.LPush(readyKey, payload).Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
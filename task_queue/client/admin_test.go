@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	taskqueue "github.com/n1207n/video-transcode-queue/api/common/queue"
+	"github.com/n1207n/video-transcode-queue/api/common/schema"
+)
+
+func TestSelectFailedTasks(t *testing.T) {
+	tasks := []failedTask{
+		{queue: "rejected-high", index: 0, task: schema.TranscodeTask{VideoID: "12"}},
+		{queue: "rejected-high", index: 1, err: errors.New("invalid character")},
+		{queue: "dead", index: 0, task: schema.TranscodeTask{VideoID: "15"}},
+		{queue: "dead", index: 1, task: schema.TranscodeTask{VideoID: "12"}},
+		{queue: "dead", index: 2, err: errors.New("unknown task type")},
+	}
+
+	tests := []struct {
+		name            string
+		ids             string
+		all             bool
+		expectedIndexes []int
+		isInvalid       bool
+	}{
+		{name: "all", all: true, expectedIndexes: []int{0, 1, 2, 3, 4}},
+		{name: "task ID in several lists", ids: "12", expectedIndexes: []int{0, 3}},
+		{name: "task IDs", ids: "15, 99", expectedIndexes: []int{2}},
+		{name: "unreadable by position", ids: "rejected-high:1,dead:2", expectedIndexes: []int{1, 4}},
+		{name: "IDs and positions", ids: "15,dead:1,dead:1", expectedIndexes: []int{2, 3}},
+		{name: "position out of range", ids: "dead:7"},
+		{name: "invalid index", ids: "dead:x", isInvalid: true},
+		{name: "negative index", ids: "dead:-1", isInvalid: true},
+		{name: "no queue", ids: ":1", isInvalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selectedTasks, err := selectFailedTasks(tasks, test.ids, test.all)
+
+			if test.isInvalid != (err != nil) {
+				t.Fatalf("selectFailedTasks(%q) returned error %v", test.ids, err)
+			}
+
+			var indexes []int
+			for _, selectedTask := range selectedTasks {
+				for index := range tasks {
+					if reflect.DeepEqual(selectedTask, tasks[index]) {
+						indexes = append(indexes, index)
+					}
+				}
+			}
+
+			if !reflect.DeepEqual(indexes, test.expectedIndexes) {
+				t.Errorf("selectFailedTasks(%q) picked tasks %v, want %v", test.ids, indexes, test.expectedIndexes)
+			}
+		})
+	}
+}
+
+func TestRequireRmqBackend(t *testing.T) {
+	tests := []struct {
+		backend   string
+		isAllowed bool
+	}{
+		{"", true},
+		{taskqueue.BackendRedis, true},
+		{taskqueue.BackendStream, false},
+		{taskqueue.BackendPostgres, false},
+	}
+
+	for _, test := range tests {
+		if err := requireRmqBackend("admin", test.backend); test.isAllowed != (err == nil) {
+			t.Errorf("requireRmqBackend(%q) returned %v", test.backend, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/n1207n/video-transcode-queue/api/common/schema"
+	"gopkg.in/redis.v3"
+)
+
+// rmq keys of connections and the queues they consume
+const (
+	rmqConnectionsKey         = "rmq::connections"
+	rmqConnectionHeartbeatKey = "rmq::connection::%s::heartbeat"
+	rmqConnectionQueuesKey    = "rmq::connection::%s::queues"
+	rmqConnectionConsumersKey = "rmq::connection::%s::queue::[%s]::consumers"
+	rmqConnectionUnackedKey   = "rmq::connection::%s::queue::[%s]::unacked"
+)
+
+// runCleanerCommand returns unacked deliveries of dead consumer connections
+// to their ready queues, once or periodically, and returns the process exit code
+func runCleanerCommand(arguments []string) int {
+	flags := flag.NewFlagSet("cleaner", flag.ContinueOnError)
+	interval := flags.Duration("interval", time.Minute, "time between two cleanups")
+	once := flags.Bool("once", false, "clean up once and exit")
+
+	if err := flags.Parse(arguments); err != nil {
+		return 2
+	}
+
+	redisClient := openRedisClient()
+	defer redisClient.Close()
+
+	for {
+		recoveredCount, err := cleanDeadConnections(redisClient)
+		if err != nil {
+			glog.Errorf("Queue cleanup failed: %s\n", err)
+
+			if *once {
+				fmt.Fprintf(os.Stderr, "Queue cleanup failed: %s\n", err)
+				return 1
+			}
+		} else if recoveredCount > 0 {
+			glog.Infof("Recovered %d unacked deliveries from dead connections\n", recoveredCount)
+		}
+
+		if *once {
+			return 0
+		}
+
+		time.Sleep(*interval)
+	}
+}
+
+// cleanDeadConnections finds rmq connections whose heartbeat expired,
+// moves their unacked deliveries back to the ready lists
+// and removes the connections, like rmq's Cleaner does
+func cleanDeadConnections(redisClient *redis.Client) (int, error) {
+	connections, err := redisClient.SMembers(rmqConnectionsKey).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	recoveredCount := 0
+
+	for _, connection := range connections {
+		isAlive, err := redisClient.Exists(fmt.Sprintf(rmqConnectionHeartbeatKey, connection)).Result()
+		if err != nil {
+			return recoveredCount, err
+		}
+
+		if isAlive {
+			continue
+		}
+
+		glog.Warningf("Found dead consumer connection: %s\n", connection)
+
+		count, err := cleanDeadConnection(redisClient, connection)
+		recoveredCount += count
+		if err != nil {
+			return recoveredCount, err
+		}
+	}
+
+	return recoveredCount, nil
+}
+
+func cleanDeadConnection(redisClient *redis.Client, connection string) (int, error) {
+	queuesKey := fmt.Sprintf(rmqConnectionQueuesKey, connection)
+
+	queues, err := redisClient.SMembers(queuesKey).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	recoveredCount := 0
+
+	for _, queue := range queues {
+		unackedKey := fmt.Sprintf(rmqConnectionUnackedKey, connection, queue)
+		readyKey := rmqQueueKey(queue, "ready")
+
+		for {
+			payload, err := redisClient.RPopLPush(unackedKey, readyKey).Result()
+			if err == redis.Nil {
+				break
+			} else if err != nil {
+				return recoveredCount, err
+			}
+
+			recoveredCount++
+			logRecoveredDelivery(connection, queue, payload)
+		}
+
+		err = redisClient.Del(unackedKey, fmt.Sprintf(rmqConnectionConsumersKey, connection, queue)).Err()
+		if err != nil {
+			return recoveredCount, err
+		}
+	}
+
+	if err = redisClient.Del(queuesKey).Err(); err != nil {
+		return recoveredCount, err
+	}
+
+	return recoveredCount, redisClient.SRem(rmqConnectionsKey, connection).Err()
+}
+
+func logRecoveredDelivery(connection string, queue string, payload string) {
+	task, _, err := schema.DecodeTranscodeTask([]byte(payload))
+	if err != nil {
+		glog.Infof("Recovered unreadable delivery of %s on %s: %s\n", connection, queue, payload)
+		return
+	}
+
+	glog.Infof("Recovered task %s of %s on %s: %s (attempts: %d)\n", task.VideoID, connection, queue, task.FilePath, task.Attempts)
+}
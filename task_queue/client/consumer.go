@@ -3,14 +3,21 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/adjust/rmq"
 	"github.com/golang/glog"
+	"github.com/n1207n/video-transcode-queue/api/common/database"
+	"github.com/n1207n/video-transcode-queue/api/common/queue"
+	"github.com/n1207n/video-transcode-queue/api/common/schema"
 	"gopkg.in/redis.v3"
 )
 
@@ -19,61 +26,192 @@ var (
 	redisProtocol                                  = "tcp"
 	redisNetworkTag                                = "transcode_task_consume"
 	transcodeServiceHost, transcodeServicePort     string
-
-	// TODO: Make below variables as a CLI argument
-	queueFetchInterval            = 10
-	queueFetchIntervalMeasurement = time.Second
+	taskQueueBackend                               string
+	pgDb, pgUser, pgPassword, pgHost               string
+	taskMaxAttempts                                = 5
+	retryBaseBackoff                               = 10 * time.Second
+
+	// Below variables are set by flags, or environment variables as their defaults
+	queuePrefetchLimit = 10
+	queuePollInterval  = time.Second
+	consumerCount      = 1
+	statsLogInterval   = time.Minute
+	shutdownTimeout    = 25 * time.Second
+	laneWeights        map[queue.Priority]int
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "admin":
+			exitUnlessRmqBackend("admin")
+			loadRedisEnvironmentVariables()
+			os.Exit(runAdminCommand(os.Args[2:]))
+		case "cleaner":
+			exitUnlessRmqBackend("cleaner")
+			flag.Set("logtostderr", "true")
+			loadRedisEnvironmentVariables()
+			os.Exit(runCleanerCommand(os.Args[2:]))
+		}
+	}
+
 	loadEnvironmentVariables()
+	loadConsumerSettings()
+
+	broker := openBroker()
+
+	var lanes []*taskLane
+	var taskQueues []queue.TaskQueue
+
+	for _, priority := range queue.Priorities {
+		taskQueue, err := broker.OpenQueue(queue.LaneName(redisTopic, priority))
+		if err != nil {
+			panic(err)
+		}
+
+		glog.Infof("Queue accessed: %s, weight %d\n", taskQueue.Name(), laneWeights[priority])
+
+		lanes = append(lanes, &taskLane{
+			priority:  priority,
+			weight:    laneWeights[priority],
+			taskQueue: taskQueue,
+		})
+		taskQueues = append(taskQueues, taskQueue)
+	}
+
+	scheduler := newLaneScheduler(lanes)
+
+	deadLetterQueue, err := broker.OpenQueue(deadLetterQueueName(redisTopic))
+	if err != nil {
+		panic(err)
+	}
+
+	glog.Infof("Dead-letter queue accessed: %s\n", deadLetterQueueName(redisTopic))
+
+	for _, lane := range lanes {
+		if err = lane.taskQueue.StartConsuming(queuePrefetchLimit, queuePollInterval); err != nil {
+			panic(err)
+		}
+
+		lane.taskQueue.AddConsumer(fmt.Sprintf("lane-%s", lane.priority), &laneConsumer{
+			scheduler: scheduler,
+			lane:      lane,
+		})
+	}
 
-	taskQueue := openTaskQueue()
-	glog.Infof("Queue accessed: %s\n", redisTopic)
+	glog.Infof("Queue consumption started: prefetch %d per lane, poll interval %s\n", queuePrefetchLimit, queuePollInterval)
 
-	taskQueue.StartConsuming(queueFetchInterval, queueFetchIntervalMeasurement)
-	glog.Infoln("Queue consumption started...")
+	var taskConsumers []*TaskConsumer
 
-	taskConsumer := &TaskConsumer{}
-	taskQueue.AddConsumer("Task consumer 1", taskConsumer)
+	for index := 1; index <= consumerCount; index++ {
+		taskConsumer := &TaskConsumer{
+			name:            fmt.Sprintf("task-consumer-%d", index),
+			scheduler:       scheduler,
+			deadLetterQueue: deadLetterQueue,
+		}
 
-	select {}
+		go taskConsumer.run()
+		taskConsumers = append(taskConsumers, taskConsumer)
+	}
+
+	glog.Infof("Started %d task consumers\n", consumerCount)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	statsTicker := time.NewTicker(statsLogInterval)
+	defer statsTicker.Stop()
+
+	for {
+		select {
+		case <-statsTicker.C:
+			for _, taskConsumer := range taskConsumers {
+				glog.Infoln(taskConsumer.Stats())
+			}
+
+			logLaneStats(lanes)
+		case receivedSignal := <-signals:
+			glog.Infof("Received %s, shutting down\n", receivedSignal)
+
+			drainConsumers(taskQueues, scheduler, shutdownTimeout)
+
+			for _, taskConsumer := range taskConsumers {
+				glog.Infoln(taskConsumer.Stats())
+			}
+
+			glog.Flush()
+			return
+		}
+	}
 }
 
 // TaskConsumer represents the Redis topic consumer
 type TaskConsumer struct {
 	name         string
-	count        int
-	lastAccessed time.Time
+	count        int64
+	lastAccessed atomic.Value
+
+	// Counters of how consumed deliveries ended up,
+	// updated atomically as retries finish in background
+	ackedCount        int64
+	rejectedCount     int64
+	retriedCount      int64
+	deadLetteredCount int64
+
+	// scheduler hands out deliveries of the priority lanes, whose queues
+	// receive failed tasks again for a retry,
+	// deadLetterQueue keeps tasks which ran out of attempts
+	scheduler       *laneScheduler
+	deadLetterQueue queue.TaskQueue
 }
 
-// TranscodeRequest represents a JSON POST data for video-transcode API
-type TranscodeRequest struct {
-	Path    string `json:"path"`
-	VideoID string `json:"video_id"`
+// run consumes deliveries the scheduler hands out
+// until it is stopped and nothing is pending
+func (tc *TaskConsumer) run() {
+	for {
+		delivery, lane := tc.scheduler.next()
+		if delivery == nil {
+			return
+		}
+
+		tc.Consume(delivery, lane)
+		endInFlight()
+	}
 }
 
-// Consume method implements TaskConsumer struct
-// to be registered on Queue.
-// It handles actual data handling from Queue
-func (tc *TaskConsumer) Consume(delivery rmq.Delivery) {
-	var task Task
+// Consume handles actual data handling of a delivery from given lane
+func (tc *TaskConsumer) Consume(delivery queue.Delivery, lane *taskLane) {
+	// Prefetched deliveries left after a shutdown signal are left for other consumers
+	if isStopping() {
+		tc.returnDelivery(delivery, lane)
+		return
+	}
+
+	atomic.AddInt64(&tc.count, 1)
+	tc.lastAccessed.Store(time.Now())
+
+	task, version, err := schema.DecodeTranscodeTask([]byte(delivery.Payload()))
+	if err != nil {
+		glog.Errorf("Failed to read task message, moving it to dead-letter queue: %s\n", err)
 
-	tc.count++
+		if tc.deadLetterQueue.Publish([]byte(delivery.Payload())) == nil {
+			atomic.AddInt64(&tc.deadLetteredCount, 1)
+			tc.ack(delivery)
+		} else {
+			tc.reject(delivery)
+		}
 
-	if err := json.Unmarshal([]byte(delivery.Payload()), &task); err != nil {
-		glog.Errorf("Failed to read task message: %s\n", err)
-		delivery.Reject()
 		return
 	}
 
-	glog.Infof("Processed task message: Transcoding %s\n", task.FilePath)
+	if countedDelivery, ok := delivery.(queue.CountedDelivery); ok && countedDelivery.DeliveryCount() > 1 {
+		glog.Warningf("%s: task %s is delivered for the %d. time\n", tc.name, task.VideoID, countedDelivery.DeliveryCount())
+	}
+
+	glog.Infof("Processed %s priority task message: Transcoding %s\n", lane.priority, task.FilePath)
 
 	// TODO: Call Go subroutine to call go binding of ffmpeg
-	transcodeRequest := &TranscodeRequest{
-		Path:    task.FilePath,
-		VideoID: task.ID,
-	}
+	transcodeRequest := task.TranscodeRequest()
 
 	b := new(bytes.Buffer)
 	json.NewEncoder(b).Encode(transcodeRequest)
@@ -83,7 +221,7 @@ func (tc *TaskConsumer) Consume(delivery rmq.Delivery) {
 	request, err := http.NewRequest("POST", url, b)
 	if err != nil {
 		glog.Warningf("Failed to trigger transcode API: %s\n", err)
-		delivery.Reject()
+		tc.retryTask(delivery, lane, task, version, err)
 		return
 	}
 
@@ -91,20 +229,151 @@ func (tc *TaskConsumer) Consume(delivery rmq.Delivery) {
 	response, err := client.Do(request)
 	if err != nil {
 		glog.Warningf("Unsuccessful transcode request: %s\n", err)
-		delivery.Reject()
+		tc.retryTask(delivery, lane, task, version, err)
 		return
 	}
 
+	defer response.Body.Close()
+
 	responseBuffer := new(bytes.Buffer)
 	io.Copy(responseBuffer, response.Body)
 
-	glog.Infof("Successful transcode request: %s\n", responseBuffer)
-	delivery.Ack()
+	if response.StatusCode != http.StatusAccepted {
+		glog.Warningf("Transcode request not accepted: %d %s\n", response.StatusCode, responseBuffer)
+
+		requestErr := fmt.Errorf("transcode request not accepted: %d %s", response.StatusCode, responseBuffer)
+
+		if isRetryableStatus(response.StatusCode) {
+			tc.retryTask(delivery, lane, task, version, requestErr)
+		} else {
+			task.Attempts++
+			tc.deadLetterTask(delivery, task, version, requestErr)
+		}
+
+		return
+	}
+
+	glog.Infof("%s successful transcode request: %s\n", tc.name, responseBuffer)
+	tc.ack(delivery)
+}
+
+// isRetryableStatus tells if a transcode request answered with given status may
+// succeed later. Client errors won't change by retrying, except timeouts and throttling.
+func isRetryableStatus(statusCode int) bool {
+	if statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests {
+		return true
+	}
+
+	return statusCode < 400 || statusCode >= 500
+}
+
+// ack acknowledges a delivery and counts it
+func (tc *TaskConsumer) ack(delivery queue.Delivery) {
+	if err := delivery.Ack(); err != nil {
+		glog.Warningf("%s failed to ack delivery: %s\n", tc.name, err)
+		return
+	}
+
+	atomic.AddInt64(&tc.ackedCount, 1)
+}
+
+// reject rejects a delivery and counts it
+func (tc *TaskConsumer) reject(delivery queue.Delivery) {
+	if err := delivery.Reject(); err != nil {
+		glog.Warningf("%s failed to reject delivery: %s\n", tc.name, err)
+		return
+	}
+
+	atomic.AddInt64(&tc.rejectedCount, 1)
+}
+
+// Stats returns the counters of the consumer as a log line
+func (tc *TaskConsumer) Stats() string {
+	lastAccessed := "never"
+	if accessedAt, ok := tc.lastAccessed.Load().(time.Time); ok {
+		lastAccessed = accessedAt.Format(time.RFC3339)
+	}
+
+	return fmt.Sprintf(
+		"%s: consumed %d, acked %d, rejected %d, retried %d, dead-lettered %d, last accessed %s",
+		tc.name,
+		atomic.LoadInt64(&tc.count),
+		atomic.LoadInt64(&tc.ackedCount),
+		atomic.LoadInt64(&tc.rejectedCount),
+		atomic.LoadInt64(&tc.retriedCount),
+		atomic.LoadInt64(&tc.deadLetteredCount),
+		lastAccessed,
+	)
+}
+
+// logLaneStats logs queue counters of every priority lane
+func logLaneStats(lanes []*taskLane) {
+	for _, lane := range lanes {
+		stats, err := lane.taskQueue.Stats()
+		if err != nil {
+			glog.Warningf("Failed to read stats of %s lane: %s\n", lane.priority, err)
+			continue
+		}
+
+		glog.Infof("%s lane: ready %d, scheduled %d, unacked %d, rejected %d\n", lane.priority, stats.Ready, stats.Scheduled, stats.Unacked, stats.Rejected)
+	}
 }
 
 // loadEnvironmentVariables loads Redis
 // information from environment variables
 func loadEnvironmentVariables() {
+	taskQueueBackend = os.Getenv("TASK_QUEUE_BACKEND")
+	if len(taskQueueBackend) == 0 {
+		taskQueueBackend = queue.BackendRedis
+	}
+
+	switch taskQueueBackend {
+	case queue.BackendRedis, queue.BackendStream:
+		loadRedisEnvironmentVariables()
+	case queue.BackendPostgres:
+		loadPostgresEnvironmentVariables()
+	default:
+		panic("Invalid TASK_QUEUE_BACKEND environment variable")
+	}
+
+	// REDIS_TOPIC names the task queue with every backend
+	redisTopic = os.Getenv("REDIS_TOPIC")
+	if len(redisTopic) == 0 {
+		panic("No REDIS_TOPIC environment variable")
+	}
+
+	transcodeServiceHost = os.Getenv("TRANSCODER_API_SERVICE_HOST")
+	if len(transcodeServiceHost) == 0 {
+		panic("No TRANSCODER_API_SERVICE_HOST environment variable")
+	}
+
+	transcodeServicePort = os.Getenv("TRANSCODER_API_SERVICE_PORT")
+	if len(transcodeServicePort) == 0 {
+		panic("No TRANSCODER_API_SERVICE_PORT environment variable")
+	}
+
+	if maxAttempts := os.Getenv("TASK_MAX_ATTEMPTS"); len(maxAttempts) != 0 {
+		attempts, err := strconv.Atoi(maxAttempts)
+		if err != nil || attempts < 1 {
+			panic("Invalid TASK_MAX_ATTEMPTS environment variable")
+		}
+
+		taskMaxAttempts = attempts
+	}
+
+	if backoffSeconds := os.Getenv("TASK_RETRY_BACKOFF_SECONDS"); len(backoffSeconds) != 0 {
+		seconds, err := strconv.Atoi(backoffSeconds)
+		if err != nil || seconds < 1 {
+			panic("Invalid TASK_RETRY_BACKOFF_SECONDS environment variable")
+		}
+
+		retryBaseBackoff = time.Duration(seconds) * time.Second
+	}
+}
+
+// loadRedisEnvironmentVariables loads Redis information
+// shared by the consumer and the admin command
+func loadRedisEnvironmentVariables() {
 	redisURL = os.Getenv("REDIS_URL")
 	if len(redisURL) == 0 {
 		panic("No REDIS_URL environment variable")
@@ -115,11 +384,6 @@ func loadEnvironmentVariables() {
 		panic("No REDIS_PORT environment variable")
 	}
 
-	redisTopic = os.Getenv("REDIS_TOPIC")
-	if len(redisTopic) == 0 {
-		panic("No REDIS_TOPIC environment variable")
-	}
-
 	redisPassword = os.Getenv("REDIS_PASSWORD")
 	if len(redisPassword) == 0 {
 		panic("No REDIS_PASSWORD environment variable")
@@ -129,30 +393,132 @@ func loadEnvironmentVariables() {
 	if len(redisTopic) == 0 {
 		panic("No REDIS_TOPIC environment variable")
 	}
+}
 
-	transcodeServiceHost = os.Getenv("TRANSCODER_API_SERVICE_HOST")
-	if len(transcodeServiceHost) == 0 {
-		panic("No TRANSCODER_API_SERVICE_HOST environment variable")
+// loadPostgresEnvironmentVariables loads PostgreSQL
+// information of the postgres queue backend
+func loadPostgresEnvironmentVariables() {
+	pgDb = os.Getenv("PGDB")
+	if len(pgDb) == 0 {
+		panic("No pgDB environment variable")
 	}
 
-	transcodeServicePort = os.Getenv("TRANSCODER_API_SERVICE_PORT")
-	if len(transcodeServicePort) == 0 {
-		panic("No TRANSCODER_API_SERVICE_PORT environment variable")
+	pgUser = os.Getenv("PGUSER")
+	if len(pgUser) == 0 {
+		panic("No pgUSER environment variable")
+	}
+
+	pgPassword = os.Getenv("PGPASSWORD")
+	if len(pgPassword) == 0 {
+		panic("No pgPASSWORD environment variable")
+	}
+
+	pgHost = os.Getenv("PGHOST")
+	if len(pgHost) == 0 {
+		panic("No pgHOST environment variable")
 	}
 }
 
-// openTaskQueue connects to redis and return a Queue interface
-func openTaskQueue() rmq.Queue {
-	redisClient := redis.NewClient(&redis.Options{
+// openRedisClient returns a client of the redis database holding the queues
+func openRedisClient() *redis.Client {
+	return redis.NewClient(&redis.Options{
 		Network:  redisProtocol,
 		Addr:     fmt.Sprintf("%s:%s", redisURL, redisPort),
 		DB:       int64(1),
 		Password: redisPassword,
 	})
+}
+
+// openBroker connects to the configured queue backend
+// to open the task and dead-letter queues from
+func openBroker() queue.Broker {
+	config := queue.Config{
+		Backend:  taskQueueBackend,
+		RedisTag: redisNetworkTag,
+		ErrorLog: glog.Errorf,
+	}
 
-	connection := rmq.OpenConnectionWithRedisClient(redisNetworkTag, redisClient)
+	switch taskQueueBackend {
+	case queue.BackendRedis, queue.BackendStream:
+		config.RedisClient = openRedisClient()
+	case queue.BackendPostgres:
+		config.PostgresConnection = database.GetConnection(pgUser, pgPassword, pgHost, pgDb)
+	}
 
-	glog.Infof("Connected to Redis task queue: %s\n", connection.Name)
+	broker, err := queue.NewBroker(config)
+	if err != nil {
+		panic(err)
+	}
+
+	glog.Infof("Connected to %s task queue\n", taskQueueBackend)
+
+	return broker
+}
+
+// loadConsumerSettings reads prefetch limit, poll interval and consumer count
+// from flags, falling back to environment variables and then to defaults
+func loadConsumerSettings() {
+	if prefetchLimit := os.Getenv("TASK_PREFETCH_LIMIT"); len(prefetchLimit) != 0 {
+		limit, err := strconv.Atoi(prefetchLimit)
+		if err != nil || limit < 1 {
+			panic("Invalid TASK_PREFETCH_LIMIT environment variable")
+		}
+
+		queuePrefetchLimit = limit
+	}
 
-	return connection.OpenQueue(redisTopic)
+	if pollInterval := os.Getenv("TASK_POLL_INTERVAL"); len(pollInterval) != 0 {
+		interval, err := time.ParseDuration(pollInterval)
+		if err != nil || interval <= 0 {
+			panic("Invalid TASK_POLL_INTERVAL environment variable")
+		}
+
+		queuePollInterval = interval
+	}
+
+	if timeout := os.Getenv("TASK_SHUTDOWN_TIMEOUT"); len(timeout) != 0 {
+		duration, err := time.ParseDuration(timeout)
+		if err != nil || duration <= 0 {
+			panic("Invalid TASK_SHUTDOWN_TIMEOUT environment variable")
+		}
+
+		shutdownTimeout = duration
+	}
+
+	weights := os.Getenv("TASK_LANE_WEIGHTS")
+	if len(weights) == 0 {
+		weights = defaultLaneWeights
+	}
+
+	if count := os.Getenv("TASK_CONSUMER_COUNT"); len(count) != 0 {
+		consumers, err := strconv.Atoi(count)
+		if err != nil || consumers < 1 {
+			panic("Invalid TASK_CONSUMER_COUNT environment variable")
+		}
+
+		consumerCount = consumers
+	}
+
+	flag.IntVar(&queuePrefetchLimit, "prefetch", queuePrefetchLimit, "number of unacked deliveries fetched ahead (TASK_PREFETCH_LIMIT)")
+	flag.DurationVar(&queuePollInterval, "poll-interval", queuePollInterval, "time between two fetches of ready deliveries (TASK_POLL_INTERVAL)")
+	flag.IntVar(&consumerCount, "consumers", consumerCount, "number of parallel consumers (TASK_CONSUMER_COUNT)")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "time in-flight deliveries may take to finish on SIGTERM (TASK_SHUTDOWN_TIMEOUT)")
+	flag.DurationVar(&statsLogInterval, "stats-interval", statsLogInterval, "time between two logs of consumer counters")
+	flag.StringVar(&weights, "lane-weights", weights, "share of consumers per priority lane while all lanes have tasks (TASK_LANE_WEIGHTS)")
+	flag.Parse()
+
+	var err error
+	if laneWeights, err = parseLaneWeights(weights); err != nil {
+		panic(fmt.Sprintf("Invalid lane weights: %s", err))
+	}
+
+	if queuePrefetchLimit < 1 || consumerCount < 1 || queuePollInterval <= 0 || statsLogInterval <= 0 || shutdownTimeout <= 0 {
+		panic("Invalid consumer flags")
+	}
+
+	// Every lane prefetches on its own, so fewer prefetched deliveries
+	// than consumers leaves some of them idle while one lane is busy
+	if queuePrefetchLimit < consumerCount {
+		glog.Warningf("Prefetch limit %d is lower than consumer count %d\n", queuePrefetchLimit, consumerCount)
+	}
 }
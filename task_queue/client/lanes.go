@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/n1207n/video-transcode-queue/api/common/queue"
+)
+
+// defaultLaneWeights share consumers 6:3:1 between high, normal and low
+// priority lanes while all of them have tasks waiting
+const defaultLaneWeights = "high=6,normal=3,low=1"
+
+// taskLane is the queue of one task priority
+type taskLane struct {
+	priority  queue.Priority
+	weight    int
+	taskQueue queue.TaskQueue
+
+	// pending holds prefetched deliveries waiting for a consumer,
+	// current is the smooth weighted round-robin counter of the lane
+	pending []queue.Delivery
+	current int
+}
+
+// laneScheduler hands prefetched deliveries of several lanes to consumers
+// in smooth weighted round-robin order. Only lanes with pending deliveries
+// take part in a round, so an idle lane leaves its share to the others,
+// and a low weight lane still gets its share while the others are busy.
+type laneScheduler struct {
+	lanes []*taskLane
+
+	mutex      sync.Mutex
+	hasPending *sync.Cond
+	isStopped  bool
+}
+
+func newLaneScheduler(lanes []*taskLane) *laneScheduler {
+	scheduler := &laneScheduler{lanes: lanes}
+	scheduler.hasPending = sync.NewCond(&scheduler.mutex)
+
+	return scheduler
+}
+
+// laneConsumer registers a lane on its queue,
+// it only parks deliveries until the scheduler picks them
+type laneConsumer struct {
+	scheduler *laneScheduler
+	lane      *taskLane
+}
+
+// Consume implements queue.Consumer, the delivery counts
+// as in flight from here until a task consumer is done with it
+func (lc *laneConsumer) Consume(delivery queue.Delivery) {
+	beginInFlight()
+
+	lc.scheduler.mutex.Lock()
+	lc.lane.pending = append(lc.lane.pending, delivery)
+	lc.scheduler.mutex.Unlock()
+
+	lc.scheduler.hasPending.Signal()
+}
+
+// next blocks until a delivery is pending and returns it with its lane.
+// After stop, it keeps returning pending deliveries
+// and returns a nil delivery once none are left.
+func (s *laneScheduler) next() (queue.Delivery, *taskLane) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for {
+		if lane := s.pick(); lane != nil {
+			delivery := lane.pending[0]
+			lane.pending = lane.pending[1:]
+
+			return delivery, lane
+		}
+
+		if s.isStopped {
+			return nil, nil
+		}
+
+		s.hasPending.Wait()
+	}
+}
+
+// pick selects the lane to take the next delivery from,
+// it must be called with the mutex held
+func (s *laneScheduler) pick() *taskLane {
+	var picked *taskLane
+	totalWeight := 0
+
+	for _, lane := range s.lanes {
+		if len(lane.pending) == 0 {
+			continue
+		}
+
+		lane.current += lane.weight
+		totalWeight += lane.weight
+
+		if picked == nil || lane.current > picked.current {
+			picked = lane
+		}
+	}
+
+	if picked != nil {
+		picked.current -= totalWeight
+	}
+
+	return picked
+}
+
+// stop wakes up waiting consumers so they return once nothing is pending
+func (s *laneScheduler) stop() {
+	s.mutex.Lock()
+	s.isStopped = true
+	s.mutex.Unlock()
+
+	s.hasPending.Broadcast()
+}
+
+// parseLaneWeights reads weights like "high=6,normal=3,low=1",
+// every priority needs a positive weight
+func parseLaneWeights(value string) (map[queue.Priority]int, error) {
+	weights := map[queue.Priority]int{}
+
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+			return nil, fmt.Errorf("invalid lane weight %q", pair)
+		}
+
+		priority, err := queue.ParsePriority(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, err
+		}
+
+		weight, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("invalid weight of %s lane: %q", priority, parts[1])
+		}
+
+		weights[priority] = weight
+	}
+
+	for _, priority := range queue.Priorities {
+		if _, ok := weights[priority]; !ok {
+			return nil, fmt.Errorf("no weight for %s lane", priority)
+		}
+	}
+
+	return weights, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/n1207n/video-transcode-queue/api/common/queue"
+)
+
+// testDelivery is a delivery parked in a lane, named by its payload
+type testDelivery string
+
+func (d testDelivery) Payload() string {
+	return string(d)
+}
+
+func (d testDelivery) Ack() error {
+	return nil
+}
+
+func (d testDelivery) Reject() error {
+	return nil
+}
+
+// newTestScheduler returns a scheduler of the default 6:3:1 lanes
+// with given number of deliveries pending in each
+func newTestScheduler(high int, normal int, low int) (*laneScheduler, map[queue.Priority]*taskLane) {
+	lanes := map[queue.Priority]*taskLane{}
+	var orderedLanes []*taskLane
+
+	for _, lane := range []struct {
+		priority queue.Priority
+		weight   int
+		pending  int
+	}{
+		{queue.PriorityHigh, 6, high},
+		{queue.PriorityNormal, 3, normal},
+		{queue.PriorityLow, 1, low},
+	} {
+		taskLane := &taskLane{priority: lane.priority, weight: lane.weight}
+		for index := 0; index < lane.pending; index++ {
+			taskLane.pending = append(taskLane.pending, testDelivery(lane.priority))
+		}
+
+		lanes[lane.priority] = taskLane
+		orderedLanes = append(orderedLanes, taskLane)
+	}
+
+	return newLaneScheduler(orderedLanes), lanes
+}
+
+// nextPriorities returns the lanes of the next count deliveries
+func nextPriorities(t *testing.T, scheduler *laneScheduler, count int) []queue.Priority {
+	var priorities []queue.Priority
+
+	for index := 0; index < count; index++ {
+		delivery, lane := scheduler.next()
+		if delivery == nil || lane == nil {
+			t.Fatalf("no delivery after %v", priorities)
+		}
+
+		if delivery.Payload() != string(lane.priority) {
+			t.Fatalf("delivery %s came from %s lane", delivery.Payload(), lane.priority)
+		}
+
+		priorities = append(priorities, lane.priority)
+	}
+
+	return priorities
+}
+
+func countPriorities(priorities []queue.Priority) map[queue.Priority]int {
+	counts := map[queue.Priority]int{}
+	for _, priority := range priorities {
+		counts[priority]++
+	}
+
+	return counts
+}
+
+func TestLaneSchedulerOrder(t *testing.T) {
+	scheduler, _ := newTestScheduler(10, 10, 10)
+
+	high, normal, low := queue.PriorityHigh, queue.PriorityNormal, queue.PriorityLow
+
+	// Smooth weighted round-robin spreads the lanes over the round
+	expected := []queue.Priority{high, normal, high, high, normal, high, low, high, normal, high}
+
+	if priorities := nextPriorities(t, scheduler, 10); !reflect.DeepEqual(priorities, expected) {
+		t.Errorf("picked %v, want %v", priorities, expected)
+	}
+}
+
+func TestLaneSchedulerIdleLane(t *testing.T) {
+	scheduler, _ := newTestScheduler(10, 0, 10)
+
+	counts := countPriorities(nextPriorities(t, scheduler, 7))
+
+	expected := map[queue.Priority]int{queue.PriorityHigh: 6, queue.PriorityLow: 1}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("picked %v over 7 picks without normal tasks, want %v", counts, expected)
+	}
+
+	// Only lanes with tasks are picked
+	scheduler, _ = newTestScheduler(0, 0, 3)
+
+	counts = countPriorities(nextPriorities(t, scheduler, 3))
+	if counts[queue.PriorityLow] != 3 {
+		t.Errorf("picked %v with only low tasks pending", counts)
+	}
+}
+
+func TestLaneSchedulerLowNotStarved(t *testing.T) {
+	scheduler, lanes := newTestScheduler(1, 1, 1)
+
+	// Every lane gets a new task for every one taken, so high and normal never run dry
+	for round := 0; round < 5; round++ {
+		isLowPicked := false
+
+		for pick := 0; pick < 10; pick++ {
+			_, lane := scheduler.next()
+
+			isLowPicked = isLowPicked || lane.priority == queue.PriorityLow
+			lane.pending = append(lane.pending, testDelivery(lane.priority))
+		}
+
+		if !isLowPicked {
+			t.Fatalf("low lane not picked in round %d while high and normal lanes kept getting tasks", round+1)
+		}
+	}
+
+	if len(lanes[queue.PriorityHigh].pending) != 1 {
+		t.Errorf("high lane holds %d tasks, want 1", len(lanes[queue.PriorityHigh].pending))
+	}
+}
+
+func TestLaneSchedulerStop(t *testing.T) {
+	scheduler, _ := newTestScheduler(1, 0, 0)
+	scheduler.stop()
+
+	// Pending deliveries are still handed out after stop
+	if delivery, _ := scheduler.next(); delivery == nil {
+		t.Fatal("no pending delivery after stop")
+	}
+
+	if delivery, lane := scheduler.next(); delivery != nil || lane != nil {
+		t.Errorf("next after stop returned %v, want nil", delivery)
+	}
+}
+
+func TestParseLaneWeights(t *testing.T) {
+	weights, err := parseLaneWeights(" high=6, normal = 3,low=1")
+	if err != nil {
+		t.Fatalf("parseLaneWeights failed: %v", err)
+	}
+
+	expected := map[queue.Priority]int{queue.PriorityHigh: 6, queue.PriorityNormal: 3, queue.PriorityLow: 1}
+	if !reflect.DeepEqual(weights, expected) {
+		t.Errorf("parseLaneWeights = %v, want %v", weights, expected)
+	}
+
+	tests := []struct {
+		value         string
+		expectedError string
+	}{
+		{"high=6,normal=3", "no weight for low lane"},
+		{"high=6,normal=3,low=0", "invalid weight of low lane"},
+		{"high=6,normal=3,low=-1", "invalid weight of low lane"},
+		{"high=6,normal=3,low=1,urgent=9", "unknown priority"},
+		{"high=6,normal=3,low", "invalid lane weight"},
+		{"high=6,normal=3,=1", "invalid lane weight"},
+		{"high=6,normal=3,low=one", "invalid weight of low lane"},
+		{"", "invalid lane weight"},
+	}
+
+	for _, test := range tests {
+		if _, err := parseLaneWeights(test.value); err == nil || !strings.Contains(err.Error(), test.expectedError) {
+			t.Errorf("parseLaneWeights(%q) returned error %v, want one containing %q", test.value, err, test.expectedError)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/n1207n/video-transcode-queue/api/common/queue"
+	"github.com/n1207n/video-transcode-queue/api/common/schema"
+)
+
+// maxRetryBackoff caps the delay between two attempts of a task
+const maxRetryBackoff = 10 * time.Minute
+
+// retryBackoff returns how long to wait before given attempt number,
+// doubling the base delay after every failed attempt
+func retryBackoff(attempt int) time.Duration {
+	backoff := retryBaseBackoff
+	for index := 1; index < attempt; index++ {
+		backoff *= 2
+
+		if backoff >= maxRetryBackoff {
+			return maxRetryBackoff
+		}
+	}
+
+	return backoff
+}
+
+// retryTask schedules a failed task into its lane after a backoff
+// in the schema version it was read in,
+// or moves it to the dead-letter queue once attempts run out.
+// The delivery is acked once the task is scheduled, so the backoff
+// neither holds a consumer nor is lost when the consumer stops.
+func (tc *TaskConsumer) retryTask(delivery queue.Delivery, lane *taskLane, task schema.TranscodeTask, version int, lastError error) {
+	task.Attempts++
+	task.LastError = lastError.Error()
+
+	if task.Attempts >= taskMaxAttempts {
+		tc.deadLetterTask(delivery, task, version, lastError)
+		return
+	}
+
+	atomic.AddInt64(&tc.retriedCount, 1)
+
+	backoff := retryBackoff(task.Attempts)
+	glog.Warningf("%s: task %s attempt %d/%d failed, retrying in %s: %s\n", tc.name, task.VideoID, task.Attempts, taskMaxAttempts, backoff, lastError)
+
+	payload, err := schema.EncodeTranscodeTask(task, version)
+	if err != nil {
+		glog.Errorf("Failed to encode task %s for retry: %s\n", task.VideoID, err)
+		tc.reject(delivery)
+		return
+	}
+
+	if err = lane.taskQueue.PublishAt(payload, time.Now().Add(backoff)); err != nil {
+		glog.Errorf("Failed to schedule retry of task %s: %s\n", task.VideoID, err)
+		tc.reject(delivery)
+		return
+	}
+
+	tc.ack(delivery)
+}
+
+// deadLetterTask moves a task which can't succeed to the dead-letter queue
+// with its last error attached, keeping the schema version it was read in
+func (tc *TaskConsumer) deadLetterTask(delivery queue.Delivery, task schema.TranscodeTask, version int, lastError error) {
+	task.LastError = lastError.Error()
+
+	payload, err := schema.EncodeTranscodeTask(task, version)
+	if err != nil {
+		glog.Errorf("Failed to encode task %s for dead-letter queue: %s\n", task.VideoID, err)
+		tc.reject(delivery)
+		return
+	}
+
+	if err = tc.deadLetterQueue.Publish(payload); err != nil {
+		glog.Errorf("Failed to move task %s to dead-letter queue: %s\n", task.VideoID, err)
+		tc.reject(delivery)
+		return
+	}
+
+	atomic.AddInt64(&tc.deadLetteredCount, 1)
+	glog.Errorf("%s: task %s moved to dead-letter queue after %d attempts: %s\n", tc.name, task.VideoID, task.Attempts, lastError)
+	tc.ack(delivery)
+}
+
+// deadLetterQueueName returns the queue name holding dead tasks of given topic
+func deadLetterQueueName(topic string) string {
+	return fmt.Sprintf("%s_dead", topic)
+}
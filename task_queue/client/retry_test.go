@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/n1207n/video-transcode-queue/api/common/queue"
+	"github.com/n1207n/video-transcode-queue/api/common/schema"
+)
+
+// recordingQueue records what is published to it,
+// the TaskQueue methods retries don't use are left unimplemented
+type recordingQueue struct {
+	queue.TaskQueue
+
+	payloads    []string
+	scheduledAt []time.Time
+}
+
+func (q *recordingQueue) Publish(payload []byte) error {
+	q.payloads = append(q.payloads, string(payload))
+	q.scheduledAt = append(q.scheduledAt, time.Time{})
+
+	return nil
+}
+
+func (q *recordingQueue) PublishAt(payload []byte, notBefore time.Time) error {
+	q.payloads = append(q.payloads, string(payload))
+	q.scheduledAt = append(q.scheduledAt, notBefore)
+
+	return nil
+}
+
+// recordingDelivery records how it was closed
+type recordingDelivery struct {
+	payload    string
+	isAcked    bool
+	isRejected bool
+}
+
+func (d *recordingDelivery) Payload() string {
+	return d.payload
+}
+
+func (d *recordingDelivery) Ack() error {
+	d.isAcked = true
+	return nil
+}
+
+func (d *recordingDelivery) Reject() error {
+	d.isRejected = true
+	return nil
+}
+
+func TestRetryBackoff(t *testing.T) {
+	defer func(backoff time.Duration) { retryBaseBackoff = backoff }(retryBaseBackoff)
+	retryBaseBackoff = 10 * time.Second
+
+	tests := []struct {
+		attempt         int
+		expectedBackoff time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{4, 80 * time.Second},
+		{6, 320 * time.Second},
+		{7, maxRetryBackoff},
+		{30, maxRetryBackoff},
+		{200, maxRetryBackoff},
+	}
+
+	for _, test := range tests {
+		if backoff := retryBackoff(test.attempt); backoff != test.expectedBackoff {
+			t.Errorf("retryBackoff(%d) = %s, want %s", test.attempt, backoff, test.expectedBackoff)
+		}
+	}
+}
+
+func TestRetryTask(t *testing.T) {
+	defer func(attempts int) { taskMaxAttempts = attempts }(taskMaxAttempts)
+	taskMaxAttempts = 3
+
+	tests := []struct {
+		name                string
+		attempts            int
+		expectedAttempts    int
+		isExpectedDead      bool
+		expectedScheduledIn time.Duration
+	}{
+		{name: "first failure", attempts: 0, expectedAttempts: 1, expectedScheduledIn: retryBackoff(1)},
+		{name: "second failure", attempts: 1, expectedAttempts: 2, expectedScheduledIn: retryBackoff(2)},
+		{name: "last attempt", attempts: 2, expectedAttempts: 3, isExpectedDead: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			laneQueue := &recordingQueue{}
+			deadLetterQueue := &recordingQueue{}
+			consumer := &TaskConsumer{name: "test", deadLetterQueue: deadLetterQueue}
+
+			task := schema.TranscodeTask{VideoID: "12", FilePath: "12/source.mp4", Attempts: test.attempts, LastError: "previous error"}
+			delivery := &recordingDelivery{}
+
+			retriedAt := time.Now()
+			consumer.retryTask(delivery, &taskLane{taskQueue: laneQueue}, task, schema.Version, errors.New("transcoder busy"))
+
+			if !delivery.isAcked || delivery.isRejected {
+				t.Errorf("delivery acked %t and rejected %t, want acked", delivery.isAcked, delivery.isRejected)
+			}
+
+			publishedQueue, otherQueue := laneQueue, deadLetterQueue
+			if test.isExpectedDead {
+				publishedQueue, otherQueue = deadLetterQueue, laneQueue
+			}
+
+			if len(publishedQueue.payloads) != 1 || len(otherQueue.payloads) != 0 {
+				t.Fatalf("published %d retries and %d dead tasks", len(laneQueue.payloads), len(deadLetterQueue.payloads))
+			}
+
+			publishedTask, version, err := schema.DecodeTranscodeTask([]byte(publishedQueue.payloads[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if version != schema.Version {
+				t.Errorf("published version %d, want %d", version, schema.Version)
+			}
+
+			if publishedTask.Attempts != test.expectedAttempts || publishedTask.LastError != "transcoder busy" {
+				t.Errorf("published attempts %d and last error %q, want %d and %q", publishedTask.Attempts, publishedTask.LastError, test.expectedAttempts, "transcoder busy")
+			}
+
+			if !test.isExpectedDead {
+				scheduledIn := publishedQueue.scheduledAt[0].Sub(retriedAt)
+				if scheduledIn < test.expectedScheduledIn || scheduledIn > test.expectedScheduledIn+time.Second {
+					t.Errorf("retry scheduled in %s, want %s", scheduledIn, test.expectedScheduledIn)
+				}
+			}
+		})
+	}
+}
+
+func TestDeadLetterTaskKeepsLegacyVersion(t *testing.T) {
+	deadLetterQueue := &recordingQueue{}
+	consumer := &TaskConsumer{name: "test", deadLetterQueue: deadLetterQueue}
+
+	task := schema.TranscodeTask{VideoID: "12", FilePath: "12/source.mp4", Attempts: 1}
+	consumer.deadLetterTask(&recordingDelivery{}, task, schema.VersionLegacy, errors.New("bad request"))
+
+	if len(deadLetterQueue.payloads) != 1 {
+		t.Fatalf("published %d dead tasks, want 1", len(deadLetterQueue.payloads))
+	}
+
+	deadTask, version, err := schema.DecodeTranscodeTask([]byte(deadLetterQueue.payloads[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != schema.VersionLegacy || deadTask.LastError != "bad request" || deadTask.Attempts != 1 {
+		t.Errorf("dead task %+v of version %d, want version %d with the last error", deadTask, version, schema.VersionLegacy)
+	}
+}
+
+func TestIsRetryableStatus(t *testing.T) {
+	tests := []struct {
+		statusCode  int
+		isRetryable bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusBadRequest, false},
+		{http.StatusNotFound, false},
+		{http.StatusConflict, false},
+		{http.StatusUnprocessableEntity, false},
+		{http.StatusRequestTimeout, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusBadGateway, true},
+		{http.StatusServiceUnavailable, true},
+	}
+
+	for _, test := range tests {
+		if isRetryable := isRetryableStatus(test.statusCode); isRetryable != test.isRetryable {
+			t.Errorf("isRetryableStatus(%d) = %t, want %t", test.statusCode, isRetryable, test.isRetryable)
+		}
+	}
+}
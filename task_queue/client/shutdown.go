@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/n1207n/video-transcode-queue/api/common/queue"
+)
+
+var (
+	// consumersStopping is closed once a shutdown signal arrives,
+	// consumers then hand deliveries back instead of processing them
+	consumersStopping = make(chan struct{})
+
+	// inFlightCount counts deliveries handed to consumers and not done yet
+	inFlightCount int64
+)
+
+// isStopping tells if the consumer is shutting down
+func isStopping() bool {
+	select {
+	case <-consumersStopping:
+		return true
+	default:
+		return false
+	}
+}
+
+func beginInFlight() {
+	atomic.AddInt64(&inFlightCount, 1)
+}
+
+func endInFlight() {
+	atomic.AddInt64(&inFlightCount, -1)
+}
+
+// returnDelivery puts a delivery which wasn't processed back to the ready queue of its lane
+func (tc *TaskConsumer) returnDelivery(delivery queue.Delivery, lane *taskLane) {
+	if lane.taskQueue.Publish([]byte(delivery.Payload())) == nil {
+		glog.Infof("%s returned an unprocessed delivery to the ready queue\n", tc.name)
+		tc.ack(delivery)
+	} else {
+		tc.reject(delivery)
+	}
+}
+
+// drainConsumers stops fetching new deliveries and waits
+// for in-flight ones up to given timeout.
+// Deliveries left unacked after that are recovered by the queue cleaner.
+func drainConsumers(taskQueues []queue.TaskQueue, scheduler *laneScheduler, timeout time.Duration) {
+	close(consumersStopping)
+
+	for _, taskQueue := range taskQueues {
+		taskQueue.StopConsuming()
+	}
+
+	scheduler.stop()
+
+	glog.Infof("Draining task consumers, waiting up to %s\n", timeout)
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if atomic.LoadInt64(&inFlightCount) == 0 {
+			glog.Infoln("Task consumers drained")
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	glog.Warningf("%d deliveries still in flight after %s\n", atomic.LoadInt64(&inFlightCount), timeout)
+}